@@ -0,0 +1,382 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// apiKeyPrefix starts every API key, so leaked keys are easy to recognise and scan for.
+const apiKeyPrefix = "gbk_"
+
+var (
+	// ErrAPIKeyNotFound is returned by an APIKeyStore when no key matches.
+	ErrAPIKeyNotFound = errors.New("API key not found")
+	// ErrInvalidAPIKey is returned by authenticateAPIKey for a malformed, unknown, expired or revoked key.
+	ErrInvalidAPIKey = errors.New("invalid API key")
+)
+
+// APIKey is the server-side record of an API key. The key itself is "gbk_<ID>_<secret>"; only
+// its SHA-256 is stored.
+type APIKey struct {
+	ID         string
+	Hash       string
+	UserID     string
+	Name       string
+	Scopes     []string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time // Zero for keys that do not expire.
+	LastUsedAt time.Time // Zero until the key is first used.
+	Revoked    bool
+}
+
+// expired reports whether the key has expired at now.
+func (k *APIKey) expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && now.After(k.ExpiresAt)
+}
+
+// APIKeyStore persists API key records. Implementations must be safe for concurrent use and
+// return copies.
+type APIKeyStore interface {
+	// Create stores a new key.
+	Create(k *APIKey) error
+	// Get returns the key with the given ID.
+	Get(id string) (*APIKey, error)
+	// ListByUser returns a user's keys, oldest first.
+	ListByUser(userID string) ([]APIKey, error)
+	// Touch records that the key was used at t.
+	Touch(id string, t time.Time) error
+	// Revoke revokes a key.
+	Revoke(id string) error
+}
+
+// memoryAPIKeyStore is an APIKeyStore that keeps keys in memory.
+type memoryAPIKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]APIKey // By ID.
+}
+
+// newMemoryAPIKeyStore returns an empty in-memory API key store.
+func newMemoryAPIKeyStore() *memoryAPIKeyStore {
+	return &memoryAPIKeyStore{keys: make(map[string]APIKey)}
+}
+
+// cloneAPIKey returns a copy of k that shares no slices with it.
+func cloneAPIKey(k APIKey) *APIKey {
+	k.Scopes = append([]string(nil), k.Scopes...)
+	return &k
+}
+
+func (s *memoryAPIKeyStore) Create(k *APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.keys[k.ID]; ok {
+		return fmt.Errorf("duplicate API key ID %q", k.ID)
+	}
+	s.keys[k.ID] = *cloneAPIKey(*k)
+	return nil
+}
+
+func (s *memoryAPIKeyStore) Get(id string) (*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.keys[id]
+	if !ok {
+		return nil, ErrAPIKeyNotFound
+	}
+	return cloneAPIKey(k), nil
+}
+
+func (s *memoryAPIKeyStore) ListByUser(userID string) ([]APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []APIKey
+	for _, k := range s.keys {
+		if k.UserID == userID {
+			keys = append(keys, *cloneAPIKey(k))
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (s *memoryAPIKeyStore) Touch(id string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.keys[id]
+	if !ok {
+		return ErrAPIKeyNotFound
+	}
+	k.LastUsedAt = t
+	s.keys[id] = k
+	return nil
+}
+
+func (s *memoryAPIKeyStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.keys[id]
+	if !ok {
+		return ErrAPIKeyNotFound
+	}
+	k.Revoked = true
+	s.keys[id] = k
+	return nil
+}
+
+// apiKeys holds the issued API keys.
+var apiKeys APIKeyStore = newMemoryAPIKeyStore()
+
+// createAPIKey issues a key for user limited to scopes, which must all be granted to the user
+// and be among allowed, the scopes of the access token the key is created with, so a key
+// never carries more than the token it was made with. A zero ttl creates a key that does not
+// expire. The returned string is the only copy of the key.
+func createAPIKey(user *User, allowed []string, name string, scopes []string, ttl time.Duration) (string, *APIKey, error) {
+	granted := grantedScopes(user)
+	for _, scope := range scopes {
+		if !containsString(granted, scope) {
+			return "", nil, fmt.Errorf("scope %q is not granted to %s", scope, user.Username)
+		}
+		if !containsString(allowed, scope) {
+			return "", nil, fmt.Errorf("scope %q is not granted to the access token", scope)
+		}
+	}
+
+	id := newID()[:16]
+	key := apiKeyPrefix + id + "_" + newOpaqueToken()
+	k := &APIKey{
+		ID:        id,
+		Hash:      hashToken(key),
+		UserID:    user.ID,
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+	}
+	if ttl > 0 {
+		k.ExpiresAt = k.CreatedAt.Add(ttl)
+	}
+	if err := apiKeys.Create(k); err != nil {
+		return "", nil, err
+	}
+	return key, k, nil
+}
+
+// revokeUserAPIKeys revokes every API key of a user.
+func revokeUserAPIKeys(userID string) error {
+	keys, err := apiKeys.ListByUser(userID)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if k.Revoked {
+			continue
+		}
+		if err := apiKeys.Revoke(k.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// authenticateAPIKey returns the caller identified by an API key and records its use. The
+// key's scopes are narrowed to those its user is still granted.
+func authenticateAPIKey(key string) (*Principal, error) {
+	rest := strings.TrimPrefix(key, apiKeyPrefix)
+	parts := strings.SplitN(rest, "_", 2)
+	if rest == key || len(parts) != 2 {
+		return nil, ErrInvalidAPIKey
+	}
+
+	k, err := apiKeys.Get(parts[0])
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if subtle.ConstantTimeCompare([]byte(hashToken(key)), []byte(k.Hash)) != 1 || k.Revoked || k.expired(now) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	user, err := userStore.GetByID(k.UserID)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := apiKeys.Touch(k.ID, now); err != nil {
+		return nil, err
+	}
+
+	p := &Principal{
+		UserID:    user.ID,
+		Username:  user.Username,
+		Roles:     grantedRoles(user),
+		APIKeyID:  k.ID,
+		ExpiresAt: k.ExpiresAt,
+	}
+	granted := grantedScopes(user)
+	for _, scope := range k.Scopes {
+		if containsString(granted, scope) {
+			p.Scopes = append(p.Scopes, scope)
+		}
+	}
+	return p, nil
+}
+
+// maxAPIKeyExpiresIn is the largest ExpiresIn, in seconds, that fits in a time.Duration.
+const maxAPIKeyExpiresIn = math.MaxInt64 / int64(time.Second)
+
+// apiKeyRequest is the body of POST /api/keys. ExpiresIn is in seconds; 0 never expires.
+type apiKeyRequest struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn int64    `json:"expires_in"`
+}
+
+// apiKeyResponse describes an API key. Key is only set when the key is created.
+type apiKeyResponse struct {
+	ID         string     `json:"id"`
+	Key        string     `json:"key,omitempty"`
+	Prefix     string     `json:"prefix"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	Revoked    bool       `json:"revoked"`
+}
+
+// newAPIKeyResponse describes k without its secret.
+func newAPIKeyResponse(k *APIKey) apiKeyResponse {
+	resp := apiKeyResponse{
+		ID:        k.ID,
+		Prefix:    apiKeyPrefix + k.ID,
+		Name:      k.Name,
+		Scopes:    append([]string{}, k.Scopes...),
+		CreatedAt: k.CreatedAt,
+		Revoked:   k.Revoked,
+	}
+	if !k.ExpiresAt.IsZero() {
+		resp.ExpiresAt = &k.ExpiresAt
+	}
+	if !k.LastUsedAt.IsZero() {
+		resp.LastUsedAt = &k.LastUsedAt
+	}
+	return resp
+}
+
+// tokenPrincipal returns the caller if they authenticated with an access token rather than an
+// API key. Account operations such as managing API keys require a token, so that a leaked key
+// cannot be used to mint more.
+func tokenPrincipal(w http.ResponseWriter, r *http.Request) (*Principal, bool) {
+	p, ok := PrincipalFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return nil, false
+	}
+	if p.APIKeyID != "" {
+		http.Error(w, "This endpoint requires an access token, not an API key", http.StatusForbidden)
+		return nil, false
+	}
+	return p, true
+}
+
+// createAPIKeyHandler issues an API key for the caller.
+func createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := tokenPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	var req apiKeyRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxAuthBodyBytes)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid API key request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" || len(req.Scopes) == 0 || req.ExpiresIn < 0 {
+		http.Error(w, "Invalid API key request: a name and at least one scope are required", http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresIn > maxAPIKeyExpiresIn {
+		http.Error(w, fmt.Sprintf("Invalid API key request: expires_in must be at most %d seconds", maxAPIKeyExpiresIn), http.StatusBadRequest)
+		return
+	}
+
+	user, err := userStore.GetByID(p.UserID)
+	if err != nil {
+		http.Error(w, "Error looking up user", http.StatusInternalServerError)
+		return
+	}
+	key, k, err := createAPIKey(user, p.Scopes, strings.TrimSpace(req.Name), req.Scopes, time.Duration(req.ExpiresIn)*time.Second)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid API key request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	auditLog(r).Infof("Created API key %s (%s) with scopes %v", k.ID, k.Name, k.Scopes)
+
+	resp := newAPIKeyResponse(k)
+	resp.Key = key
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSONStatus(w, http.StatusCreated, resp)
+}
+
+// listAPIKeysHandler lists the caller's API keys without their secrets.
+func listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := tokenPrincipal(w, r)
+	if !ok {
+		return
+	}
+	keys, err := apiKeys.ListByUser(p.UserID)
+	if err != nil {
+		http.Error(w, "Error listing API keys", http.StatusInternalServerError)
+		return
+	}
+	resp := make([]apiKeyResponse, 0, len(keys))
+	for i := range keys {
+		resp = append(resp, newAPIKeyResponse(&keys[i]))
+	}
+	writeJSON(w, resp)
+}
+
+// revokeAPIKeyHandler revokes one of the caller's API keys. Admins can revoke anyone's, with a
+// second factor if the admin routes require one.
+func revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := tokenPrincipal(w, r)
+	if !ok {
+		return
+	}
+	k, err := apiKeys.Get(mux.Vars(r)["id"])
+	if errors.Is(err, ErrAPIKeyNotFound) || (err == nil && k.UserID != p.UserID && !actsAsAdmin(p)) {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error looking up API key", http.StatusInternalServerError)
+		return
+	}
+	if err := apiKeys.Revoke(k.ID); err != nil {
+		http.Error(w, "Error revoking API key", http.StatusInternalServerError)
+		return
+	}
+	auditLog(r).Infof("Revoked API key %s of user %s", k.ID, k.UserID)
+	w.WriteHeader(http.StatusNoContent)
+}
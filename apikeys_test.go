@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useAPIKeyStore swaps apiKeys for the duration of a test.
+func useAPIKeyStore(t *testing.T, store APIKeyStore) {
+	original := apiKeys
+	apiKeys = store
+	t.Cleanup(func() { apiKeys = original })
+}
+
+// apiKeyRequestTo sends a request with an X-API-Key header through the application router.
+func apiKeyRequestTo(method, target, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set("X-API-Key", key)
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+// TestAPIKeyLifecycle tests creating, using, listing and revoking an API key.
+func TestAPIKeyLifecycle(t *testing.T) {
+	useRateLimits(t)
+	user := newTestUser(t, "ci-bot", "ci-bot-password")
+	useAPIKeyStore(t, newMemoryAPIKeyStore())
+	useRevocationStore(t, newMemoryRevocationStore())
+	useProvider(t, &fakeProvider{search: func(q SearchQuery) (*SearchResult, error) {
+		return &SearchResult{Docs: []Book{{Title: "Test Book"}}}, nil
+	}})
+	token, err := issueAccessToken(user, "", tokenGrant{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	create := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/keys", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		newRouter().ServeHTTP(rr, req)
+		return rr
+	}
+	if rr := create(`{"name": "smoke tests", "scopes": ["users:admin"]}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected a scope the user lacks to be refused, got %d", rr.Code)
+	}
+	if rr := create(`{"scopes": ["books:read"]}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected a key without a name to be refused, got %d", rr.Code)
+	}
+	if rr := create(`{"name": "smoke tests", "scopes": ["books:read"], "expires_in": 9223372037}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected an expiry that overflows to be refused, got %d", rr.Code)
+	}
+
+	rr := create(`{"name": "smoke tests", "scopes": ["books:read"], "expires_in": 3600}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var created apiKeyResponse
+	if err := json.NewDecoder(rr.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(created.Key, created.Prefix+"_") || !strings.HasPrefix(created.Prefix, apiKeyPrefix) || created.ExpiresAt == nil {
+		t.Fatalf("unexpected key %+v", created)
+	}
+	stored, err := apiKeys.Get(created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Hash == created.Key || stored.Hash != hashToken(created.Key) {
+		t.Errorf("expected only the key's hash to be stored")
+	}
+
+	if rr := apiKeyRequestTo("GET", "/api/search?q=go", created.Key); rr.Code != http.StatusOK {
+		t.Fatalf("expected the key to be accepted, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := apiKeyRequestTo("GET", "/api/cache/stats", created.Key); rr.Code != http.StatusForbidden {
+		t.Errorf("expected the key to be limited to its scopes, got %d", rr.Code)
+	}
+	if rr := apiKeyRequestTo("GET", "/api/keys", created.Key); rr.Code != http.StatusForbidden {
+		t.Errorf("expected a key not to be able to manage keys, got %d", rr.Code)
+	}
+	if rr := apiKeyRequestTo("GET", "/api/search?q=go", created.Key+"x"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected a wrong secret to be rejected, got %d", rr.Code)
+	}
+
+	rr = authorizedRequest("GET", "/api/keys", token)
+	var listed []apiKeyResponse
+	if err := json.NewDecoder(rr.Body).Decode(&listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].Key != "" || listed[0].LastUsedAt == nil {
+		t.Fatalf("expected one key with a last-used time and no secret, got %+v", listed)
+	}
+
+	if rr := authorizedRequest("DELETE", "/api/keys/"+created.ID, token); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected the key to be revoked, got %d", rr.Code)
+	}
+	if rr := apiKeyRequestTo("GET", "/api/search?q=go", created.Key); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected a revoked key to be rejected, got %d", rr.Code)
+	}
+}
+
+// TestAuthenticateAPIKey tests rejection of malformed and expired keys, and that keys lose
+// scopes their user no longer has.
+func TestAuthenticateAPIKey(t *testing.T) {
+	store := newMemoryUserStore()
+	useUserStore(t, store)
+	useAPIKeyStore(t, newMemoryAPIKeyStore())
+	user, err := registerUser(store, "librarian", "librarianpassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Roles = []string{roleLibrarian}
+	if err := store.Update(user); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"", "gbk_", "gbk_nosecret", "other_abc_def", "gbk_unknown_secret"} {
+		if _, err := authenticateAPIKey(key); err != ErrInvalidAPIKey {
+			t.Errorf("expected %q to be invalid, got %v", key, err)
+		}
+	}
+
+	expiring, _, err := createAPIKey(user, grantedScopes(user), "expiring", []string{scopeBooksRead}, time.Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if _, err := authenticateAPIKey(expiring); err != ErrInvalidAPIKey {
+		t.Errorf("expected an expired key to be invalid, got %v", err)
+	}
+
+	if _, _, err := createAPIKey(user, []string{scopeBooksRead}, "stats", []string{scopeCacheRead}, 0); err == nil {
+		t.Error("expected a scope the access token lacks to be refused")
+	}
+	key, _, err := createAPIKey(user, grantedScopes(user), "stats", []string{scopeBooksRead, scopeCacheRead}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := authenticateAPIKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.HasScope(scopeCacheRead) || p.UserID != user.ID || p.APIKeyID == "" {
+		t.Errorf("unexpected principal %+v", p)
+	}
+
+	user.Roles = []string{roleReader}
+	if err := store.Update(user); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := authenticateAPIKey(key); err != nil || p.HasScope(scopeCacheRead) {
+		t.Errorf("expected the key to lose the cache:read scope, got %+v, %v", p, err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// maxAuthBodyBytes bounds the size of credential request bodies.
+const maxAuthBodyBytes = 1 << 16
+
+// legacyLoginEnabled controls whether the deprecated GET /login route is registered.
+var legacyLoginEnabled = true
+
+// credentials are a username and password submitted by a client.
+type credentials struct {
+	Username string
+	Password string
+}
+
+// tokenResponse is the OAuth2 (RFC 6749 section 5.1) style body returned on successful login.
+// Scope and IDToken are only set for OAuth clients.
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+}
+
+// oauthError is the OAuth2 (RFC 6749 section 5.2) style error body.
+type oauthError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// readAuthBody reads the string fields of a JSON object or form-encoded request body.
+// Query parameters are ignored so credentials and tokens never end up in URLs.
+func readAuthBody(w http.ResponseWriter, r *http.Request) (map[string]string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxAuthBodyBytes)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		var fields map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+			return nil, fmt.Errorf("invalid JSON body: %v", err)
+		}
+		return fields, nil
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		if err := r.ParseMultipartForm(maxAuthBodyBytes); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+			return nil, fmt.Errorf("invalid form body: %v", err)
+		}
+		fields := make(map[string]string, len(r.PostForm))
+		for key := range r.PostForm {
+			fields[key] = r.PostForm.Get(key)
+		}
+		return fields, nil
+	default:
+		return nil, errors.New("content type must be application/json or application/x-www-form-urlencoded")
+	}
+}
+
+// readCredentials reads a username and password from a JSON or form-encoded request body.
+func readCredentials(w http.ResponseWriter, r *http.Request) (credentials, error) {
+	body, err := readAuthBody(w, r)
+	if err != nil {
+		return credentials{}, err
+	}
+	creds := credentials{Username: body["username"], Password: body["password"]}
+	if creds.Username == "" || creds.Password == "" {
+		return credentials{}, errors.New("missing credentials")
+	}
+	return creds, nil
+}
+
+// tokenLoginHandler authenticates the credentials in the request body and responds with an
+// OAuth2-style token response. Users with two-factor authentication get an mfa_required
+// challenge instead, to answer at POST /auth/login/mfa.
+func tokenLoginHandler(w http.ResponseWriter, r *http.Request) {
+	// Token responses must not be cached (RFC 6749 section 5.1).
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	creds, err := readCredentials(w, r)
+	if err != nil {
+		writeJSONStatus(w, http.StatusBadRequest, oauthError{Error: "invalid_request", ErrorDescription: err.Error()})
+		return
+	}
+
+	user, err := login(r, creds.Username, creds.Password)
+	var throttled *throttledError
+	if errors.As(err, &throttled) {
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(throttled.retryAfter)))
+		writeJSONStatus(w, http.StatusTooManyRequests, oauthError{Error: "invalid_grant", ErrorDescription: "Too many failed login attempts"})
+		return
+	}
+	if errors.Is(err, ErrInvalidCredentials) {
+		writeJSONStatus(w, http.StatusUnauthorized, oauthError{Error: "invalid_grant", ErrorDescription: "Invalid username or password"})
+		return
+	}
+	if err != nil {
+		writeJSONStatus(w, http.StatusInternalServerError, oauthError{Error: "server_error"})
+		return
+	}
+
+	if user.MFAEnabled() {
+		writeMFAChallenge(w, user)
+		return
+	}
+	resp, err := issueTokens(user, "", tokenGrant{AMR: amrPassword})
+	if err != nil {
+		writeJSONStatus(w, http.StatusInternalServerError, oauthError{Error: "server_error"})
+		return
+	}
+	writeJSON(w, resp)
+}
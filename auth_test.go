@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestUser registers a user in a fresh user store used for the duration of the test.
+func newTestUser(t *testing.T, username, password string) *User {
+	t.Helper()
+	store := newMemoryUserStore()
+	user, err := registerUser(store, username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useUserStore(t, store)
+	return user
+}
+
+// TestTokenLoginHandler tests POST /auth/login with JSON and form bodies.
+func TestTokenLoginHandler(t *testing.T) {
+	newTestUser(t, "reader", "readerpassword")
+	useLoginGuard(t, defaultLoginGuardConfig)
+
+	tests := []struct {
+		name           string
+		target         string
+		contentType    string
+		body           string
+		expectedStatus int
+		expectedError  string
+	}{
+		{"json", "/auth/login", "application/json", `{"username": "reader", "password": "readerpassword"}`, http.StatusOK, ""},
+		{"form", "/auth/login", "application/x-www-form-urlencoded", "username=reader&password=readerpassword", http.StatusOK, ""},
+		{"wrong password", "/auth/login", "application/json", `{"username": "reader", "password": "nope-nope"}`, http.StatusUnauthorized, "invalid_grant"},
+		{"malformed json", "/auth/login", "application/json", `{"username": `, http.StatusBadRequest, "invalid_request"},
+		{"unsupported content type", "/auth/login", "text/plain", "reader:readerpassword", http.StatusBadRequest, "invalid_request"},
+		{"query string ignored", "/auth/login?username=reader&password=readerpassword", "application/x-www-form-urlencoded", "", http.StatusBadRequest, "invalid_request"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tc.target, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", tc.contentType)
+			rr := httptest.NewRecorder()
+			tokenLoginHandler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tc.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if rr.Header().Get("Cache-Control") != "no-store" {
+				t.Error("expected Cache-Control: no-store")
+			}
+
+			if tc.expectedError != "" {
+				var body oauthError
+				if err := json.NewDecoder(rr.Body).Decode(&body); err != nil || body.Error != tc.expectedError {
+					t.Errorf("expected error %q, got %+v (%v)", tc.expectedError, body, err)
+				}
+				return
+			}
+			var body tokenResponse
+			if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+				t.Fatalf("decoding token response: %v", err)
+			}
+			if body.AccessToken == "" || body.TokenType != "Bearer" || body.ExpiresIn <= 0 || body.RefreshToken == "" {
+				t.Errorf("unexpected token response %+v", body)
+			}
+		})
+	}
+}
+
+// TestLegacyLoginRoute tests that GET /login can be disabled by configuration.
+func TestLegacyLoginRoute(t *testing.T) {
+	useRateLimits(t)
+	useLoginGuard(t, defaultLoginGuardConfig)
+	newTestUser(t, "reader", "readerpassword")
+	defer func(enabled bool) { legacyLoginEnabled = enabled }(legacyLoginEnabled)
+
+	for _, enabled := range []bool{true, false} {
+		legacyLoginEnabled = enabled
+		rr := httptest.NewRecorder()
+		newRouter().ServeHTTP(rr, httptest.NewRequest("GET", "/login?username=reader&password=readerpassword", nil))
+
+		if enabled && rr.Code != http.StatusOK {
+			t.Errorf("expected GET /login to work when enabled, got %d", rr.Code)
+		}
+		if !enabled && rr.Code == http.StatusOK {
+			t.Errorf("expected GET /login to be gone when disabled, got %d", rr.Code)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+// Scopes that API routes require.
+const (
+	scopeBooksRead  = "books:read"  // Search and look up books.
+	scopeCacheRead  = "cache:read"  // Read the response cache statistics.
+	scopeUsersAdmin = "users:admin" // Manage other users' roles and sessions.
+)
+
+// Roles users can have.
+const (
+	roleReader    = "reader"
+	roleLibrarian = "librarian"
+	roleAdmin     = "admin"
+)
+
+// roleScopes are the scopes each role grants.
+var roleScopes = map[string][]string{
+	roleReader:    {scopeBooksRead},
+	roleLibrarian: {scopeBooksRead, scopeCacheRead},
+	roleAdmin:     {scopeBooksRead, scopeCacheRead, scopeUsersAdmin},
+}
+
+// isKnownScope reports whether some role grants scope.
+func isKnownScope(scope string) bool {
+	for _, scopes := range roleScopes {
+		if containsString(scopes, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// isFirstPartyScope reports whether scope is reserved for the user's own logins. OAuth clients
+// cannot ask for it, because users authorize them without a separate consent step.
+func isFirstPartyScope(scope string) bool {
+	return scope == scopeUsersAdmin
+}
+
+// adminUserIDs are the IDs of the users that always have the admin role, from ADMIN_USER_IDS.
+// It bootstraps the first admin, who can then assign roles to others. It lists IDs rather
+// than usernames, because anyone can register a username that is not taken yet.
+var adminUserIDs = map[string]bool{}
+
+// adminUserIDsFromEnv reads the comma-separated ADMIN_USER_IDS list.
+func adminUserIDsFromEnv() map[string]bool {
+	admins := make(map[string]bool)
+	for _, id := range splitList(os.Getenv("ADMIN_USER_IDS")) {
+		admins[id] = true
+	}
+	return admins
+}
+
+// grantedRoles returns the sorted roles of a user. Users without roles, such as accounts
+// created before roles existed, are readers.
+func grantedRoles(u *User) []string {
+	roles := append([]string(nil), u.Roles...)
+	if len(roles) == 0 {
+		roles = append(roles, roleReader)
+	}
+	if adminUserIDs[u.ID] && !containsString(roles, roleAdmin) {
+		roles = append(roles, roleAdmin)
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// grantedScopes returns the sorted scopes a user's roles grant, plus the user's extra scopes.
+func grantedScopes(u *User) []string {
+	var scopes []string
+	for _, role := range grantedRoles(u) {
+		for _, scope := range roleScopes[role] {
+			if !containsString(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	for _, scope := range u.Scopes {
+		if !containsString(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+// scopeError is the body of a 403 response for a token lacking a required scope.
+type scopeError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+	RequiredScope    string `json:"required_scope"`
+}
+
+// RequireScope returns middleware that only lets requests whose access token has scope through.
+// It must run after jwtMiddleware. Other requests get 403 with an insufficient_scope error.
+func RequireScope(scope string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if p, ok := PrincipalFromContext(r.Context()); !ok || !p.HasScope(scope) {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+				writeJSONStatus(w, http.StatusForbidden, scopeError{
+					Error:            "insufficient_scope",
+					ErrorDescription: fmt.Sprintf("The access token does not grant the %s scope", scope),
+					RequiredScope:    scope,
+				})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireMFA is middleware that only lets requests through whose access token was obtained with
+// a second factor. It must run after jwtMiddleware. Other requests, including those with API
+// keys, get 401 with an insufficient_user_authentication error (RFC 9470) telling the client
+// to log in again with two-factor authentication.
+func RequireMFA(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p, ok := PrincipalFromContext(r.Context()); !ok || !p.HasMFA() {
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_user_authentication", error_description="Two-factor authentication required"`)
+			writeJSONStatus(w, http.StatusUnauthorized, oauthError{
+				Error:            "insufficient_user_authentication",
+				ErrorDescription: "Two-factor authentication required",
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// actsAsAdmin reports whether p may use admin powers outside /api/admin: whether it has the
+// users:admin scope and, if ADMIN_REQUIRE_MFA is set, was obtained with a second factor.
+func actsAsAdmin(p *Principal) bool {
+	return p.HasScope(scopeUsersAdmin) && (!adminMFARequired || p.HasMFA())
+}
+
+// RequireFirstParty is middleware that refuses access tokens issued to OAuth clients. It guards
+// account management, such as API keys and two-factor settings, and administration, which a
+// user authorizing a client to read books on their behalf has not handed over. It must run
+// after jwtMiddleware. Other requests get 403 with an insufficient_scope error.
+func RequireFirstParty(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p, ok := PrincipalFromContext(r.Context()); !ok || p.ClientID != "" {
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", error_description="A go-books login is required"`)
+			writeJSONStatus(w, http.StatusForbidden, oauthError{
+				Error:            "insufficient_scope",
+				ErrorDescription: "Account management and administration require a go-books login, not a token issued to an OAuth client",
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rolesRequest is the body of PUT /api/admin/users/{id}/roles.
+type rolesRequest struct {
+	Roles  []string `json:"roles"`
+	Scopes []string `json:"scopes"`
+}
+
+// rolesResponse describes a user's roles and the scopes they grant.
+type rolesResponse struct {
+	ID       string   `json:"id"`
+	Username string   `json:"username"`
+	Roles    []string `json:"roles"`
+	Scopes   []string `json:"scopes"`
+}
+
+// setRolesHandler replaces the roles and extra scopes of the user named in the path. The
+// user's sessions are revoked so that tokens carrying the old scopes stop working.
+func setRolesHandler(w http.ResponseWriter, r *http.Request) {
+	var req rolesRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxAuthBodyBytes)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid roles: %v", err), http.StatusBadRequest)
+		return
+	}
+	for _, role := range req.Roles {
+		if _, ok := roleScopes[role]; !ok {
+			http.Error(w, fmt.Sprintf("Invalid roles: unknown role %q", role), http.StatusBadRequest)
+			return
+		}
+	}
+	for _, scope := range req.Scopes {
+		if !isKnownScope(scope) {
+			http.Error(w, fmt.Sprintf("Invalid roles: unknown scope %q", scope), http.StatusBadRequest)
+			return
+		}
+	}
+
+	user, err := userStore.GetByID(mux.Vars(r)["id"])
+	if errors.Is(err, ErrUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error looking up user", http.StatusInternalServerError)
+		return
+	}
+
+	user.Roles = req.Roles
+	user.Scopes = req.Scopes
+	if err := userStore.Update(user); err != nil {
+		http.Error(w, "Error updating user", http.StatusInternalServerError)
+		return
+	}
+	if err := revokeAllSessions(user.ID); err != nil {
+		http.Error(w, "Error revoking sessions", http.StatusInternalServerError)
+		return
+	}
+	auditLog(r).Infof("Set the roles of user %s (%s) to %v", user.ID, user.Username, grantedRoles(user))
+
+	writeJSON(w, rolesResponse{ID: user.ID, Username: user.Username, Roles: grantedRoles(user), Scopes: grantedScopes(user)})
+}
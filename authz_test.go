@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// useAdminUserIDs makes the users with the given IDs admins for the duration of a test.
+func useAdminUserIDs(t *testing.T, ids ...string) {
+	original := adminUserIDs
+	adminUserIDs = make(map[string]bool)
+	for _, id := range ids {
+		adminUserIDs[id] = true
+	}
+	t.Cleanup(func() { adminUserIDs = original })
+}
+
+// TestGrantedScopes tests the roles and scopes embedded in tokens.
+func TestGrantedScopes(t *testing.T) {
+	useAdminUserIDs(t, "root-id")
+
+	tests := []struct {
+		name       string
+		user       User
+		wantRoles  []string
+		wantScopes []string
+	}{
+		{"no roles", User{Username: "legacy"}, []string{"reader"}, []string{"books:read"}},
+		{"librarian", User{Username: "lib", Roles: []string{"librarian"}}, []string{"librarian"}, []string{"books:read", "cache:read"}},
+		{"extra scope", User{Username: "ops", Roles: []string{"reader"}, Scopes: []string{"cache:read"}}, []string{"reader"}, []string{"books:read", "cache:read"}},
+		{"ADMIN_USER_IDS", User{ID: "root-id", Username: "root", Roles: []string{"reader"}}, []string{"admin", "reader"}, []string{"books:read", "cache:read", "users:admin"}},
+		{"admin username, other ID", User{ID: "squatter-id", Username: "root-id"}, []string{"reader"}, []string{"books:read"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := grantedRoles(&tc.user); !reflect.DeepEqual(got, tc.wantRoles) {
+				t.Errorf("expected roles %v, got %v", tc.wantRoles, got)
+			}
+			if got := grantedScopes(&tc.user); !reflect.DeepEqual(got, tc.wantScopes) {
+				t.Errorf("expected scopes %v, got %v", tc.wantScopes, got)
+			}
+		})
+	}
+}
+
+// TestRequireScope tests that each role can reach the routes its scopes allow, and gets a
+// structured 403 elsewhere.
+func TestRequireScope(t *testing.T) {
+	useRateLimits(t)
+	useProvider(t, &fakeProvider{search: func(q SearchQuery) (*SearchResult, error) {
+		return &SearchResult{Docs: []Book{{Title: "Test Book"}}}, nil
+	}})
+	useRevocationStore(t, newMemoryRevocationStore())
+
+	tokens := make(map[string]string)
+	for _, role := range []string{roleReader, roleLibrarian, roleAdmin} {
+		token, err := issueAccessToken(&User{ID: role + "-id", Username: role, Roles: []string{role}}, "", tokenGrant{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[role] = token
+	}
+
+	tests := []struct {
+		role   string
+		method string
+		target string
+		want   int
+	}{
+		{roleReader, "GET", "/api/search?q=go", http.StatusOK},
+		{roleReader, "GET", "/api/cache/stats", http.StatusForbidden},
+		{roleReader, "POST", "/api/admin/users/x/revoke-sessions", http.StatusForbidden},
+		{roleLibrarian, "GET", "/api/search?q=go", http.StatusOK},
+		{roleLibrarian, "GET", "/api/cache/stats", http.StatusNotFound}, // The cache is disabled in tests.
+		{roleLibrarian, "POST", "/api/admin/users/x/revoke-sessions", http.StatusForbidden},
+		{roleAdmin, "POST", "/api/admin/users/x/revoke-sessions", http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		t.Run(tc.role+" "+tc.target, func(t *testing.T) {
+			rr := authorizedRequest(tc.method, tc.target, tokens[tc.role])
+			if rr.Code != tc.want {
+				t.Fatalf("expected %d, got %d: %s", tc.want, rr.Code, rr.Body.String())
+			}
+			if rr.Code != http.StatusForbidden {
+				return
+			}
+			var body scopeError
+			if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Error != "insufficient_scope" || body.RequiredScope == "" {
+				t.Errorf("unexpected error body %+v", body)
+			}
+			if !strings.Contains(rr.Header().Get("WWW-Authenticate"), `error="insufficient_scope"`) {
+				t.Errorf("unexpected WWW-Authenticate %q", rr.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+// TestSetRolesHandler tests assigning roles and that it revokes the user's sessions.
+func TestSetRolesHandler(t *testing.T) {
+	store := newMemoryUserStore()
+	useUserStore(t, store)
+	useRefreshTokenStore(t, newMemoryRefreshTokenStore())
+	useRevocationStore(t, newMemoryRevocationStore())
+
+	admin, err := registerUser(store, "admin", "adminpassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin.Roles = []string{roleAdmin}
+	if err := store.Update(admin); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := registerUser(store, "reader", "readerpassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminToken, _ := issueAccessToken(admin, "", tokenGrant{})
+	readerTokens, _ := issueTokens(reader, "", tokenGrant{})
+
+	put := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/api/admin/users/"+reader.ID+"/roles", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		newRouter().ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := put(`{"roles": ["superuser"]}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected an unknown role to be rejected, got %d", rr.Code)
+	}
+	if rr := put(`{"roles": ["reader"], "scopes": ["everything"]}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected an unknown scope to be rejected, got %d", rr.Code)
+	}
+
+	rr := put(`{"roles": ["librarian"]}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp rolesResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(resp.Roles, []string{"librarian"}) || !reflect.DeepEqual(resp.Scopes, []string{"books:read", "cache:read"}) {
+		t.Errorf("unexpected response %+v", resp)
+	}
+
+	stored, err := store.GetByID(reader.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stored.Roles, []string{"librarian"}) {
+		t.Errorf("expected the roles to be stored, got %v", stored.Roles)
+	}
+	if rr := authorizedRequest("GET", "/api/search?q=go", readerTokens.AccessToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected tokens with the old roles to be revoked, got %d", rr.Code)
+	}
+}
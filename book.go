@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+)
+
+// Book is a single search result: a work together with a summary of its editions.
+type Book struct {
+	Key              string   `json:"key"`
+	Title            string   `json:"title"`
+	Subtitle         string   `json:"subtitle,omitempty"`
+	Authors          []Author `json:"authors,omitempty"`
+	FirstPublishYear int      `json:"first_publish_year,omitempty"`
+	ISBNs            []string `json:"isbn,omitempty"`
+	Publishers       []string `json:"publishers,omitempty"`
+	Languages        []string `json:"languages,omitempty"`
+	NumberOfPages    int      `json:"number_of_pages,omitempty"`
+	Subjects         []string `json:"subjects,omitempty"`
+	CoverID          int      `json:"cover_id,omitempty"`
+	CoverURL         string   `json:"cover_url,omitempty"`
+	EditionCount     int      `json:"edition_count,omitempty"`
+}
+
+// Author identifies the author of a book. Name may be empty when the provider only returns keys.
+type Author struct {
+	Key  string `json:"key"`
+	Name string `json:"name,omitempty"`
+}
+
+// Work is a single abstract book, independent of any particular printing.
+type Work struct {
+	Key              string   `json:"key"`
+	Title            string   `json:"title"`
+	Subtitle         string   `json:"subtitle,omitempty"`
+	Description      string   `json:"description,omitempty"`
+	Authors          []Author `json:"authors,omitempty"`
+	FirstPublishDate string   `json:"first_publish_date,omitempty"`
+	Subjects         []string `json:"subjects,omitempty"`
+	CoverID          int      `json:"cover_id,omitempty"`
+	CoverURL         string   `json:"cover_url,omitempty"`
+}
+
+// Edition is one published printing of a work.
+type Edition struct {
+	Key           string   `json:"key"`
+	Title         string   `json:"title"`
+	Subtitle      string   `json:"subtitle,omitempty"`
+	Works         []string `json:"works,omitempty"`
+	Authors       []Author `json:"authors,omitempty"`
+	Publishers    []string `json:"publishers,omitempty"`
+	PublishDate   string   `json:"publish_date,omitempty"`
+	ISBNs         []string `json:"isbn,omitempty"`
+	Languages     []string `json:"languages,omitempty"`
+	NumberOfPages int      `json:"number_of_pages,omitempty"`
+	CoverID       int      `json:"cover_id,omitempty"`
+	CoverURL      string   `json:"cover_url,omitempty"`
+}
+
+// normalizeStrings trims every value and drops empty and duplicate entries, keeping the first occurrence.
+func normalizeStrings(values []string) []string {
+	var out []string
+	seen := make(map[string]bool, len(values))
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" || seen[v] {
+			continue
+		}
+		seen[v] = true
+		out = append(out, v)
+	}
+	return out
+}
+
+// normalizeISBN strips hyphens and spaces from an ISBN and upper-cases a trailing X check digit.
+// It returns "" if what remains is not a 10 or 13 character ISBN.
+func normalizeISBN(isbn string) string {
+	isbn = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(isbn))
+	if len(isbn) != 10 && len(isbn) != 13 {
+		return ""
+	}
+	for i, c := range isbn {
+		if c >= '0' && c <= '9' || c == 'X' && i == 9 && len(isbn) == 10 {
+			continue
+		}
+		return ""
+	}
+	return isbn
+}
+
+// normalizeISBNs normalizes each ISBN, dropping invalid and duplicate ones.
+func normalizeISBNs(isbns []string) []string {
+	out := make([]string, 0, len(isbns))
+	for _, isbn := range isbns {
+		out = append(out, normalizeISBN(isbn))
+	}
+	return normalizeStrings(out)
+}
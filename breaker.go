@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Circuit breaker states.
+const (
+	breakerClosed   = "closed"    // Requests flow normally.
+	breakerOpen     = "open"      // Requests fail fast until the cooldown ends.
+	breakerHalfOpen = "half-open" // A single probe request decides whether to close again.
+)
+
+// circuitBreaker stops sending requests to an upstream after threshold consecutive failures.
+// After cooldown it lets one probe request through; success closes the circuit again and
+// failure re-opens it for another cooldown.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int
+	openUntil time.Time
+	probing   bool
+	now       func() time.Time
+}
+
+// newCircuitBreaker returns a closed breaker that opens after threshold consecutive failures.
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, state: breakerClosed, now: time.Now}
+}
+
+// allow reports whether a request may be sent. If not, retryAfter is how long until the
+// breaker will let a probe through.
+func (b *circuitBreaker) allow() (retryAfter time.Duration, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if wait := b.openUntil.Sub(b.now()); wait > 0 {
+			return wait, false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return 0, true
+	case breakerHalfOpen:
+		if b.probing {
+			return b.cooldown, false
+		}
+		b.probing = true
+		return 0, true
+	default:
+		return 0, true
+	}
+}
+
+// success records a successful request, closing the circuit.
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = breakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// failure records a failed request, opening the circuit if the threshold is reached or the probe failed.
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openUntil = b.now().Add(b.cooldown)
+		b.probing = false
+	}
+}
+
+// release gives up a probe slot without recording an outcome, e.g. when the caller went away.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// State returns the current state of the breaker.
+func (b *circuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && !b.now().Before(b.openUntil) {
+		return breakerHalfOpen
+	}
+	return b.state
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestCircuitBreaker tests the closed, open and half-open transitions of the breaker.
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newCircuitBreaker(3, 30*time.Second)
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		b.failure()
+	}
+	if _, ok := b.allow(); !ok || b.State() != breakerClosed {
+		t.Fatalf("expected the breaker to stay closed below the threshold, state %s", b.State())
+	}
+	b.success()
+	b.failure()
+	b.failure()
+	if b.State() != breakerClosed {
+		t.Fatal("expected a success to reset the failure count")
+	}
+
+	b.failure()
+	if b.State() != breakerOpen {
+		t.Fatalf("expected the breaker to open at the threshold, state %s", b.State())
+	}
+	if wait, ok := b.allow(); ok || wait != 30*time.Second {
+		t.Errorf("expected an open breaker to refuse for 30s, got ok=%v wait=%s", ok, wait)
+	}
+
+	now = now.Add(31 * time.Second)
+	if _, ok := b.allow(); !ok {
+		t.Fatal("expected a probe to be allowed after the cooldown")
+	}
+	if _, ok := b.allow(); ok {
+		t.Error("expected only one probe at a time")
+	}
+	b.failure()
+	if b.State() != breakerOpen {
+		t.Fatalf("expected a failed probe to re-open the breaker, state %s", b.State())
+	}
+
+	now = now.Add(31 * time.Second)
+	if _, ok := b.allow(); !ok {
+		t.Fatal("expected a second probe after the cooldown")
+	}
+	b.success()
+	if _, ok := b.allow(); !ok || b.State() != breakerClosed {
+		t.Errorf("expected a successful probe to close the breaker, state %s", b.State())
+	}
+}
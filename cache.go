@@ -0,0 +1,277 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Cache statuses reported in the X-Cache response header.
+const (
+	cacheHit   = "HIT"   // Served from a fresh cache entry.
+	cacheMiss  = "MISS"  // Fetched from the upstream.
+	cacheStale = "STALE" // Served from a cache entry that was past its TTL, revalidated or not.
+)
+
+// cacheEntry is a cached upstream response body with its validators.
+type cacheEntry struct {
+	Key          string    `json:"key"`
+	Body         []byte    `json:"body"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	StoredAt     time.Time `json:"stored_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// cacheStats is a snapshot of the cache counters.
+type cacheStats struct {
+	Entries      int   `json:"entries"`
+	Capacity     int   `json:"capacity"`
+	Hits         int64 `json:"hits"`
+	Misses       int64 `json:"misses"`
+	Stale        int64 `json:"stale"`
+	Revalidated  int64 `json:"revalidated"`
+	StaleIfError int64 `json:"stale_if_error"`
+	Evictions    int64 `json:"evictions"`
+}
+
+// responseCache is a bounded, concurrency-safe LRU cache of upstream responses.
+// Entries are kept after their TTL expires so they can be revalidated with their ETag or
+// Last-Modified validators; they are only dropped when evicted to make room.
+type responseCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	ll       *list.List // Front is most recently used; values are *cacheEntry.
+	items    map[string]*list.Element
+	stats    cacheStats
+	dirty    bool
+	now      func() time.Time
+}
+
+// newResponseCache returns a cache holding at most capacity entries that stay fresh for ttl.
+func newResponseCache(capacity int, ttl time.Duration) *responseCache {
+	return &responseCache{
+		capacity: capacity,
+		ttl:      ttl,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+		now:      time.Now,
+	}
+}
+
+// get returns a copy of the entry for key and whether it is still fresh.
+func (c *responseCache) get(key string) (entry cacheEntry, fresh, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return cacheEntry{}, false, false
+	}
+	c.ll.MoveToFront(el)
+	entry = *el.Value.(*cacheEntry)
+	return entry, c.now().Before(entry.ExpiresAt), true
+}
+
+// put stores a response body under key, evicting the least recently used entry if the cache is full.
+func (c *responseCache) put(key string, body []byte, etag, lastModified string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	entry := &cacheEntry{
+		Key:          key,
+		Body:         body,
+		ETag:         etag,
+		LastModified: lastModified,
+		StoredAt:     now,
+		ExpiresAt:    now.Add(c.ttl),
+	}
+	c.insert(entry)
+}
+
+// insert adds or replaces entry. c.mu must be held.
+func (c *responseCache) insert(entry *cacheEntry) {
+	c.dirty = true
+	if el, ok := c.items[entry.Key]; ok {
+		el.Value = entry
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[entry.Key] = c.ll.PushFront(entry)
+	for c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).Key)
+		c.stats.Evictions++
+	}
+}
+
+// refresh marks the entry for key as fresh again after the upstream confirmed it is unchanged.
+func (c *responseCache) refresh(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		entry := *el.Value.(*cacheEntry)
+		entry.StoredAt = c.now()
+		entry.ExpiresAt = entry.StoredAt.Add(c.ttl)
+		el.Value = &entry
+		c.dirty = true
+	}
+}
+
+// record counts a lookup outcome in the cache statistics.
+func (c *responseCache) record(status string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch status {
+	case cacheHit:
+		c.stats.Hits++
+	case cacheMiss:
+		c.stats.Misses++
+	case cacheStale:
+		c.stats.Stale++
+	}
+}
+
+// recordRevalidation counts an expired entry that the upstream confirmed is unchanged.
+func (c *responseCache) recordRevalidation() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.Revalidated++
+}
+
+// recordStaleIfError counts an entry served because the upstream failed.
+func (c *responseCache) recordStaleIfError() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.StaleIfError++
+}
+
+// Stats returns a snapshot of the cache counters.
+func (c *responseCache) Stats() cacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.ll.Len()
+	stats.Capacity = c.capacity
+	return stats
+}
+
+// load reads entries previously written by save. A missing file is not an error.
+func (c *responseCache) load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []*cacheEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Entries are saved most recently used first, so insert them in reverse.
+	for i := len(entries) - 1; i >= 0; i-- {
+		c.insert(entries[i])
+	}
+	c.dirty = false
+	return nil
+}
+
+// save writes all entries to path if the cache changed since the last save.
+func (c *responseCache) save(path string) error {
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	entries := make([]*cacheEntry, 0, c.ll.Len())
+	for el := c.ll.Front(); el != nil; el = el.Next() {
+		entries = append(entries, el.Value.(*cacheEntry))
+	}
+	c.dirty = false
+	c.mu.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// persistEvery saves the cache to path every interval. It never returns.
+func (c *responseCache) persistEvery(path string, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := c.save(path); err != nil {
+			logrus.Warnf("Failed to persist response cache to %s: %v", path, err)
+		}
+	}
+}
+
+// upstreamCache is the shared cache of upstream responses, or nil if caching is disabled.
+var upstreamCache *responseCache
+
+// newResponseCacheFromEnv builds the response cache configured by CACHE_SIZE, CACHE_TTL, CACHE_FILE
+// and CACHE_PERSIST_INTERVAL. It returns nil if CACHE_SIZE is 0.
+func newResponseCacheFromEnv() (*responseCache, error) {
+	size, err := envInt("CACHE_SIZE", 1000)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("CACHE_SIZE must not be negative, got %d", size)
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	ttl, err := envDuration("CACHE_TTL", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	if ttl < 0 {
+		return nil, fmt.Errorf("CACHE_TTL must not be negative, got %s", ttl)
+	}
+	cache := newResponseCache(size, ttl)
+
+	if path := os.Getenv("CACHE_FILE"); path != "" {
+		interval, err := envDuration("CACHE_PERSIST_INTERVAL", time.Minute)
+		if err != nil {
+			return nil, err
+		}
+		if interval <= 0 {
+			return nil, fmt.Errorf("CACHE_PERSIST_INTERVAL must be positive, got %s", interval)
+		}
+		if err := cache.load(path); err != nil {
+			logrus.Warnf("Ignoring unreadable response cache file %s: %v", path, err)
+		}
+		go cache.persistEvery(path, interval)
+	}
+	return cache, nil
+}
+
+// cacheStatsHandler reports the response cache counters.
+func cacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if upstreamCache == nil {
+		http.Error(w, "Response cache is disabled", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, upstreamCache.Stats())
+}
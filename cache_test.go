@@ -0,0 +1,117 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestCache returns a cache whose clock is controlled by the returned pointer.
+func newTestCache(capacity int, ttl time.Duration) (*responseCache, *time.Time) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := newResponseCache(capacity, ttl)
+	cache.now = func() time.Time { return now }
+	return cache, &now
+}
+
+// TestResponseCacheTTL tests that entries go stale after their TTL but stay available for revalidation.
+func TestResponseCacheTTL(t *testing.T) {
+	cache, now := newTestCache(10, time.Minute)
+	cache.put("a", []byte("body"), `"v1"`, "")
+
+	if entry, fresh, ok := cache.get("a"); !ok || !fresh || string(entry.Body) != "body" {
+		t.Fatalf("expected a fresh entry, got %+v fresh=%v ok=%v", entry, fresh, ok)
+	}
+
+	*now = now.Add(2 * time.Minute)
+	entry, fresh, ok := cache.get("a")
+	if !ok || fresh || entry.ETag != `"v1"` {
+		t.Fatalf("expected a stale entry with its ETag, got %+v fresh=%v ok=%v", entry, fresh, ok)
+	}
+
+	cache.refresh("a")
+	if _, fresh, _ := cache.get("a"); !fresh {
+		t.Error("expected refresh to make the entry fresh again")
+	}
+}
+
+// TestResponseCacheLRU tests that the least recently used entry is evicted when the cache is full.
+func TestResponseCacheLRU(t *testing.T) {
+	cache, _ := newTestCache(2, time.Minute)
+	cache.put("a", []byte("a"), "", "")
+	cache.put("b", []byte("b"), "", "")
+	cache.get("a") // a is now more recently used than b.
+	cache.put("c", []byte("c"), "", "")
+
+	if _, _, ok := cache.get("b"); ok {
+		t.Error("expected b to be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, _, ok := cache.get(key); !ok {
+			t.Errorf("expected %s to be cached", key)
+		}
+	}
+	if stats := cache.Stats(); stats.Entries != 2 || stats.Evictions != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+// TestResponseCachePersistence tests saving the cache to disk and loading it into a new cache.
+func TestResponseCachePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+
+	cache, _ := newTestCache(2, time.Minute)
+	cache.put("a", []byte("a"), `"etag-a"`, "")
+	cache.put("b", []byte("b"), "", "Mon, 01 Jan 2024 00:00:00 GMT")
+	if err := cache.save(path); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	loaded, _ := newTestCache(2, time.Minute)
+	if err := loaded.load(path); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	entry, fresh, ok := loaded.get("a")
+	if !ok || !fresh || string(entry.Body) != "a" || entry.ETag != `"etag-a"` {
+		t.Errorf("unexpected loaded entry %+v fresh=%v ok=%v", entry, fresh, ok)
+	}
+
+	// The recency order survives the round trip: a was just used, so c evicts b.
+	loaded.put("c", []byte("c"), "", "")
+	if _, _, ok := loaded.get("b"); ok {
+		t.Error("expected b to be evicted after reload")
+	}
+
+	if err := newResponseCache(1, time.Minute).load(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("expected a missing file to be ignored, got %v", err)
+	}
+}
+
+// TestNewResponseCacheFromEnv tests that invalid cache settings are rejected at startup.
+func TestNewResponseCacheFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantNil bool
+		wantErr bool
+	}{
+		{"defaults", nil, false, false},
+		{"disabled", map[string]string{"CACHE_SIZE": "0"}, true, false},
+		{"negative size", map[string]string{"CACHE_SIZE": "-1"}, true, true},
+		{"no TTL", map[string]string{"CACHE_TTL": "0"}, false, false},
+		{"negative TTL", map[string]string{"CACHE_TTL": "-1m"}, true, true},
+		{"zero persist interval", map[string]string{"CACHE_FILE": "cache.json", "CACHE_PERSIST_INTERVAL": "0"}, true, true},
+		{"negative persist interval", map[string]string{"CACHE_FILE": "cache.json", "CACHE_PERSIST_INTERVAL": "-1m"}, true, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, key := range []string{"CACHE_SIZE", "CACHE_TTL", "CACHE_FILE", "CACHE_PERSIST_INTERVAL"} {
+				t.Setenv(key, tc.env[key])
+			}
+			cache, err := newResponseCacheFromEnv()
+			if (err != nil) != tc.wantErr || (cache == nil) != tc.wantNil {
+				t.Errorf("expected nil %v and error %v, got %v, %v", tc.wantNil, tc.wantErr, cache, err)
+			}
+		})
+	}
+}
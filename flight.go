@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// flightGroup deduplicates concurrent upstream fetches of the same URL: the first caller
+// starts the fetch and every caller that arrives before it finishes shares its result or error.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// flightCall is a fetch in progress.
+type flightCall struct {
+	done    chan struct{}
+	result  upstreamResult
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// upstreamResult is the outcome of an upstream fetch shared by coalesced callers.
+type upstreamResult struct {
+	body        []byte
+	cacheStatus string
+}
+
+// do runs fn once for all concurrent callers with the same key. shared reports whether the
+// result came from a fetch started by another caller.
+//
+// fn runs with a context that is detached from any single caller, so one caller giving up does
+// not fail the others; it is cancelled once every caller waiting for it has gone away. It keeps
+// the deadline of the caller that started it.
+func (g *flightGroup) do(ctx context.Context, key string, fn func(context.Context) (upstreamResult, error)) (result upstreamResult, shared bool, err error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	call, shared := g.calls[key]
+	if !shared {
+		var fnCtx context.Context
+		var cancel context.CancelFunc
+		if deadline, ok := ctx.Deadline(); ok {
+			fnCtx, cancel = context.WithDeadline(context.WithoutCancel(ctx), deadline)
+		} else {
+			fnCtx, cancel = context.WithCancel(context.WithoutCancel(ctx))
+		}
+		call = &flightCall{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = call
+		go func() {
+			call.result, call.err = fn(fnCtx)
+			cancel()
+			g.mu.Lock()
+			g.forget(key, call)
+			g.mu.Unlock()
+			close(call.done)
+		}()
+	}
+	call.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.result, shared, call.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			// Nobody wants the result any more; later callers start a fresh fetch.
+			call.cancel()
+			g.forget(key, call)
+		}
+		g.mu.Unlock()
+		return upstreamResult{}, shared, ctx.Err()
+	}
+}
+
+// forget removes call from the group if it is still the fetch in progress for key. g.mu must be held.
+func (g *flightGroup) forget(key string, call *flightCall) {
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+}
+
+// waiting returns the number of callers waiting for the fetch of key.
+func (g *flightGroup) waiting(key string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if call, ok := g.calls[key]; ok {
+		return call.waiters
+	}
+	return 0
+}
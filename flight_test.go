@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitForWaiters blocks until n callers are waiting on the fetch of key.
+func waitForWaiters(t *testing.T, g *flightGroup, key string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for g.waiting(key) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d callers, have %d", n, g.waiting(key))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestSearchCoalescing tests that concurrent identical searches share a single upstream request
+// and all receive its result or error.
+func TestSearchCoalescing(t *testing.T) {
+	const concurrency = 20
+
+	tests := []struct {
+		name                  string
+		respond               func() (*http.Response, error)
+		expectedStatus        int
+		expectedBodySubstring string
+	}{
+		{
+			name: "success",
+			respond: func() (*http.Response, error) {
+				return newResponse(200, `{"numFound": 1, "docs": [{"title": "Shared"}]}`), nil
+			},
+			expectedStatus:        http.StatusOK,
+			expectedBodySubstring: "Shared",
+		},
+		{
+			name:                  "error",
+			respond:               func() (*http.Response, error) { return nil, errors.New("simulated network error") },
+			expectedStatus:        http.StatusInternalServerError,
+			expectedBodySubstring: "simulated network error",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls int32
+			release := make(chan struct{})
+			provider := newTestOpenLibrary(func(req *http.Request) (*http.Response, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return tc.respond()
+			})
+			provider.upstream.retry.retries = 0 // Count only the coalesced request, not its retries.
+			useProvider(t, provider)
+
+			var wg sync.WaitGroup
+			recorders := make([]*httptest.ResponseRecorder, concurrency)
+			for i := range recorders {
+				recorders[i] = httptest.NewRecorder()
+				wg.Add(1)
+				go func(rr *httptest.ResponseRecorder) {
+					defer wg.Done()
+					searchHandler(rr, httptest.NewRequest("GET", "/api/search?author=popular", nil))
+				}(recorders[i])
+			}
+
+			key := provider.baseURL + provider.searchPath(SearchQuery{Author: "popular", Page: 1, Limit: defaultSearchLimit})
+			waitForWaiters(t, &provider.upstream.flight, key, concurrency)
+			close(release)
+			wg.Wait()
+
+			if n := atomic.LoadInt32(&calls); n != 1 {
+				t.Errorf("expected 1 upstream request, got %d", n)
+			}
+			for _, rr := range recorders {
+				if rr.Code != tc.expectedStatus || !strings.Contains(rr.Body.String(), tc.expectedBodySubstring) {
+					t.Errorf("expected %d containing %q, got %d %q", tc.expectedStatus, tc.expectedBodySubstring, rr.Code, rr.Body.String())
+				}
+			}
+		})
+	}
+}
+
+// TestFlightGroupCancellation tests that a caller giving up does not fail the others,
+// and that the shared fetch is cancelled once every caller has gone.
+func TestFlightGroupCancellation(t *testing.T) {
+	var g flightGroup
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fnCancelled := make(chan struct{})
+	fn := func(ctx context.Context) (upstreamResult, error) {
+		close(started)
+		select {
+		case <-release:
+			return upstreamResult{body: []byte("ok")}, nil
+		case <-ctx.Done():
+			close(fnCancelled)
+			return upstreamResult{}, ctx.Err()
+		}
+	}
+
+	// One caller leaves early while another keeps waiting and gets the result.
+	impatient, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := g.do(impatient, "k", fn)
+		errs <- err
+	}()
+	<-started
+	results := make(chan upstreamResult, 1)
+	go func() {
+		result, _, _ := g.do(context.Background(), "k", fn)
+		results <- result
+	}()
+	waitForWaiters(t, &g, "k", 2)
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the impatient caller to get context.Canceled, got %v", err)
+	}
+	close(release)
+	if result := <-results; string(result.body) != "ok" {
+		t.Errorf("expected the patient caller to get the result, got %q", result.body)
+	}
+
+	// When the only caller leaves, the fetch itself is cancelled.
+	started = make(chan struct{})
+	release = make(chan struct{})
+	lonely, cancel := context.WithCancel(context.Background())
+	go g.do(lonely, "k2", fn)
+	<-started
+	cancel()
+	select {
+	case <-fnCancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the abandoned fetch to be cancelled")
+	}
+}
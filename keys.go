@@ -0,0 +1,376 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/sirupsen/logrus"
+)
+
+// SigningMethodEdDSA signs tokens with Ed25519 (RFC 8037), which jwt-go does not provide.
+var SigningMethodEdDSA = &signingMethodEdDSA{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod { return SigningMethodEdDSA })
+}
+
+// signingMethodEdDSA implements jwt.SigningMethod for Ed25519 keys.
+type signingMethodEdDSA struct{}
+
+func (m *signingMethodEdDSA) Alg() string { return "EdDSA" }
+
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, []byte(signingString), sig) {
+		return errors.New("ed25519: verification error")
+	}
+	return nil
+}
+
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(priv, []byte(signingString))), nil
+}
+
+// signingKey is a key tokens are signed or verified with.
+type signingKey struct {
+	id      string
+	method  jwt.SigningMethod
+	private interface{} // Used to sign; nil for keys that only verify.
+	public  interface{} // Used to verify. For HMAC this is the shared secret.
+	retires time.Time   // Zero for keys that do not retire; tokens are rejected after it.
+}
+
+// keySet holds the current signing key and the retired keys that still verify tokens issued
+// before a rotation. Only tokens whose alg is in the allow-list are accepted. A keySet is not
+// modified after it is built, so it is safe for concurrent use.
+type keySet struct {
+	current *signingKey
+	keys    map[string]*signingKey // By kid, including current.
+	allowed []string
+	now     func() time.Time
+}
+
+// newKeySet returns a key set signing with current and accepting only the allowed algorithms.
+// If allowed is empty, the algorithms of the given keys are allowed.
+func newKeySet(current *signingKey, allowed []string, retired ...*signingKey) (*keySet, error) {
+	ks := &keySet{current: current, keys: make(map[string]*signingKey), now: time.Now}
+	for _, k := range append([]*signingKey{current}, retired...) {
+		if _, ok := ks.keys[k.id]; ok {
+			return nil, fmt.Errorf("duplicate key ID %q", k.id)
+		}
+		ks.keys[k.id] = k
+		if len(allowed) == 0 && !containsString(ks.allowed, k.method.Alg()) {
+			ks.allowed = append(ks.allowed, k.method.Alg())
+		}
+	}
+	if len(allowed) > 0 {
+		ks.allowed = allowed
+		for _, k := range ks.keys {
+			if !containsString(allowed, k.method.Alg()) {
+				return nil, fmt.Errorf("key %q uses %s, which is not an allowed algorithm", k.id, k.method.Alg())
+			}
+		}
+	}
+	return ks, nil
+}
+
+// sign signs claims with the current key and sets the kid header.
+func (ks *keySet) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.current.method, claims)
+	token.Header["kid"] = ks.current.id
+	return token.SignedString(ks.current.private)
+}
+
+// parse verifies a token's signature with the key named by its kid header.
+func (ks *keySet) parse(tokenStr string, claims jwt.Claims) (*jwt.Token, error) {
+	parser := &jwt.Parser{ValidMethods: ks.allowed}
+	return parser.ParseWithClaims(tokenStr, claims, ks.keyfunc)
+}
+
+// keyfunc returns the verification key for a token, making sure the token's alg is the one
+// the key is meant for so that, say, an RSA public key is never used as an HMAC secret.
+func (ks *keySet) keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := ks.keys[kid]
+	switch {
+	case !ok:
+		return nil, fmt.Errorf("unknown key ID %q", kid)
+	case token.Method.Alg() != key.method.Alg():
+		return nil, fmt.Errorf("key %q does not sign with %s", kid, token.Method.Alg())
+	case !key.retires.IsZero() && ks.now().After(key.retires):
+		return nil, fmt.Errorf("key %q has been retired", kid)
+	}
+	return key.public, nil
+}
+
+// jwk is a public key in JSON Web Key format (RFC 7517).
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// jwkSet is the document served at /.well-known/jwks.json.
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// JWKS returns the public keys that still verify tokens. Symmetric keys are never published.
+func (ks *keySet) JWKS() jwkSet {
+	set := jwkSet{Keys: []jwk{}}
+	now := ks.now()
+	for _, k := range ks.sortedKeys() {
+		if !k.retires.IsZero() && now.After(k.retires) {
+			continue
+		}
+		if j, ok := publicJWK(k.public); ok {
+			j.Kid = k.id
+			j.Use = "sig"
+			j.Alg = k.method.Alg()
+			set.Keys = append(set.Keys, j)
+		}
+	}
+	return set
+}
+
+// sortedKeys returns the current key followed by the retired keys, latest retirement first.
+func (ks *keySet) sortedKeys() []*signingKey {
+	var retired []*signingKey
+	for _, k := range ks.keys {
+		if k != ks.current {
+			retired = append(retired, k)
+		}
+	}
+	sort.Slice(retired, func(i, j int) bool {
+		if !retired[i].retires.Equal(retired[j].retires) {
+			return retired[i].retires.After(retired[j].retires)
+		}
+		return retired[i].id < retired[j].id
+	})
+	return append([]*signingKey{ks.current}, retired...)
+}
+
+// publicJWK converts an asymmetric public key to a JWK without kid, use or alg.
+func publicJWK(pub interface{}) (jwk, bool) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return jwk{Kty: "RSA", N: b64(pub.N.Bytes()), E: b64(big.NewInt(int64(pub.E)).Bytes())}, true
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		return jwk{Kty: "EC", Crv: pub.Curve.Params().Name, X: b64(pub.X.FillBytes(make([]byte, size))), Y: b64(pub.Y.FillBytes(make([]byte, size)))}, true
+	case ed25519.PublicKey:
+		return jwk{Kty: "OKP", Crv: "Ed25519", X: b64(pub)}, true
+	}
+	return jwk{}, false
+}
+
+// keyThumbprint returns the RFC 7638 JWK thumbprint of a public key, which is used as its kid
+// so that the same key always gets the same ID.
+func keyThumbprint(pub interface{}) (string, error) {
+	j, ok := publicJWK(pub)
+	if !ok {
+		return "", fmt.Errorf("unsupported public key type %T", pub)
+	}
+	// The required members in lexicographic order, without whitespace.
+	var canonical string
+	switch j.Kty {
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, j.E, j.N)
+	case "EC":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, j.Crv, j.X, j.Y)
+	case "OKP":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, j.Crv, j.X)
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// parseKeyPEM parses a PEM encoded RSA, P-256 ECDSA or Ed25519 key. Private keys can sign and
+// verify; public keys can only verify.
+func parseKeyPEM(data []byte) (*signingKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &signingKey{}
+	if signer, ok := parsed.(crypto.Signer); ok {
+		key.private = signer
+		parsed = signer.Public()
+	}
+	switch pub := parsed.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA keys must be at least 2048 bits, got %d", pub.N.BitLen())
+		}
+		key.method = jwt.SigningMethodRS256
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("ECDSA keys must use P-256, got %s", pub.Curve.Params().Name)
+		}
+		key.method = jwt.SigningMethodES256
+	case ed25519.PublicKey:
+		key.method = SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+	key.public = parsed
+	if key.id, err = keyThumbprint(parsed); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// readKeyFile parses the PEM key in path.
+func readKeyFile(path string) (*signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseKeyPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	return key, nil
+}
+
+// defaultSigningKey is the hardcoded HS256 key used when no signing key is configured.
+func defaultSigningKey() *signingKey {
+	return &signingKey{id: "default", method: jwt.SigningMethodHS256, private: jwtSecret, public: jwtSecret}
+}
+
+// signingKeys signs and verifies access tokens. It is replaced at startup by newKeySetFromEnv.
+var signingKeys = mustKeySet(newKeySet(defaultSigningKey(), nil))
+
+// mustKeySet panics if a key set could not be built; it is only used for the default set.
+func mustKeySet(ks *keySet, err error) *keySet {
+	if err != nil {
+		panic(err)
+	}
+	return ks
+}
+
+// newKeySetFromEnv loads the signing key from the PEM in JWT_SIGNING_KEY or the file
+// JWT_SIGNING_KEY_FILE, and the retired keys from the comma-separated files in
+// JWT_PREVIOUS_KEY_FILES. Retired keys keep verifying tokens for JWT_KEY_GRACE_PERIOD, which
+// defaults to accessTTL so that tokens signed before a rotation stay valid until they expire.
+// JWT_ALGORITHMS restricts the accepted algorithms. Without a signing key the hardcoded HS256
+// secret is used.
+func newKeySetFromEnv(accessTTL time.Duration) (*keySet, error) {
+	var current *signingKey
+	var err error
+	switch {
+	case os.Getenv("JWT_SIGNING_KEY") != "":
+		current, err = parseKeyPEM([]byte(os.Getenv("JWT_SIGNING_KEY")))
+	case os.Getenv("JWT_SIGNING_KEY_FILE") != "":
+		current, err = readKeyFile(os.Getenv("JWT_SIGNING_KEY_FILE"))
+	default:
+		logrus.Warn("No JWT signing key configured; signing tokens with the hardcoded HS256 secret")
+		current = defaultSigningKey()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("signing key: %v", err)
+	}
+	if current.private == nil {
+		return nil, errors.New("signing key: a private key is required")
+	}
+
+	grace, err := envDuration("JWT_KEY_GRACE_PERIOD", accessTTL)
+	if err != nil {
+		return nil, err
+	}
+	if grace < 0 {
+		return nil, fmt.Errorf("JWT_KEY_GRACE_PERIOD must not be negative, got %s", grace)
+	}
+	var retired []*signingKey
+	for _, path := range splitList(os.Getenv("JWT_PREVIOUS_KEY_FILES")) {
+		key, err := readKeyFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("previous key: %v", err)
+		}
+		key.private = nil
+		key.retires = time.Now().Add(grace)
+		retired = append(retired, key)
+	}
+
+	return newKeySet(current, splitList(os.Getenv("JWT_ALGORITHMS")), retired...)
+}
+
+// splitList splits a comma-separated list, dropping blank entries.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// containsString reports whether list contains s.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// jwksHandler publishes the public keys access tokens can be verified with.
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, signingKeys.JWKS())
+}
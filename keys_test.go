@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// testKeyPEMs returns freshly generated PKCS #8 PEM private keys by algorithm.
+func testKeyPEMs(t *testing.T) map[string][]byte {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pems := make(map[string][]byte)
+	for alg, key := range map[string]interface{}{"RS256": rsaKey, "ES256": ecKey, "EdDSA": edKey} {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pems[alg] = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	}
+	return pems
+}
+
+// useKeySet swaps signingKeys for the duration of a test.
+func useKeySet(t *testing.T, ks *keySet) {
+	original := signingKeys
+	signingKeys = ks
+	t.Cleanup(func() { signingKeys = original })
+}
+
+// TestKeySetAlgorithms tests signing and verifying with each supported key type.
+func TestKeySetAlgorithms(t *testing.T) {
+	for alg, data := range testKeyPEMs(t) {
+		t.Run(alg, func(t *testing.T) {
+			key, err := parseKeyPEM(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key.method.Alg() != alg {
+				t.Fatalf("expected %s, got %s", alg, key.method.Alg())
+			}
+			ks, err := newKeySet(key, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			useKeySet(t, ks)
+
+			issued, err := issueAccessToken(&User{ID: "u1", Username: "reader"}, "", tokenGrant{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, err := ks.parse(issued, jwt.MapClaims{})
+			if err != nil {
+				t.Fatalf("expected the token to verify, got %v", err)
+			}
+			if token.Header["kid"] != key.id || token.Header["alg"] != alg {
+				t.Errorf("unexpected header %v", token.Header)
+			}
+
+			jwks := ks.JWKS()
+			if len(jwks.Keys) != 1 || jwks.Keys[0].Kid != key.id || jwks.Keys[0].Alg != alg {
+				t.Errorf("unexpected JWKS %+v", jwks)
+			}
+		})
+	}
+}
+
+// TestKeySetRejects tests that tokens with a disallowed alg, an unknown kid or an alg that
+// does not match their key are rejected.
+func TestKeySetRejects(t *testing.T) {
+	pems := testKeyPEMs(t)
+	rsaKey, err := parseKeyPEM(pems["RS256"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := newKeySet(rsaKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(rsaKey.public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token func() (string, error)
+	}{
+		{"alg none", func() (string, error) {
+			token := jwt.NewWithClaims(jwt.SigningMethodNone, validTestClaims())
+			token.Header["kid"] = rsaKey.id
+			return token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+		}},
+		{"public key as HMAC secret", func() (string, error) {
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, validTestClaims())
+			token.Header["kid"] = rsaKey.id
+			return token.SignedString(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}))
+		}},
+		{"hardcoded secret", func() (string, error) {
+			return jwt.NewWithClaims(jwt.SigningMethodHS256, validTestClaims()).SignedString(jwtSecret)
+		}},
+		{"unknown kid", func() (string, error) {
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, validTestClaims())
+			token.Header["kid"] = "unknown"
+			return token.SignedString(rsaKey.private)
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tokenStr, err := tc.token()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ks.parse(tokenStr, jwt.MapClaims{}); err == nil {
+				t.Error("expected the token to be rejected")
+			}
+		})
+	}
+
+	edKey, err := parseKeyPEM(pems["EdDSA"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newKeySet(edKey, []string{"RS256"}); err == nil {
+		t.Error("expected a key outside the allow-list to be refused")
+	}
+}
+
+// TestKeyRotation tests that a retired key verifies tokens until its grace period ends.
+func TestKeyRotation(t *testing.T) {
+	pems := testKeyPEMs(t)
+	oldKey, err := parseKeyPEM(pems["ES256"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := parseKeyPEM(pems["EdDSA"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := newKeySet(oldKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldToken, err := before.sign(validTestClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	retired := *oldKey
+	retired.private = nil
+	retired.retires = now.Add(time.Hour)
+	after, err := newKeySet(newKey, nil, &retired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after.now = func() time.Time { return now }
+
+	if _, err := after.parse(oldToken, jwt.MapClaims{}); err != nil {
+		t.Errorf("expected a token signed with the retired key to verify, got %v", err)
+	}
+	if jwks := after.JWKS(); len(jwks.Keys) != 2 || jwks.Keys[0].Kid != newKey.id || jwks.Keys[1].Kid != oldKey.id {
+		t.Errorf("expected both keys to be published, got %+v", jwks)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if _, err := after.parse(oldToken, jwt.MapClaims{}); err == nil {
+		t.Error("expected the retired key to stop verifying after the grace period")
+	}
+	if jwks := after.JWKS(); len(jwks.Keys) != 1 {
+		t.Errorf("expected only the current key to be published, got %+v", jwks)
+	}
+}
+
+// TestNewKeySetFromEnv tests loading the signing key and previous keys from files.
+func TestNewKeySetFromEnv(t *testing.T) {
+	pems := testKeyPEMs(t)
+	dir := t.TempDir()
+	for alg, data := range pems {
+		if err := os.WriteFile(filepath.Join(dir, alg+".pem"), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Setenv("JWT_SIGNING_KEY_FILE", filepath.Join(dir, "EdDSA.pem"))
+	t.Setenv("JWT_PREVIOUS_KEY_FILES", filepath.Join(dir, "RS256.pem")+", "+filepath.Join(dir, "ES256.pem"))
+	ks, err := newKeySetFromEnv(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ks.current.method != SigningMethodEdDSA || len(ks.keys) != 3 || len(ks.allowed) != 3 {
+		t.Errorf("unexpected key set: current %s, %d keys, allowed %v", ks.current.method.Alg(), len(ks.keys), ks.allowed)
+	}
+	for _, k := range ks.keys {
+		if k != ks.current && (k.private != nil || k.retires.IsZero()) {
+			t.Errorf("expected previous key %s to only verify until it retires", k.id)
+		}
+	}
+
+	t.Setenv("JWT_KEY_GRACE_PERIOD", "-1m")
+	if _, err := newKeySetFromEnv(time.Hour); err == nil {
+		t.Error("expected a negative grace period to be refused")
+	}
+	t.Setenv("JWT_KEY_GRACE_PERIOD", "")
+
+	t.Setenv("JWT_ALGORITHMS", "EdDSA")
+	if _, err := newKeySetFromEnv(time.Hour); err == nil {
+		t.Error("expected previous keys outside JWT_ALGORITHMS to be refused")
+	}
+
+	t.Setenv("JWT_SIGNING_KEY_FILE", filepath.Join(dir, "missing.pem"))
+	if _, err := newKeySetFromEnv(time.Hour); err == nil {
+		t.Error("expected a missing key file to be an error")
+	}
+}
+
+// TestJWKSHandler tests that /.well-known/jwks.json publishes the signing key.
+func TestJWKSHandler(t *testing.T) {
+	key, err := parseKeyPEM(testKeyPEMs(t)["RS256"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := newKeySet(key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useKeySet(t, ks)
+
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	var jwks jwkSet
+	if err := json.NewDecoder(rr.Body).Decode(&jwks); err != nil {
+		t.Fatal(err)
+	}
+	if len(jwks.Keys) != 1 || jwks.Keys[0].Kty != "RSA" || jwks.Keys[0].E != "AQAB" || jwks.Keys[0].Kid != key.id {
+		t.Errorf("unexpected JWKS %+v", jwks)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LimiterStore holds rate limit counters. A store shared by all replicas, such as Redis, makes
+// limits hold across them. Implementations must be safe for concurrent use.
+type LimiterStore interface {
+	// Increment atomically adds n to the counter at key and returns its new value. A counter
+	// that does not exist is created at zero and expires after expiry.
+	Increment(key string, n int64, expiry time.Duration) (int64, error)
+}
+
+// limiterCounter is a counter in a memoryLimiterStore.
+type limiterCounter struct {
+	value     int64
+	expiresAt time.Time
+}
+
+// memoryLimiterStore is a LimiterStore that keeps counters in memory. It is a stand-in for a
+// shared store on a single replica.
+type memoryLimiterStore struct {
+	mu        sync.Mutex
+	counters  map[string]limiterCounter
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// newMemoryLimiterStore returns an empty in-memory limiter store.
+func newMemoryLimiterStore() *memoryLimiterStore {
+	return &memoryLimiterStore{counters: make(map[string]limiterCounter), now: time.Now}
+}
+
+func (s *memoryLimiterStore) Increment(key string, n int64, expiry time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+	c, ok := s.counters[key]
+	if !ok || !now.Before(c.expiresAt) {
+		c = limiterCounter{expiresAt: now.Add(expiry)}
+	}
+	c.value += n
+	s.counters[key] = c
+	return c.value, nil
+}
+
+// sweep drops expired counters. It runs at most once a minute. s.mu must be held.
+func (s *memoryLimiterStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for key, c := range s.counters {
+		if !now.Before(c.expiresAt) {
+			delete(s.counters, key)
+		}
+	}
+}
+
+// redisError is an error reply from a Redis server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// redisConn is a connection to a Redis server speaking RESP, the Redis serialization protocol.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// send writes a command as an array of bulk strings. Commands can be pipelined by sending
+// several before reading their replies.
+func (c *redisConn) send(args ...string) error {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"+arg+"\r\n"...)
+	}
+	_, err := c.Write(buf)
+	return err
+}
+
+// receive reads a reply. Simple and bulk strings are returned as string, integers as int64,
+// arrays as []interface{} and nil replies as nil. Error replies are returned as a redisError.
+func (c *redisConn) receive() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(body)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(body)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, size)
+		for i := range items {
+			if items[i], err = c.receive(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
+
+// redisLimiterStore is a LimiterStore backed by a Redis server, or anything else speaking its
+// protocol, shared by all replicas.
+type redisLimiterStore struct {
+	addr     string
+	password string
+	timeout  time.Duration
+	idle     chan *redisConn // Idle connections for reuse.
+}
+
+// newRedisLimiterStore returns a store using the Redis server at addr, authenticating with
+// password unless it is empty. Each command must complete within timeout.
+func newRedisLimiterStore(addr, password string, timeout time.Duration) *redisLimiterStore {
+	return &redisLimiterStore{addr: addr, password: password, timeout: timeout, idle: make(chan *redisConn, 16)}
+}
+
+// conn returns an idle connection or dials a new one.
+func (s *redisLimiterStore) conn() (*redisConn, error) {
+	select {
+	case c := <-s.idle:
+		return c, nil
+	default:
+	}
+	nc, err := net.DialTimeout("tcp", s.addr, s.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	if s.password != "" {
+		c.SetDeadline(time.Now().Add(s.timeout))
+		if err := c.send("AUTH", s.password); err == nil {
+			_, err = c.receive()
+		}
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// release returns a healthy connection to the idle pool, closing it if the pool is full.
+func (s *redisLimiterStore) release(c *redisConn) {
+	select {
+	case s.idle <- c:
+	default:
+		c.Close()
+	}
+}
+
+// Increment runs SET NX PX and INCRBY in a MULTI/EXEC transaction, so the counter is created
+// with its expiry and incremented atomically. INCRBY keeps the expiry of an existing key.
+func (s *redisLimiterStore) Increment(key string, n int64, expiry time.Duration) (int64, error) {
+	c, err := s.conn()
+	if err != nil {
+		return 0, err
+	}
+	ms := expiry.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+
+	c.SetDeadline(time.Now().Add(s.timeout))
+	commands := [][]string{
+		{"MULTI"},
+		{"SET", key, "0", "PX", strconv.FormatInt(ms, 10), "NX"},
+		{"INCRBY", key, strconv.FormatInt(n, 10)},
+		{"EXEC"},
+	}
+	for _, cmd := range commands {
+		if err = c.send(cmd...); err != nil {
+			break
+		}
+	}
+	var reply interface{}
+	for range commands {
+		if err != nil {
+			break
+		}
+		reply, err = c.receive()
+	}
+	if err != nil {
+		// The connection may be left mid-transaction or mid-reply.
+		c.Close()
+		return 0, err
+	}
+	s.release(c)
+
+	results, ok := reply.([]interface{})
+	if !ok || len(results) != 2 {
+		return 0, fmt.Errorf("redis: unexpected EXEC reply %v", reply)
+	}
+	value, ok := results[1].(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected INCRBY reply %v", results[1])
+	}
+	return value, nil
+}
+
+// Close closes the idle connections.
+func (s *redisLimiterStore) Close() error {
+	for {
+		select {
+		case c := <-s.idle:
+			c.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// newLimiterStoreFromEnv returns the store selected by RATE_LIMIT_STORE: "memory", or "redis"
+// at REDIS_ADDR with REDIS_PASSWORD and REDIS_TIMEOUT. It returns nil when RATE_LIMIT_STORE is
+// unset, for rate limits kept by each replica in process.
+func newLimiterStoreFromEnv() (LimiterStore, error) {
+	switch kind := os.Getenv("RATE_LIMIT_STORE"); kind {
+	case "":
+		return nil, nil
+	case "memory":
+		return newMemoryLimiterStore(), nil
+	case "redis":
+		addr := os.Getenv("REDIS_ADDR")
+		if addr == "" {
+			addr = "localhost:6379"
+		}
+		timeout, err := envDuration("REDIS_TIMEOUT", time.Second)
+		if err != nil {
+			return nil, err
+		}
+		if timeout <= 0 {
+			return nil, fmt.Errorf("REDIS_TIMEOUT must be positive, got %s", timeout)
+		}
+		return newRedisLimiterStore(addr, os.Getenv("REDIS_PASSWORD"), timeout), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit store %q", kind)
+	}
+}
+
+// storeLimiter is a sliding window Limiter that keeps its counts in a LimiterStore, one
+// counter per client and fixed window. Replicas sharing a store must have synchronised clocks.
+type storeLimiter struct {
+	store  LimiterStore
+	prefix string // Namespaces the limiter's counters in the store.
+	limit  int
+	period time.Duration
+	now    func() time.Time
+}
+
+// newStoreLimiter returns a limiter applying limit with counters in store under prefix.
+func newStoreLimiter(store LimiterStore, prefix string, limit rateLimit) (*storeLimiter, error) {
+	if limit.Requests <= 0 || limit.Period <= 0 {
+		return nil, fmt.Errorf("rate limit must allow at least one request per period, got %d per %v", limit.Requests, limit.Period)
+	}
+	return &storeLimiter{store: store, prefix: prefix, limit: limit.Requests, period: limit.Period, now: time.Now}, nil
+}
+
+// counterKey returns the key of the client's counter for the fixed window starting at start.
+func (l *storeLimiter) counterKey(key string, start time.Time) string {
+	return l.prefix + ":" + key + ":" + strconv.FormatInt(start.UnixMilli(), 10)
+}
+
+func (l *storeLimiter) Allow(key string) rateDecision {
+	return l.check(key, 1)
+}
+
+func (l *storeLimiter) Charge(key string, cost int) {
+	now := l.now()
+	if _, err := l.store.Increment(l.counterKey(key, now.Truncate(l.period)), int64(cost), 2*l.period); err != nil {
+		logrus.Warnf("Could not charge request to rate limit store: %v", err)
+	}
+}
+
+func (l *storeLimiter) Peek(key string) rateDecision {
+	return l.check(key, 0)
+}
+
+// check counts n requests from the client and decides whether they are within the limit. A
+// request is counted before the decision, so that concurrent requests on other replicas see
+// it, and taken back if it is rejected. If the store is unavailable requests are allowed, so
+// that an outage of the store does not take the API down with it.
+func (l *storeLimiter) check(key string, n int64) rateDecision {
+	now := l.now()
+	s := slidingWindow{limit: l.limit, period: l.period, start: now.Truncate(l.period)}
+	// A window's counter is still needed as the previous window throughout the next one.
+	expiry := 2 * l.period
+	current := l.counterKey(key, s.start)
+
+	count, err := l.store.Increment(current, n, expiry)
+	var prev int64
+	if err == nil {
+		prev, err = l.store.Increment(l.counterKey(key, s.start.Add(-l.period)), 0, expiry)
+	}
+	if err != nil {
+		logrus.Warnf("Rate limit store unavailable, allowing request: %v", err)
+		return rateDecision{Allowed: true, Limit: l.limit, Remaining: l.limit}
+	}
+	s.count, s.prev = int(count), int(prev)
+
+	if n == 0 {
+		d := s.decision(now)
+		d.Allowed = d.Remaining > 0
+		return d
+	}
+	allowed := s.estimate(now) <= float64(l.limit)
+	if !allowed {
+		if _, err := l.store.Increment(current, -n, expiry); err != nil {
+			logrus.Warnf("Could not take back rejected request from rate limit store: %v", err)
+		}
+		s.count -= int(n)
+	}
+	d := s.decision(now)
+	d.Allowed = allowed
+	return d
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// miniRedis is an in-process server speaking just enough of the Redis protocol for
+// redisLimiterStore: AUTH, MULTI, EXEC, SET with PX and NX, and INCRBY.
+type miniRedis struct {
+	ln       net.Listener
+	password string
+
+	mu     sync.Mutex
+	values map[string]int64
+	expiry map[string]time.Time
+	offset time.Duration // Added to the wall clock, to expire keys without waiting.
+}
+
+// newMiniRedis starts a server requiring password, unless it is empty, until the test ends.
+func newMiniRedis(t *testing.T, password string) *miniRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &miniRedis{ln: ln, password: password, values: make(map[string]int64), expiry: make(map[string]time.Time)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return m
+}
+
+// addr returns the address the server listens on.
+func (m *miniRedis) addr() string {
+	return m.ln.Addr().String()
+}
+
+// advance moves the server's clock forward by d.
+func (m *miniRedis) advance(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.offset += d
+}
+
+// serve handles the commands sent on conn until it is closed.
+func (m *miniRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	c := &redisConn{Conn: conn, r: bufio.NewReader(conn)}
+	authenticated := m.password == ""
+	var queued [][]string
+	inMulti := false
+
+	for {
+		req, err := c.receive()
+		if err != nil {
+			return
+		}
+		items, _ := req.([]interface{})
+		var args []string
+		for _, item := range items {
+			s, _ := item.(string)
+			args = append(args, s)
+		}
+		if len(args) == 0 {
+			return
+		}
+
+		var reply string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			authenticated = len(args) == 2 && args[1] == m.password
+			reply = "+OK\r\n"
+			if !authenticated {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case cmd == "MULTI":
+			inMulti, queued = true, nil
+			reply = "+OK\r\n"
+		case cmd == "EXEC":
+			m.mu.Lock()
+			reply = "*" + strconv.Itoa(len(queued)) + "\r\n"
+			for _, q := range queued {
+				reply += m.exec(q)
+			}
+			m.mu.Unlock()
+			inMulti = false
+		case inMulti:
+			queued = append(queued, args)
+			reply = "+QUEUED\r\n"
+		default:
+			m.mu.Lock()
+			reply = m.exec(args)
+			m.mu.Unlock()
+		}
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+// exec runs a data command and returns its encoded reply. m.mu must be held.
+func (m *miniRedis) exec(args []string) string {
+	now := time.Now().Add(m.offset)
+	key := ""
+	if len(args) > 1 {
+		key = args[1]
+		if exp, ok := m.expiry[key]; ok && !now.Before(exp) {
+			delete(m.values, key)
+			delete(m.expiry, key)
+		}
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "SET":
+		// SET key value PX ms NX, the only form the store uses.
+		if len(args) != 6 || strings.ToUpper(args[3]) != "PX" || strings.ToUpper(args[5]) != "NX" {
+			return "-ERR syntax error\r\n"
+		}
+		value, err1 := strconv.ParseInt(args[2], 10, 64)
+		ms, err2 := strconv.ParseInt(args[4], 10, 64)
+		if err1 != nil || err2 != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		if _, ok := m.values[key]; ok {
+			return "$-1\r\n"
+		}
+		m.values[key] = value
+		m.expiry[key] = now.Add(time.Duration(ms) * time.Millisecond)
+		return "+OK\r\n"
+	case "INCRBY":
+		n, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		m.values[key] += n
+		return ":" + strconv.FormatInt(m.values[key], 10) + "\r\n"
+	}
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+}
+
+// TestLimiterStores tests that each store increments atomically and expires counters.
+func TestLimiterStores(t *testing.T) {
+	memory := newMemoryLimiterStore()
+	now := time.Now()
+	memory.now = func() time.Time { return now }
+
+	server := newMiniRedis(t, "")
+	redis := newRedisLimiterStore(server.addr(), "", time.Second)
+	t.Cleanup(func() { redis.Close() })
+
+	stores := []struct {
+		name    string
+		store   LimiterStore
+		advance func(time.Duration)
+	}{
+		{"memory", memory, func(d time.Duration) { now = now.Add(d) }},
+		{"redis", redis, server.advance},
+	}
+	for _, tc := range stores {
+		t.Run(tc.name, func(t *testing.T) {
+			steps := []struct {
+				key     string
+				n       int64
+				elapsed time.Duration
+				want    int64
+			}{
+				{"a", 1, 0, 1},
+				{"a", 1, 0, 2},
+				{"a", -1, 0, 1},
+				{"b", 0, 0, 0},
+				{"a", 5, 30 * time.Second, 6},
+				// Incrementing does not extend the expiry set when the counter was created.
+				{"a", 1, 31 * time.Second, 1},
+			}
+			for i, step := range steps {
+				tc.advance(step.elapsed)
+				got, err := tc.store.Increment(step.key, step.n, time.Minute)
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				if got != step.want {
+					t.Errorf("step %d: expected %s to be %d, got %d", i, step.key, step.want, got)
+				}
+			}
+		})
+	}
+}
+
+// TestRedisLimiterStoreAuth tests authenticating to the server and connection failures.
+func TestRedisLimiterStoreAuth(t *testing.T) {
+	server := newMiniRedis(t, "s3cret")
+
+	if _, err := newRedisLimiterStore(server.addr(), "wrong", time.Second).Increment("a", 1, time.Minute); err == nil {
+		t.Error("expected a wrong password to be an error")
+	}
+	if _, err := newRedisLimiterStore(server.addr(), "", time.Second).Increment("a", 1, time.Minute); err == nil {
+		t.Error("expected a missing password to be an error")
+	}
+	store := newRedisLimiterStore(server.addr(), "s3cret", time.Second)
+	defer store.Close()
+	if n, err := store.Increment("a", 1, time.Minute); err != nil || n != 1 {
+		t.Errorf("expected 1, got %d, %v", n, err)
+	}
+
+	server.ln.Close()
+	unreachable := newRedisLimiterStore(server.addr(), "s3cret", 100*time.Millisecond)
+	if _, err := unreachable.Increment("a", 1, time.Minute); err == nil {
+		t.Error("expected an unreachable server to be an error")
+	}
+}
+
+// TestStoreLimiterAcrossReplicas tests that replicas sharing a Redis server share their limits,
+// however their requests interleave; run with -race.
+func TestStoreLimiterAcrossReplicas(t *testing.T) {
+	server := newMiniRedis(t, "")
+	now := time.Now().Truncate(time.Minute).Add(10 * time.Second)
+
+	var replicas []*storeLimiter
+	for i := 0; i < 3; i++ {
+		store := newRedisLimiterStore(server.addr(), "", time.Second)
+		t.Cleanup(func() { store.Close() })
+		l, err := newStoreLimiter(store, "go-books:ratelimit:test", rateLimit{Requests: 50, Period: time.Minute})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.now = func() time.Time { return now }
+		replicas = append(replicas, l)
+	}
+
+	var granted int64
+	var wg sync.WaitGroup
+	for g := 0; g < 12; g++ {
+		wg.Add(1)
+		go func(l *storeLimiter) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				if l.Allow("user:alice").Allowed {
+					atomic.AddInt64(&granted, 1)
+				}
+			}
+		}(replicas[g%len(replicas)])
+	}
+	wg.Wait()
+
+	if granted != 50 {
+		t.Errorf("expected 50 requests to be allowed across replicas, got %d", granted)
+	}
+	for i, l := range replicas {
+		if d := l.Peek("user:alice"); d.Remaining != 0 || d.Limit != 50 {
+			t.Errorf("replica %d: expected no requests remaining of 50, got %+v", i, d)
+		}
+	}
+	if d := replicas[0].Peek("user:bob"); d.Remaining != 50 {
+		t.Errorf("expected other clients to have their own limit, got %+v", d)
+	}
+}
+
+// TestStoreLimiter tests the sliding window kept in a store against the in-process one.
+func TestStoreLimiter(t *testing.T) {
+	store := newMemoryLimiterStore()
+	l, err := newStoreLimiter(store, "test", rateLimit{Requests: 10, Period: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	store.now = l.now
+
+	if got := allowed(l, "a", 20); got != 10 {
+		t.Fatalf("expected 10 requests in the first window, got %d", got)
+	}
+	if d := l.Peek("a"); d.Remaining != 0 || !closeTo(d.RetryAfter, 66*time.Second) {
+		t.Errorf("expected to retry in the next window, got %+v", d)
+	}
+
+	// Halfway through the next window, half of the previous window still counts.
+	now = now.Add(90 * time.Second)
+	if got := allowed(l, "a", 20); got != 5 {
+		t.Errorf("expected 5 requests half a window later, got %d", got)
+	}
+
+	now = now.Add(5 * time.Minute)
+	if got := allowed(l, "a", 20); got != 10 {
+		t.Errorf("expected a full allowance after being idle, got %d", got)
+	}
+}
+
+// TestStoreLimiterUnavailable tests that requests are allowed while the store is down.
+func TestStoreLimiterUnavailable(t *testing.T) {
+	server := newMiniRedis(t, "")
+	server.ln.Close()
+	l, err := newStoreLimiter(newRedisLimiterStore(server.addr(), "", 100*time.Millisecond), "test", rateLimit{Requests: 1, Period: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := allowed(l, "a", 3); got != 3 {
+		t.Errorf("expected requests to be allowed while the store is unavailable, got %d of 3", got)
+	}
+}
+
+// TestRateLimitPolicyStore tests building policies on a store.
+func TestRateLimitPolicyStore(t *testing.T) {
+	store := newMemoryLimiterStore()
+	configs := map[string]policyConfig{
+		"default": {limit: rateLimit{Requests: 10, Period: time.Minute}, keys: []string{"user"}, store: store},
+	}
+	policies, err := newRateLimitPolicies(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, ok := policies.Default.limiter.(*storeLimiter)
+	if !ok {
+		t.Fatalf("expected a store limiter, got %T", policies.Default.limiter)
+	}
+	if l.prefix != "go-books:ratelimit:default" {
+		t.Errorf("expected the policy's counters to be namespaced by its name, got %q", l.prefix)
+	}
+
+	configs["default"] = policyConfig{algorithm: algorithmTokenBucket, limit: rateLimit{Requests: 10, Period: time.Minute}, store: store}
+	if _, err := newRateLimitPolicies(configs); err == nil {
+		t.Error("expected the token bucket algorithm with a store to be an error")
+	}
+}
+
+// TestNewLimiterStoreFromEnv tests that invalid store settings are rejected at startup.
+func TestNewLimiterStoreFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantNil bool
+		wantErr bool
+	}{
+		{"in process", nil, true, false},
+		{"memory", map[string]string{"RATE_LIMIT_STORE": "memory"}, false, false},
+		{"redis", map[string]string{"RATE_LIMIT_STORE": "redis"}, false, false},
+		{"unknown store", map[string]string{"RATE_LIMIT_STORE": "etcd"}, true, true},
+		{"zero timeout", map[string]string{"RATE_LIMIT_STORE": "redis", "REDIS_TIMEOUT": "0"}, true, true},
+		{"negative timeout", map[string]string{"RATE_LIMIT_STORE": "redis", "REDIS_TIMEOUT": "-1s"}, true, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, key := range []string{"RATE_LIMIT_STORE", "REDIS_ADDR", "REDIS_TIMEOUT"} {
+				t.Setenv(key, tc.env[key])
+			}
+			store, err := newLimiterStoreFromEnv()
+			if (err != nil) != tc.wantErr || (store == nil) != tc.wantNil {
+				t.Errorf("expected nil %v and error %v, got %v, %v", tc.wantNil, tc.wantErr, store, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ErrLoginThrottled is returned by login while failed attempts hold back the username or IP.
+var ErrLoginThrottled = errors.New("too many failed login attempts")
+
+// throttledError is an ErrLoginThrottled that says when to try again.
+type throttledError struct {
+	retryAfter time.Duration
+}
+
+func (e *throttledError) Error() string {
+	return fmt.Sprintf("%v, retry in %s", ErrLoginThrottled, e.retryAfter.Round(time.Second))
+}
+
+func (e *throttledError) Unwrap() error { return ErrLoginThrottled }
+
+// loginFailures counts the consecutive failed logins for a username or IP.
+type loginFailures struct {
+	count int
+	last  time.Time
+}
+
+// loginAttempt is a login attempt reserved by loginGuard.begin. It counts as a failure of its
+// username and IP from the start, so that concurrent attempts cannot all get past the limits
+// before any of them fails; release takes it back if it turns out not to have failed.
+type loginAttempt struct {
+	username string
+	ip       string
+	at       time.Time
+	prev     [2]loginFailures // The username's and the IP's failures before the attempt.
+	locks    bool             // Whether the attempt locked out the username or the IP.
+}
+
+// loginGuardConfig configures a loginGuard.
+type loginGuardConfig struct {
+	maxUserFailures int           // Failures after which a username is locked out.
+	maxIPFailures   int           // Failures after which a client IP is locked out.
+	backoff         time.Duration // Wait after a username's first failure, doubling with each further one.
+	maxBackoff      time.Duration
+	lockout         time.Duration // How long a lockout lasts, and failures are remembered for.
+}
+
+// loginGuard tracks failed logins per username and per client IP. After each failure for a
+// username the next attempt must wait exponentially longer, and after enough of them the
+// username is locked out. IPs are locked out after failing for many usernames, without
+// back-off, so that one mistyped password does not hold back everyone behind a shared address.
+// Usernames are tracked whether or not an account exists, so that lockouts do not reveal which
+// do.
+type loginGuard struct {
+	mu        sync.Mutex
+	cfg       loginGuardConfig
+	usernames map[string]*loginFailures
+	ips       map[string]*loginFailures
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// defaultLoginGuardConfig is the built-in login guard configuration.
+var defaultLoginGuardConfig = loginGuardConfig{
+	maxUserFailures: 5,
+	maxIPFailures:   20,
+	backoff:         time.Second,
+	maxBackoff:      time.Minute,
+	lockout:         15 * time.Minute,
+}
+
+// newLoginGuard returns a guard with no failures recorded.
+func newLoginGuard(cfg loginGuardConfig) *loginGuard {
+	return &loginGuard{
+		cfg:       cfg,
+		usernames: make(map[string]*loginFailures),
+		ips:       make(map[string]*loginFailures),
+		now:       time.Now,
+	}
+}
+
+// loginAttempts guards the login routes. It is replaced at startup by newLoginGuardFromEnv.
+var loginAttempts = newLoginGuard(defaultLoginGuardConfig)
+
+// newLoginGuardFromEnv configures the login guard from LOGIN_MAX_FAILURES,
+// LOGIN_MAX_IP_FAILURES, LOGIN_BACKOFF, LOGIN_MAX_BACKOFF and LOGIN_LOCKOUT.
+func newLoginGuardFromEnv() (*loginGuard, error) {
+	cfg := defaultLoginGuardConfig
+	var err error
+	if cfg.maxUserFailures, err = envInt("LOGIN_MAX_FAILURES", cfg.maxUserFailures); err != nil {
+		return nil, err
+	}
+	if cfg.maxIPFailures, err = envInt("LOGIN_MAX_IP_FAILURES", cfg.maxIPFailures); err != nil {
+		return nil, err
+	}
+	if cfg.backoff, err = envDuration("LOGIN_BACKOFF", cfg.backoff); err != nil {
+		return nil, err
+	}
+	if cfg.maxBackoff, err = envDuration("LOGIN_MAX_BACKOFF", cfg.maxBackoff); err != nil {
+		return nil, err
+	}
+	if cfg.lockout, err = envDuration("LOGIN_LOCKOUT", cfg.lockout); err != nil {
+		return nil, err
+	}
+	if cfg.maxUserFailures <= 0 || cfg.maxIPFailures <= 0 || cfg.lockout <= 0 {
+		return nil, errors.New("login failure limits and lockout must be positive")
+	}
+	if cfg.backoff < 0 {
+		return nil, fmt.Errorf("LOGIN_BACKOFF must not be negative, got %s", cfg.backoff)
+	}
+	if cfg.maxBackoff < cfg.backoff {
+		return nil, fmt.Errorf("LOGIN_MAX_BACKOFF must be at least LOGIN_BACKOFF (%s), got %s", cfg.backoff, cfg.maxBackoff)
+	}
+	return newLoginGuard(cfg), nil
+}
+
+// wait returns how long after now the next attempt must wait given the failures f, where max
+// failures lock it out. Before then, attempts back off exponentially if backoff is set.
+func (g *loginGuard) wait(f *loginFailures, max int, backoff bool, now time.Time) time.Duration {
+	if f == nil || f.count == 0 || (f.count < max && !backoff) {
+		return 0
+	}
+	delay := g.cfg.lockout
+	if f.count < max {
+		delay = g.cfg.maxBackoff
+		if f.count-1 < 32 {
+			if d := g.cfg.backoff << (f.count - 1); d > 0 && d < delay {
+				delay = d
+			}
+		}
+	}
+	if wait := f.last.Add(delay).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// check returns how long the client at ip must wait before trying to log in as username, or
+// zero if it may try now.
+func (g *loginGuard) check(username, ip string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.waitFor(username, ip, g.now())
+}
+
+// waitFor is check at now. g.mu must be held.
+func (g *loginGuard) waitFor(username, ip string, now time.Time) time.Duration {
+	wait := g.wait(g.usernames[username], g.cfg.maxUserFailures, true, now)
+	if ipWait := g.wait(g.ips[ip], g.cfg.maxIPFailures, false, now); ipWait > wait {
+		wait = ipWait
+	}
+	return wait
+}
+
+// begin reserves a login attempt as username from ip, counting it as a failure until it is
+// released. If failed attempts hold back the username or the IP, it reserves nothing and
+// returns how long to wait instead.
+func (g *loginGuard) begin(username, ip string) (*loginAttempt, time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	if wait := g.waitFor(username, ip, now); wait > 0 {
+		return nil, wait
+	}
+
+	g.sweep(now)
+	a := &loginAttempt{username: username, ip: ip, at: now}
+	for i, t := range g.counters(a) {
+		f, ok := t.failures[t.key]
+		if !ok || now.Sub(f.last) > g.cfg.lockout {
+			f = &loginFailures{}
+			t.failures[t.key] = f
+		}
+		a.prev[i] = *f
+		f.count++
+		f.last = now
+		a.locks = a.locks || f.count == t.max
+	}
+	return a, 0
+}
+
+// release takes back an attempt that did not fail, restoring the failures it counted unless
+// later attempts have counted more since.
+func (g *loginGuard) release(a *loginAttempt) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for i, t := range g.counters(a) {
+		f, ok := t.failures[t.key]
+		switch {
+		case !ok:
+		case f.count == a.prev[i].count+1 && f.last.Equal(a.at):
+			*f = a.prev[i]
+		case f.count > 0:
+			f.count--
+		}
+		if ok && f.count == 0 {
+			delete(t.failures, t.key)
+		}
+	}
+}
+
+// succeed releases a successful attempt and clears the failures of its username. Those of the
+// IP remain, so that an attacker cannot reset them by logging in to an account of their own.
+func (g *loginGuard) succeed(a *loginAttempt) {
+	g.release(a)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.usernames, a.username)
+}
+
+// loginCounter locates the failures of one username or IP, and how many lock it out.
+type loginCounter struct {
+	failures map[string]*loginFailures
+	key      string
+	max      int
+}
+
+// counters returns the counters an attempt counts towards: its username's, then its IP's.
+func (g *loginGuard) counters(a *loginAttempt) [2]loginCounter {
+	return [2]loginCounter{
+		{g.usernames, a.username, g.cfg.maxUserFailures},
+		{g.ips, a.ip, g.cfg.maxIPFailures},
+	}
+}
+
+// unlock clears the failures of username and reports whether there were any.
+func (g *loginGuard) unlock(username string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.usernames[username]
+	delete(g.usernames, username)
+	return ok
+}
+
+// sweep forgets failures older than the lockout. It runs at most once a minute. g.mu must be held.
+func (g *loginGuard) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < time.Minute {
+		return
+	}
+	g.lastSweep = now
+	for _, failures := range []map[string]*loginFailures{g.usernames, g.ips} {
+		for key, f := range failures {
+			if now.Sub(f.last) > g.cfg.lockout {
+				delete(failures, key)
+			}
+		}
+	}
+}
+
+// login authenticates username and password for the client that sent r, unless failed
+// attempts hold back the username or the client's IP, in which case it returns a
+// throttledError. Throttled, unknown and known usernames take the same path up to the
+// password check, so that responses do not reveal which accounts exist. Each attempt counts as
+// a failure until its password is found to be right, so that concurrent guesses cannot get
+// past the limits. The failures of users with two-factor authentication are only cleared once
+// they present their second factor.
+func login(r *http.Request, username, password string) (*User, error) {
+	username = normalizeUsername(username)
+	ip := clientIP(r)
+	attempt, wait := loginAttempts.begin(username, ip)
+	if wait > 0 {
+		return nil, &throttledError{retryAfter: wait}
+	}
+
+	user, err := authenticate(userStore, username, password)
+	switch {
+	case errors.Is(err, ErrInvalidCredentials):
+		if attempt.locks {
+			auditLog(r).Warnf("Locking out logins as %q or from %s after repeated failures", username, ip)
+		}
+	case err == nil && !user.MFAEnabled():
+		loginAttempts.succeed(attempt)
+	default:
+		loginAttempts.release(attempt)
+	}
+	return user, err
+}
+
+// unlockUserHandler clears the failed logins locking out the user named in the path.
+func unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := userStore.GetByID(mux.Vars(r)["id"])
+	if errors.Is(err, ErrUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error looking up user", http.StatusInternalServerError)
+		return
+	}
+
+	if loginAttempts.unlock(user.Username) {
+		auditLog(r).Infof("Unlocked logins of user %s (%s)", user.ID, user.Username)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
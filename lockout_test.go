@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// useLoginGuard swaps loginAttempts for a fresh guard with a fake clock for the duration of a test.
+func useLoginGuard(t *testing.T, cfg loginGuardConfig) (*loginGuard, *time.Time) {
+	t.Helper()
+	g := newLoginGuard(cfg)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	g.now = func() time.Time { return now }
+	original := loginAttempts
+	loginAttempts = g
+	t.Cleanup(func() { loginAttempts = original })
+	return g, &now
+}
+
+// postLogin posts credentials to POST /auth/login from ip through the application router.
+func postLogin(username, password, ip string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/auth/login", strings.NewReader(fmt.Sprintf(`{"username": %q, "password": %q}`, username, password)))
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = ip + ":1234"
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+// TestLoginGuardBackoff tests that a username's attempts back off exponentially until it is
+// locked out, and that failures are forgotten after the lockout.
+func TestLoginGuardBackoff(t *testing.T) {
+	g, now := useLoginGuard(t, defaultLoginGuardConfig)
+
+	steps := []struct {
+		elapsed time.Duration
+		want    time.Duration
+	}{
+		{0, time.Second},
+		{time.Second, 2 * time.Second},
+		{2 * time.Second, 4 * time.Second},
+		{4 * time.Second, 8 * time.Second},
+		{8 * time.Second, 15 * time.Minute}, // The fifth failure locks the username out.
+	}
+	for i, step := range steps {
+		*now = now.Add(step.elapsed)
+		if wait := g.check("alice", "192.0.2.1"); wait != 0 {
+			t.Fatalf("failure %d: expected no wait before failing, got %v", i+1, wait)
+		}
+		g.begin("alice", "192.0.2.1")
+		if wait := g.check("alice", "192.0.2.1"); wait != step.want {
+			t.Errorf("failure %d: expected to wait %v, got %v", i+1, step.want, wait)
+		}
+	}
+	if wait := g.check("bob", "192.0.2.1"); wait != 0 {
+		t.Errorf("expected other usernames from the same IP not to wait, got %v", wait)
+	}
+
+	*now = now.Add(15*time.Minute + time.Second)
+	attempt, _ := g.begin("alice", "192.0.2.1")
+	if wait := g.check("alice", "192.0.2.1"); wait != time.Second {
+		t.Errorf("expected failures to be forgotten after the lockout, got a wait of %v", wait)
+	}
+
+	g.succeed(attempt)
+	if wait := g.check("alice", "192.0.2.1"); wait != 0 {
+		t.Errorf("expected a successful login to clear the username's failures, got a wait of %v", wait)
+	}
+}
+
+// TestLoginGuardIP tests that an IP failing for many usernames is locked out.
+func TestLoginGuardIP(t *testing.T) {
+	g, _ := useLoginGuard(t, loginGuardConfig{maxUserFailures: 5, maxIPFailures: 3, backoff: time.Second, maxBackoff: time.Minute, lockout: time.Hour})
+
+	for i := 0; i < 3; i++ {
+		if wait := g.check(fmt.Sprintf("user%d", i), "192.0.2.1"); wait != 0 {
+			t.Fatalf("attempt %d: expected the IP not to wait before being locked out, got %v", i, wait)
+		}
+		g.begin(fmt.Sprintf("user%d", i), "192.0.2.1")
+	}
+	if wait := g.check("someone-else", "192.0.2.1"); wait != time.Hour {
+		t.Errorf("expected the IP to be locked out for an hour, got %v", wait)
+	}
+	if wait := g.check("someone-else", "192.0.2.2"); wait != 0 {
+		t.Errorf("expected other IPs not to be locked out, got %v", wait)
+	}
+}
+
+// TestLoginGuardRelease tests that attempts that turn out not to have failed are taken back,
+// leaving the earlier failures as they were.
+func TestLoginGuardRelease(t *testing.T) {
+	g, now := useLoginGuard(t, defaultLoginGuardConfig)
+
+	g.begin("alice", "192.0.2.1")
+	*now = now.Add(time.Second)
+	attempt, wait := g.begin("alice", "192.0.2.1")
+	if wait != 0 {
+		t.Fatalf("expected no wait after the back-off, got %v", wait)
+	}
+	g.release(attempt)
+	if wait := g.check("alice", "192.0.2.1"); wait != 0 {
+		t.Errorf("expected the released attempt not to extend the back-off, got a wait of %v", wait)
+	}
+	if f := g.usernames["alice"]; f == nil || f.count != 1 {
+		t.Errorf("expected the earlier failure to remain, got %+v", f)
+	}
+	if f := g.ips["192.0.2.1"]; f == nil || f.count != 1 {
+		t.Errorf("expected the IP's earlier failure to remain, got %+v", f)
+	}
+}
+
+// countingUserStore is a UserStore that counts username lookups, that is password checks.
+type countingUserStore struct {
+	UserStore
+	lookups atomic.Int32
+}
+
+func (s *countingUserStore) GetByUsername(username string) (*User, error) {
+	s.lookups.Add(1)
+	return s.UserStore.GetByUsername(username)
+}
+
+// TestLoginConcurrentGuesses tests that guesses made in parallel, before any of them has
+// failed, cannot check more passwords than the lockout allows.
+func TestLoginConcurrentGuesses(t *testing.T) {
+	store := &countingUserStore{UserStore: newMemoryUserStore()}
+	useUserStore(t, store)
+	useLoginGuard(t, loginGuardConfig{maxUserFailures: 5, maxIPFailures: 100, lockout: time.Hour})
+	if _, err := registerUser(store, "alice", "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	store.lookups.Store(0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := httptest.NewRequest("POST", "/auth/login", nil)
+			r.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", i+1)
+			login(r, "alice", fmt.Sprintf("guess %d", i))
+		}(i)
+	}
+	wg.Wait()
+	if n := store.lookups.Load(); n > 5 {
+		t.Errorf("expected at most 5 passwords to be checked, got %d", n)
+	}
+	if _, err := login(httptest.NewRequest("POST", "/auth/login", nil), "alice", "correct horse battery"); !errors.Is(err, ErrLoginThrottled) {
+		t.Errorf("expected the username to be locked out, got %v", err)
+	}
+}
+
+// TestLoginLockout tests that known and unknown usernames get identical responses through
+// their lockout, and that an admin can unlock an account.
+func TestLoginLockout(t *testing.T) {
+	useRateLimits(t)
+	useRevocationStore(t, newMemoryRevocationStore())
+	store := newMemoryUserStore()
+	useUserStore(t, store)
+	_, now := useLoginGuard(t, defaultLoginGuardConfig)
+
+	admin, err := registerUser(store, "admin", "adminpassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	useAdminUserIDs(t, admin.ID)
+	reader, err := registerUser(store, "reader", "readerpassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each attempt comes from a new IP, so only the username's limits apply.
+	responses := make(map[string][]string)
+	for n, username := range []string{"reader", "nobody"} {
+		for i := 0; i < defaultLoginGuardConfig.maxUserFailures+1; i++ {
+			*now = now.Add(time.Minute) // Past any back-off.
+			rr := postLogin(username, "wrong-password", fmt.Sprintf("192.0.%d.%d", n, i))
+			responses[username] = append(responses[username], fmt.Sprintf("%d %s %s", rr.Code, rr.Header().Get("Retry-After"), rr.Body.String()))
+		}
+	}
+	for i := range responses["reader"] {
+		if responses["reader"][i] != responses["nobody"][i] {
+			t.Errorf("attempt %d: expected identical responses for known and unknown users, got %q and %q", i, responses["reader"][i], responses["nobody"][i])
+		}
+	}
+	// The lockout started with the fifth failure, a minute earlier.
+	if last := responses["reader"][len(responses["reader"])-1]; !strings.HasPrefix(last, "429 840 ") {
+		t.Errorf("expected the account to be locked out for 14 more minutes, got %q", last)
+	}
+
+	if rr := postLogin("reader", "readerpassword", "192.0.2.100"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the right password to be refused during the lockout, got %d", rr.Code)
+	}
+
+	adminTokens, _ := issueTokens(admin, "", tokenGrant{})
+	target := "/api/admin/users/" + reader.ID + "/unlock"
+	if rr := authorizedRequest("POST", target, adminTokens.AccessToken); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected the admin to unlock the account, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := authorizedRequest("POST", "/api/admin/users/unknown/unlock", adminTokens.AccessToken); rr.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown user to be not found, got %d", rr.Code)
+	}
+	if rr := postLogin("reader", "readerpassword", "192.0.2.100"); rr.Code != http.StatusOK {
+		t.Errorf("expected the unlocked account to log in, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+// TestDummyPasswordHash tests that unknown users are checked against a hash of the same cost
+// as real ones.
+func TestDummyPasswordHash(t *testing.T) {
+	cost, err := bcrypt.Cost(dummyPasswordHash())
+	if err != nil || cost != bcryptCost {
+		t.Errorf("expected a dummy hash of cost %d, got %d (%v)", bcryptCost, cost, err)
+	}
+}
+
+// TestNewLoginGuardFromEnv tests that invalid login guard settings are rejected at startup.
+func TestNewLoginGuardFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{"defaults", nil, false},
+		{"no back-off", map[string]string{"LOGIN_BACKOFF": "0"}, false},
+		{"zero failures", map[string]string{"LOGIN_MAX_FAILURES": "0"}, true},
+		{"zero lockout", map[string]string{"LOGIN_LOCKOUT": "0"}, true},
+		{"negative back-off", map[string]string{"LOGIN_BACKOFF": "-1s"}, true},
+		{"negative maximum back-off", map[string]string{"LOGIN_MAX_BACKOFF": "-1s"}, true},
+		{"maximum below back-off", map[string]string{"LOGIN_BACKOFF": "2m", "LOGIN_MAX_BACKOFF": "1m"}, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, key := range []string{"LOGIN_MAX_FAILURES", "LOGIN_MAX_IP_FAILURES", "LOGIN_BACKOFF", "LOGIN_MAX_BACKOFF", "LOGIN_LOCKOUT"} {
+				t.Setenv(key, tc.env[key])
+			}
+			if _, err := newLoginGuardFromEnv(); (err != nil) != tc.wantErr {
+				t.Errorf("expected error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
@@ -1,78 +1,124 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"math"
 	"net/http"
-	"net/url"
 	"os"
-	"strings"
-	"time"
+	"strconv"
 
-	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 )
 
 // NOTE: This code intentionally includes vulnerabilities for demonstration purposes only.
 
-// Book struct to hold book data.
-type Book struct {
-	Title string `json:"title"`
-}
-
-// searchResults holds the API response structure.
-type searchResults struct {
-	Docs []Book `json:"docs"`
-}
-
-// jwtSecret is a hardcoded secret key (vulnerable to exposure).
+// jwtSecret is a hardcoded secret key (vulnerable to exposure). Tokens are signed with it
+// unless a signing key is configured; see newKeySetFromEnv.
 var jwtSecret = []byte("supersecretkey")
 
-// rateLimiter is a simple in-memory rate limiter map that is NOT thread-safe.
-// In a production system, use a robust rate limiter with proper locking or an external store.
-var rateLimiter = make(map[string]int)
-
-// searchHandler handles HTTP requests to search for books by author.
+// searchHandler handles HTTP requests to search for books by any combination of criteria.
 func searchHandler(w http.ResponseWriter, r *http.Request) {
-	author := r.URL.Query().Get("author")
-	if author == "" {
-		http.Error(w, "Missing 'author' query parameter", http.StatusBadRequest)
+	query, err := parseSearchQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid search: %v", err), http.StatusBadRequest)
 		return
 	}
 
-	safeAuthor := url.QueryEscape(author)
-	apiURL := fmt.Sprintf("https://openlibrary.org/search.json?author=%s", safeAuthor)
-	resp, err := http.Get(apiURL)
+	ctx, info := withFetchInfo(r.Context())
+	results, err := bookProvider.Search(ctx, query)
+	setCacheHeaders(w, info)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error fetching data: %v", err), http.StatusInternalServerError)
+		writeProviderError(w, err)
 		return
 	}
-	defer resp.Body.Close()
 
-	var results searchResults
-	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
-		http.Error(w, fmt.Sprintf("Error decoding data: %v", err), http.StatusInternalServerError)
+	if results.NumFound == 0 && len(results.Docs) == 0 {
+		http.Error(w, fmt.Sprintf("No books found matching %s", query), http.StatusNotFound)
 		return
 	}
 
-	if len(results.Docs) == 0 {
-		http.Error(w, fmt.Sprintf("No books found for author %s", author), http.StatusNotFound)
+	writeJSON(w, newSearchResponse(r.URL, query, results))
+}
+
+// workHandler returns a single work by its provider ID.
+func workHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, info := withFetchInfo(r.Context())
+	work, err := bookProvider.GetWork(ctx, mux.Vars(r)["id"])
+	setCacheHeaders(w, info)
+	if err != nil {
+		writeProviderError(w, err)
 		return
 	}
+	writeJSON(w, work)
+}
+
+// editionHandler returns a single edition by its provider ID.
+func editionHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, info := withFetchInfo(r.Context())
+	edition, err := bookProvider.GetEdition(ctx, mux.Vars(r)["id"])
+	setCacheHeaders(w, info)
+	if err != nil {
+		writeProviderError(w, err)
+		return
+	}
+	writeJSON(w, edition)
+}
+
+// setCacheHeaders reports how the upstream data for the response was obtained. Data served
+// because the upstream failed is flagged with X-Data-Stale, Age and a Warning.
+func setCacheHeaders(w http.ResponseWriter, info *fetchInfo) {
+	if status := info.CacheStatus(); status != "" {
+		w.Header().Set("X-Cache", status)
+	}
+	if age, stale := info.Stale(); stale {
+		w.Header().Set("X-Data-Stale", "true")
+		w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+		w.Header().Set("Warning", `111 go-books "Revalidation Failed"`)
+	}
+}
+
+// writeProviderError maps an error returned by the BookProvider to an HTTP response.
+func writeProviderError(w http.ResponseWriter, err error) {
+	var unavailable *unavailableError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, "Not found", http.StatusNotFound)
+	case errors.As(err, &unavailable):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(unavailable.retryAfter.Seconds()))))
+		http.Error(w, fmt.Sprintf("Service unavailable: %v", err), http.StatusServiceUnavailable)
+	case errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, "Upstream request timed out", http.StatusGatewayTimeout)
+	case errors.Is(err, ErrMalformedResponse):
+		http.Error(w, fmt.Sprintf("Error decoding data: %v", err), http.StatusInternalServerError)
+	default:
+		http.Error(w, fmt.Sprintf("Error fetching data: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// writeJSON encodes v as the JSON response body.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
 
+// writeJSONStatus encodes v as the JSON response body with the given status code.
+func writeJSONStatus(w http.ResponseWriter, status int, v interface{}) {
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(results); err != nil {
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
 		http.Error(w, fmt.Sprintf("Error encoding response: %v", err), http.StatusInternalServerError)
 	}
 }
 
-// loginHandler issues a JWT token for a user.
+// loginHandler issues a JWT token for a user. It is deprecated in favour of POST /auth/login
+// and can be disabled with ENABLE_GET_LOGIN=false. Users with two-factor authentication get
+// a challenge to answer at POST /auth/login/mfa, like from POST /auth/login.
 // Vulnerabilities:
 // - Accepts credentials via query parameters (insecure).
-// - Uses a hardcoded secret and no password validation.
-// - Does not set token expiration.
+// - Uses a hardcoded secret unless a signing key is configured.
 func loginHandler(w http.ResponseWriter, r *http.Request) {
 	username := r.URL.Query().Get("username")
 	password := r.URL.Query().Get("password")
@@ -82,21 +128,35 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Insecure: any username/password is accepted.
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"username": username,
-		"iat":      time.Now().Unix(),
-		// No expiration claim added
-	})
+	user, err := login(r, username, password)
+	var throttled *throttledError
+	if errors.As(err, &throttled) {
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(throttled.retryAfter)))
+		http.Error(w, "Too many failed login attempts", http.StatusTooManyRequests)
+		return
+	}
+	if errors.Is(err, ErrInvalidCredentials) {
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error checking credentials", http.StatusInternalServerError)
+		return
+	}
 
-	tokenString, err := token.SignedString(jwtSecret)
+	if user.MFAEnabled() {
+		writeMFAChallenge(w, user)
+		return
+	}
+	tokenString, err := issueAccessToken(user, "", tokenGrant{AMR: amrPassword})
 	if err != nil {
 		http.Error(w, "Error generating token", http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	io.WriteString(w, fmt.Sprintf(`{"token": "%s"}`, tokenString))
+	w.Header().Set("Deprecation", "true")
+	w.Header().Set("Link", `</auth/login>; rel="successor-version"`)
+	writeJSON(w, map[string]string{"token": tokenString})
 }
 
 // vulnerableHandler echoes a query parameter unsafely, making it vulnerable to XSS attacks.
@@ -107,55 +167,100 @@ func vulnerableHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "<html><body><h1>User Message:</h1><p>%s</p></body></html>", message)
 }
 
-// jwtMiddleware protects routes by requiring a valid JWT token.
+// jwtMiddleware protects routes by requiring a valid, unexpired and unrevoked JWT token for
+// this issuer and audience, signed with an allowed algorithm by a known key, or an API key in
+// the X-API-Key header. The caller is available to handlers through PrincipalFromContext.
 // Vulnerabilities:
-// - Uses a hardcoded secret.
-// - Does not check token expiration or additional claims.
+// - Uses a hardcoded secret unless a signing key is configured.
 func jwtMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			http.Error(w, "Missing Authorization header", http.StatusUnauthorized)
+		if key := r.Header.Get("X-API-Key"); key != "" {
+			p, err := authenticateAPIKey(key)
+			if err != nil {
+				http.Error(w, "Invalid API key", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), p)))
 			return
 		}
 
-		// Expected format: "Bearer <token>"
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			http.Error(w, "Invalid Authorization header format", http.StatusUnauthorized)
+		tokenStr, err := bearerToken(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
 		}
 
-		tokenStr := parts[1]
-		token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-			// Vulnerable: Simply returns the hardcoded secret.
-			return jwtSecret, nil
-		})
-
-		if err != nil || !token.Valid {
+		claims, err := parseAccessToken(tokenStr)
+		if err == nil {
+			err = checkNotRevoked(claims)
+		}
+		if err != nil {
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), newPrincipal(claims))))
 	})
 }
 
-// rateLimitMiddleware is a simple rate limiting middleware.
-// Vulnerabilities:
-// - The in-memory map is not protected from concurrent access.
-// - The rate count is never reset.
-func rateLimitMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip := r.RemoteAddr
-		if count, exists := rateLimiter[ip]; exists && count >= 10 {
-			http.Error(w, "Too many requests", http.StatusTooManyRequests)
-			return
-		}
-		// Vulnerable to race conditions: concurrent requests may access rateLimiter unsafely.
-		rateLimiter[ip]++
-		next.ServeHTTP(w, r)
-	})
+// newRouter builds the application's routes.
+func newRouter() *mux.Router {
+	// Use Gorilla Mux router.
+	router := mux.NewRouter()
+
+	// Public endpoints.
+	if legacyLoginEnabled {
+		handleLimited(router, "/login", rateLimits.Login, loginHandler).Methods("GET")
+	}
+	handleLimited(router, "/auth/login", rateLimits.Login, tokenLoginHandler).Methods("POST")
+	handleLimited(router, "/auth/login/mfa", rateLimits.Login, mfaLoginHandler).Methods("POST")
+	handleLimited(router, "/auth/refresh", rateLimits.Login, refreshHandler).Methods("POST")
+	handleLimited(router, "/register", rateLimits.Login, registerHandler).Methods("POST")
+	router.HandleFunc("/.well-known/jwks.json", jwksHandler).Methods("GET")
+	router.HandleFunc("/.well-known/openid-configuration", openIDConfigurationHandler).Methods("GET")
+	handleLimited(router, "/oauth/authorize", rateLimits.Login, authorizeHandler).Methods("GET", "POST")
+	// The client is authenticated before it is rate limited, so that each client has its own allowance.
+	rateLimits.Token.addRoute(router.Handle("/oauth/token", authenticateTokenRequest(rateLimitMiddleware(rateLimits.Token)(http.HandlerFunc(oauthTokenHandler)))).Methods("POST"))
+	router.Handle("/userinfo", jwtMiddleware(RequireScope(scopeOpenID)(http.HandlerFunc(userinfoHandler)))).Methods("GET", "POST")
+	router.Handle("/auth/logout", jwtMiddleware(http.HandlerFunc(logoutHandler))).Methods("POST")
+	handleLimited(router, "/vulnerable", rateLimits.Default, vulnerableHandler).Methods("GET")
+
+	// Protected endpoints (require valid JWT with the route's scope).
+	api := router.PathPrefix("/api").Subrouter()
+	api.Use(jwtMiddleware)
+
+	books := api.NewRoute().Subrouter()
+	books.Use(RequireScope(scopeBooksRead), planMiddleware)
+	handleLimited(books, "/search", rateLimits.Search, searchHandler).Methods("GET")
+	handleLimited(books, "/works/{id}", rateLimits.Default, workHandler).Methods("GET")
+	handleLimited(books, "/editions/{id}", rateLimits.Default, editionHandler).Methods("GET")
+
+	cache := api.NewRoute().Subrouter()
+	cache.Use(RequireScope(scopeCacheRead))
+	cache.HandleFunc("/cache/stats", cacheStatsHandler).Methods("GET")
+
+	account := api.NewRoute().Subrouter()
+	account.Use(RequireFirstParty)
+	account.HandleFunc("/keys", createAPIKeyHandler).Methods("POST")
+	account.HandleFunc("/keys", listAPIKeysHandler).Methods("GET")
+	account.HandleFunc("/keys/{id}", revokeAPIKeyHandler).Methods("DELETE")
+	account.HandleFunc("/me/quota", quotaHandler).Methods("GET")
+	account.HandleFunc("/me/mfa/totp", enrollTOTPHandler).Methods("POST")
+	account.HandleFunc("/me/mfa/totp/confirm", confirmTOTPHandler).Methods("POST")
+	account.Handle("/me/mfa/totp", RequireMFA(http.HandlerFunc(disableTOTPHandler))).Methods("DELETE")
+	account.Handle("/me/mfa/recovery-codes", RequireMFA(http.HandlerFunc(recoveryCodesHandler))).Methods("POST")
+
+	admin := api.PathPrefix("/admin").Subrouter()
+	admin.Use(RequireFirstParty, RequireScope(scopeUsersAdmin))
+	if adminMFARequired {
+		admin.Use(RequireMFA)
+	}
+	admin.HandleFunc("/users/{id}/roles", setRolesHandler).Methods("PUT")
+	admin.HandleFunc("/users/{id}/revoke-sessions", revokeSessionsHandler).Methods("POST")
+	admin.HandleFunc("/users/{id}/unlock", unlockUserHandler).Methods("POST")
+	admin.HandleFunc("/oauth/clients", registerClientHandler).Methods("POST")
+
+	return router
 }
 
 func main() {
@@ -163,17 +268,97 @@ func main() {
 	logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
 	logrus.Info("Starting application...")
 
-	// Use Gorilla Mux router.
-	router := mux.NewRouter()
+	cache, err := newResponseCacheFromEnv()
+	if err != nil {
+		logrus.Fatalf("Invalid response cache configuration: %v", err)
+	}
+	upstreamCache = cache
 
-	// Public endpoints.
-	router.HandleFunc("/login", loginHandler).Methods("GET")
-	router.Handle("/vulnerable", rateLimitMiddleware(http.HandlerFunc(vulnerableHandler))).Methods("GET")
+	users, err := newUserStoreFromEnv()
+	if err != nil {
+		logrus.Fatalf("Invalid user store configuration: %v", err)
+	}
+	userStore = users
 
-	// Protected endpoints (require valid JWT).
-	api := router.PathPrefix("/api").Subrouter()
-	api.Use(jwtMiddleware)
-	api.Handle("/search", rateLimitMiddleware(http.HandlerFunc(searchHandler))).Methods("GET")
+	provider, err := newBookProviderFromEnv()
+	if err != nil {
+		logrus.Fatalf("Invalid book provider configuration: %v", err)
+	}
+	bookProvider = provider
+
+	tokens, err := newTokenConfigFromEnv()
+	if err != nil {
+		logrus.Fatalf("Invalid token configuration: %v", err)
+	}
+	tokenSettings = tokens
+
+	keys, err := newKeySetFromEnv(tokens.accessTTL)
+	if err != nil {
+		logrus.Fatalf("Invalid signing key configuration: %v", err)
+	}
+	signingKeys = keys
+
+	getLogin, err := envBool("ENABLE_GET_LOGIN", true)
+	if err != nil {
+		logrus.Fatalf("Invalid login configuration: %v", err)
+	}
+	legacyLoginEnabled = getLogin
+
+	adminUserIDs = adminUserIDsFromEnv()
+
+	adminMFA, err := envBool("ADMIN_REQUIRE_MFA", false)
+	if err != nil {
+		logrus.Fatalf("Invalid admin configuration: %v", err)
+	}
+	adminMFARequired = adminMFA
+
+	limiterStore, err := newLimiterStoreFromEnv()
+	if err != nil {
+		logrus.Fatalf("Invalid rate limit store configuration: %v", err)
+	}
+	limits, err := newRateLimitPoliciesFromEnv(limiterStore)
+	if err != nil {
+		logrus.Fatalf("Invalid rate limit configuration: %v", err)
+	}
+	rateLimits = limits
+
+	cost, err := upstreamCallCostFromEnv()
+	if err != nil {
+		logrus.Fatalf("Invalid rate limit configuration: %v", err)
+	}
+	upstreamCallCost = cost
+
+	meteredPlans, err := newPlansFromEnv(limiterStore)
+	if err != nil {
+		logrus.Fatalf("Invalid plans configuration: %v", err)
+	}
+	plans = meteredPlans
+
+	guard, err := newLoginGuardFromEnv()
+	if err != nil {
+		logrus.Fatalf("Invalid login configuration: %v", err)
+	}
+	loginAttempts = guard
+
+	public, err := publicURLFromEnv()
+	if err != nil {
+		logrus.Fatalf("Invalid public URL: %v", err)
+	}
+	publicURL = public
+
+	proxies, err := trustedProxiesFromEnv()
+	if err != nil {
+		logrus.Fatalf("Invalid trusted proxy configuration: %v", err)
+	}
+	trustedProxies = proxies
+
+	header, err := forwardedHeaderFromEnv()
+	if err != nil {
+		logrus.Fatalf("Invalid trusted proxy configuration: %v", err)
+	}
+	forwardedHeader = header
+
+	router := newRouter()
 
 	// Use the PORT environment variable if available, else default to 8080.
 	port := os.Getenv("PORT")
@@ -181,7 +366,7 @@ func main() {
 		port = "8080"
 	}
 	logrus.Infof("Server starting on port %s...", port)
-	if err := http.ListenAndServe(":"+port, router); err != nil {
+	if err := http.ListenAndServe(":"+port, logRequests(router)); err != nil {
 		logrus.Fatalf("Server failed: %v", err)
 	}
 }
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authentication methods recorded in the amr claim of access tokens (RFC 8176).
+const (
+	amrMethodPassword = "pwd"
+	amrMethodOTP      = "otp"
+	amrMethodMFA      = "mfa"
+)
+
+var (
+	// amrPassword is the amr of users who logged in with a password alone.
+	amrPassword = []string{amrMethodPassword}
+	// amrMFA is the amr of users who logged in with a password and a TOTP or recovery code.
+	amrMFA = []string{amrMethodMFA, amrMethodOTP, amrMethodPassword}
+)
+
+const (
+	// mfaChallengeTTL is how long a user has to present their second factor after their password.
+	mfaChallengeTTL = 5 * time.Minute
+	// recoveryCodeCount is the number of recovery codes issued at a time.
+	recoveryCodeCount = 10
+)
+
+var (
+	// ErrInvalidMFAChallenge is returned by loginSecondFactor for an unknown or expired challenge token.
+	ErrInvalidMFAChallenge = errors.New("invalid or expired MFA token")
+	// ErrInvalidSecondFactor is returned for a wrong, reused or missing TOTP or recovery code.
+	ErrInvalidSecondFactor = errors.New("invalid two-factor authentication code")
+)
+
+// adminMFARequired controls whether admin routes require access tokens obtained with a second
+// factor. It is set at startup from ADMIN_REQUIRE_MFA.
+var adminMFARequired = false
+
+// mfaChallenge is a login waiting for its second factor.
+type mfaChallenge struct {
+	userID    string
+	expiresAt time.Time
+}
+
+// mfaChallengeStore keeps the challenges started by logins of users with two-factor
+// authentication, until they are answered or expire.
+type mfaChallengeStore struct {
+	mu         sync.Mutex
+	challenges map[string]mfaChallenge // By hash of the challenge token.
+	now        func() time.Time
+}
+
+// newMFAChallengeStore returns a store with no challenges.
+func newMFAChallengeStore() *mfaChallengeStore {
+	return &mfaChallengeStore{challenges: make(map[string]mfaChallenge), now: time.Now}
+}
+
+// mfaChallenges holds the pending second steps of logins.
+var mfaChallenges = newMFAChallengeStore()
+
+// create starts a challenge for userID and returns its token, dropping expired challenges.
+func (s *mfaChallengeStore) create(userID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for hash, c := range s.challenges {
+		if now.After(c.expiresAt) {
+			delete(s.challenges, hash)
+		}
+	}
+	token := newOpaqueToken()
+	s.challenges[hashToken(token)] = mfaChallenge{userID: userID, expiresAt: now.Add(mfaChallengeTTL)}
+	return token
+}
+
+// lookup returns the user a challenge token was issued to, unless it is unknown or expired.
+func (s *mfaChallengeStore) lookup(token string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.challenges[hashToken(token)]
+	if !ok || s.now().After(c.expiresAt) {
+		return "", false
+	}
+	return c.userID, true
+}
+
+// consume ends a challenge once it has been answered, so its token cannot be used again.
+func (s *mfaChallengeStore) consume(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.challenges, hashToken(token))
+}
+
+// newRecoveryCodes returns recoveryCodeCount random recovery codes and their hashes, which are
+// what is stored. Each code has 80 bits of entropy, written as four groups of four characters.
+func newRecoveryCodes() (codes, hashes []string) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			panic(err) // crypto/rand never fails on supported platforms.
+		}
+		s := strings.ToLower(totpEncoding.EncodeToString(b))
+		code := s[0:4] + "-" + s[4:8] + "-" + s[8:12] + "-" + s[12:16]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes
+}
+
+// hashRecoveryCode returns the stored form of a recovery code, ignoring case, spaces and dashes.
+func hashRecoveryCode(code string) string {
+	code = strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code))
+	return hashToken(code)
+}
+
+// mfaMu serializes checking second factors and recording their use, so that concurrent
+// requests cannot both use the same TOTP code or recovery code.
+var mfaMu sync.Mutex
+
+// useSecondFactor checks a TOTP code, or a recovery code if no TOTP code is given, for the user
+// with userID and records its use so that it cannot be used again. It returns the updated user.
+func useSecondFactor(userID, code, recoveryCode string) (*User, error) {
+	mfaMu.Lock()
+	defer mfaMu.Unlock()
+
+	user, err := userStore.GetByID(userID)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, ErrInvalidSecondFactor
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !user.MFAEnabled() {
+		return nil, ErrInvalidSecondFactor
+	}
+
+	switch {
+	case code != "":
+		step, ok := verifyTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastStep)
+		if !ok {
+			return nil, ErrInvalidSecondFactor
+		}
+		user.TOTPLastStep = step
+	case recoveryCode != "":
+		hash := hashRecoveryCode(recoveryCode)
+		found := -1
+		for i, stored := range user.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+				found = i
+			}
+		}
+		if found < 0 {
+			return nil, ErrInvalidSecondFactor
+		}
+		user.RecoveryCodes = append(user.RecoveryCodes[:found], user.RecoveryCodes[found+1:]...)
+	default:
+		return nil, ErrInvalidSecondFactor
+	}
+	if err := userStore.Update(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// loginSecondFactor completes the login that started the challenge mfaToken with a TOTP code
+// or recovery code. Wrong codes count as failed logins of the user, so that guessing codes is
+// throttled and eventually locked out like guessing passwords.
+func loginSecondFactor(r *http.Request, mfaToken, code, recoveryCode string) (*User, error) {
+	userID, ok := mfaChallenges.lookup(mfaToken)
+	if !ok {
+		return nil, ErrInvalidMFAChallenge
+	}
+	user, err := userStore.GetByID(userID)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, ErrInvalidMFAChallenge
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ip := clientIP(r)
+	attempt, wait := loginAttempts.begin(user.Username, ip)
+	if wait > 0 {
+		return nil, &throttledError{retryAfter: wait}
+	}
+	username := user.Username
+	user, err = useSecondFactor(userID, code, recoveryCode)
+	if errors.Is(err, ErrInvalidSecondFactor) {
+		if attempt.locks {
+			auditLog(r).Warnf("Locking out logins as %q or from %s after repeated failed codes", username, ip)
+		}
+		return nil, err
+	}
+	if err != nil {
+		loginAttempts.release(attempt)
+		return nil, err
+	}
+
+	mfaChallenges.consume(mfaToken)
+	loginAttempts.succeed(attempt)
+	if code == "" {
+		auditLog(r).Infof("User %s (%s) logged in with a recovery code; %d remain", user.ID, user.Username, len(user.RecoveryCodes))
+	}
+	return user, nil
+}
+
+// mfaChallengeResponse is the body of the 403 the login endpoints return when the password
+// was right but the user must also present a second factor at POST /auth/login/mfa.
+type mfaChallengeResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+	MFAToken         string `json:"mfa_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+}
+
+// writeMFAChallenge starts a challenge for user's second factor and sends its token.
+func writeMFAChallenge(w http.ResponseWriter, user *User) {
+	writeJSONStatus(w, http.StatusForbidden, mfaChallengeResponse{
+		Error:            "mfa_required",
+		ErrorDescription: "Two-factor authentication code required",
+		MFAToken:         mfaChallenges.create(user.ID),
+		ExpiresIn:        int64(mfaChallengeTTL.Seconds()),
+	})
+}
+
+// mfaLoginHandler answers a login's challenge with the mfa_token and a code or recovery_code
+// in a JSON or form body, responding like tokenLoginHandler.
+func mfaLoginHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	body, err := readAuthBody(w, r)
+	if err != nil {
+		writeJSONStatus(w, http.StatusBadRequest, oauthError{Error: "invalid_request", ErrorDescription: err.Error()})
+		return
+	}
+	if body["mfa_token"] == "" || (body["code"] == "" && body["recovery_code"] == "") {
+		writeJSONStatus(w, http.StatusBadRequest, oauthError{Error: "invalid_request", ErrorDescription: "missing mfa_token, or code or recovery_code"})
+		return
+	}
+
+	user, err := loginSecondFactor(r, body["mfa_token"], body["code"], body["recovery_code"])
+	var throttled *throttledError
+	switch {
+	case errors.As(err, &throttled):
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(throttled.retryAfter)))
+		writeJSONStatus(w, http.StatusTooManyRequests, oauthError{Error: "invalid_grant", ErrorDescription: "Too many failed login attempts"})
+		return
+	case errors.Is(err, ErrInvalidMFAChallenge):
+		writeJSONStatus(w, http.StatusUnauthorized, oauthError{Error: "invalid_grant", ErrorDescription: "Invalid or expired MFA token"})
+		return
+	case errors.Is(err, ErrInvalidSecondFactor):
+		writeJSONStatus(w, http.StatusUnauthorized, oauthError{Error: "invalid_grant", ErrorDescription: "Invalid two-factor authentication code"})
+		return
+	case err != nil:
+		writeJSONStatus(w, http.StatusInternalServerError, oauthError{Error: "server_error"})
+		return
+	}
+
+	resp, err := issueTokens(user, "", tokenGrant{AMR: amrMFA})
+	if err != nil {
+		writeJSONStatus(w, http.StatusInternalServerError, oauthError{Error: "server_error"})
+		return
+	}
+	writeJSON(w, resp)
+}
+
+// totpEnrolmentResponse is the body of POST /api/me/mfa/totp.
+type totpEnrolmentResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// recoveryCodesResponse lists newly issued recovery codes. They are only ever shown once.
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// enrollTOTPHandler starts enrolling the caller in two-factor authentication with a new TOTP
+// secret. It takes effect once confirmed with a code from it at POST /api/me/mfa/totp/confirm.
+// The caller must send their password, so that a stolen access token is not enough to enrol
+// another authenticator and lock the owner out. Wrong passwords count as failed logins.
+func enrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := tokenPrincipal(w, r)
+	if !ok {
+		return
+	}
+	body, err := readAuthBody(w, r)
+	if err != nil {
+		http.Error(w, "Invalid password: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, err := userStore.GetByID(p.UserID)
+	if err != nil {
+		http.Error(w, "Error looking up user", http.StatusInternalServerError)
+		return
+	}
+	_, err = login(r, user.Username, body["password"])
+	var throttled *throttledError
+	switch {
+	case errors.As(err, &throttled):
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(throttled.retryAfter)))
+		http.Error(w, "Too many failed login attempts", http.StatusTooManyRequests)
+		return
+	case errors.Is(err, ErrInvalidCredentials):
+		http.Error(w, "Invalid password", http.StatusForbidden)
+		return
+	case err != nil:
+		http.Error(w, "Error checking password", http.StatusInternalServerError)
+		return
+	}
+	mfaMu.Lock()
+	defer mfaMu.Unlock()
+
+	if user, err = userStore.GetByID(p.UserID); err != nil {
+		http.Error(w, "Error looking up user", http.StatusInternalServerError)
+		return
+	}
+	if user.MFAEnabled() {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	user.TOTPPending = newTOTPSecret()
+	if err := userStore.Update(user); err != nil {
+		http.Error(w, "Error updating user", http.StatusInternalServerError)
+		return
+	}
+	auditLog(r).Infof("Started two-factor enrolment of user %s (%s)", user.ID, user.Username)
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, totpEnrolmentResponse{Secret: user.TOTPPending, URI: totpURI(tokenSettings.issuer, user.Username, user.TOTPPending)})
+}
+
+// confirmTOTPHandler enables two-factor authentication for the caller once they send a code
+// from the secret being enrolled, and responds with their recovery codes. All of the user's
+// sessions, the caller's included, are revoked, so that anyone who logged in with the password
+// alone has to log in again with the second factor.
+func confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := tokenPrincipal(w, r)
+	if !ok {
+		return
+	}
+	body, err := readAuthBody(w, r)
+	if err != nil {
+		http.Error(w, "Invalid code: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	mfaMu.Lock()
+	defer mfaMu.Unlock()
+
+	user, err := userStore.GetByID(p.UserID)
+	if err != nil {
+		http.Error(w, "Error looking up user", http.StatusInternalServerError)
+		return
+	}
+	if user.TOTPPending == "" {
+		http.Error(w, "No two-factor enrolment in progress", http.StatusConflict)
+		return
+	}
+	step, ok := verifyTOTP(user.TOTPPending, body["code"], time.Now(), 0)
+	if !ok {
+		http.Error(w, "Invalid two-factor authentication code", http.StatusBadRequest)
+		return
+	}
+
+	codes, hashes := newRecoveryCodes()
+	user.TOTPSecret, user.TOTPPending, user.TOTPLastStep = user.TOTPPending, "", step
+	user.RecoveryCodes = hashes
+	if err := userStore.Update(user); err != nil {
+		http.Error(w, "Error updating user", http.StatusInternalServerError)
+		return
+	}
+	if err := revokedTokens.RevokeUser(user.ID, time.Now()); err != nil {
+		http.Error(w, "Error revoking sessions", http.StatusInternalServerError)
+		return
+	}
+	if err := refreshTokens.RevokeUser(user.ID); err != nil {
+		http.Error(w, "Error revoking sessions", http.StatusInternalServerError)
+		return
+	}
+	auditLog(r).Infof("Enabled two-factor authentication for user %s (%s)", user.ID, user.Username)
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, recoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// recoveryCodesHandler replaces the caller's recovery codes with new ones. It must run after
+// RequireMFA.
+func recoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := tokenPrincipal(w, r)
+	if !ok {
+		return
+	}
+	mfaMu.Lock()
+	defer mfaMu.Unlock()
+
+	user, err := userStore.GetByID(p.UserID)
+	if err != nil {
+		http.Error(w, "Error looking up user", http.StatusInternalServerError)
+		return
+	}
+	if !user.MFAEnabled() {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusConflict)
+		return
+	}
+	codes, hashes := newRecoveryCodes()
+	user.RecoveryCodes = hashes
+	if err := userStore.Update(user); err != nil {
+		http.Error(w, "Error updating user", http.StatusInternalServerError)
+		return
+	}
+	auditLog(r).Infof("Replaced the recovery codes of user %s (%s)", user.ID, user.Username)
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, recoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// disableTOTPHandler turns off two-factor authentication for the caller, discarding their
+// secret and recovery codes. It must run after RequireMFA.
+func disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := tokenPrincipal(w, r)
+	if !ok {
+		return
+	}
+	mfaMu.Lock()
+	defer mfaMu.Unlock()
+
+	user, err := userStore.GetByID(p.UserID)
+	if err != nil {
+		http.Error(w, "Error looking up user", http.StatusInternalServerError)
+		return
+	}
+	user.TOTPSecret, user.TOTPPending, user.TOTPLastStep, user.RecoveryCodes = "", "", 0, nil
+	if err := userStore.Update(user); err != nil {
+		http.Error(w, "Error updating user", http.StatusInternalServerError)
+		return
+	}
+	auditLog(r).Infof("Disabled two-factor authentication for user %s (%s)", user.ID, user.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postJSON posts body through the application router, with token as its bearer token unless
+// it is empty.
+func postJSON(target, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+// enrollTestTOTP enrolls the user holding token, with their password, in two-factor
+// authentication, returning the secret and recovery codes. The code used to confirm is the one
+// for the current time step. Enrolling revokes token.
+func enrollTestTOTP(t *testing.T, token, password string) (string, []string) {
+	t.Helper()
+	rr := postJSON("/api/me/mfa/totp", token, `{"password": "`+password+`"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected enrolment to start, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var enrolment totpEnrolmentResponse
+	if err := json.NewDecoder(rr.Body).Decode(&enrolment); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(enrolment.URI, "otpauth://totp/") || !strings.Contains(enrolment.URI, "secret="+enrolment.Secret) {
+		t.Errorf("unexpected enrolment %+v", enrolment)
+	}
+
+	rr = postJSON("/api/me/mfa/totp/confirm", token, `{"code": "`+totpCodeAt(t, enrolment.Secret, time.Now())+`"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected enrolment to be confirmed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var codes recoveryCodesResponse
+	if err := json.NewDecoder(rr.Body).Decode(&codes); err != nil {
+		t.Fatal(err)
+	}
+	return enrolment.Secret, codes.RecoveryCodes
+}
+
+// postMFALogin posts body to POST /auth/login/mfa from ip through the application router.
+func postMFALogin(body, ip string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/auth/login/mfa", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = ip + ":1234"
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+// mfaChallengeFor logs in with username and password from ip and returns the challenge's token.
+func mfaChallengeFor(t *testing.T, username, password, ip string) string {
+	t.Helper()
+	rr := postLogin(username, password, ip)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("expected a two-factor challenge, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var challenge mfaChallengeResponse
+	if err := json.NewDecoder(rr.Body).Decode(&challenge); err != nil {
+		t.Fatal(err)
+	}
+	if challenge.Error != "mfa_required" || challenge.MFAToken == "" || challenge.ExpiresIn != 300 {
+		t.Fatalf("unexpected challenge %+v", challenge)
+	}
+	return challenge.MFAToken
+}
+
+// TestMFALogin tests enrolling in two-factor authentication and logging in with TOTP and
+// recovery codes, each of which works only once.
+func TestMFALogin(t *testing.T) {
+	useRateLimits(t)
+	_, now := useLoginGuard(t, defaultLoginGuardConfig)
+	useRevocationStore(t, newMemoryRevocationStore())
+	useRefreshTokenStore(t, newMemoryRefreshTokenStore())
+	user := newTestUser(t, "alice", "alicepassword")
+	session, _ := issueTokens(user, "", tokenGrant{AMR: amrPassword})
+	token := session.AccessToken
+
+	if rr := postJSON("/api/me/mfa/totp/confirm", token, `{"code": "123456"}`); rr.Code != http.StatusConflict {
+		t.Errorf("expected confirming without enrolling to conflict, got %d", rr.Code)
+	}
+	if rr := postJSON("/api/me/mfa/totp", token, `{"password": "wrongpassword"}`); rr.Code != http.StatusForbidden {
+		t.Errorf("expected enrolling with a wrong password to be refused, got %d", rr.Code)
+	}
+	*now = now.Add(time.Minute) // Past the back-off of the wrong password.
+	secret, recoveryCodes := enrollTestTOTP(t, token, "alicepassword")
+	if len(recoveryCodes) != recoveryCodeCount {
+		t.Fatalf("expected %d recovery codes, got %v", recoveryCodeCount, recoveryCodes)
+	}
+	stored, _ := userStore.GetByID(user.ID)
+	if stored.TOTPSecret != secret || stored.TOTPPending != "" || stored.RecoveryCodes[0] == recoveryCodes[0] {
+		t.Errorf("expected the secret and hashed recovery codes to be stored, got %+v", stored)
+	}
+	// Sessions logged in with the password alone are revoked.
+	if rr := postJSON("/api/me/mfa/totp", token, `{"password": "alicepassword"}`); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected the access token to be revoked, got %d", rr.Code)
+	}
+	if rr := postRefresh(session.RefreshToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected the refresh token to be revoked, got %d", rr.Code)
+	}
+	// Tokens issued within the second of the revocation count as revoked too, so start afresh.
+	useRevocationStore(t, newMemoryRevocationStore())
+	token, _ = issueAccessToken(user, "", tokenGrant{AMR: amrMFA})
+	if rr := postJSON("/api/me/mfa/totp", token, `{"password": "alicepassword"}`); rr.Code != http.StatusConflict {
+		t.Errorf("expected enrolling again to conflict, got %d", rr.Code)
+	}
+
+	// The code used to confirm enrolment cannot be used again; the next one can.
+	used := totpCodeAt(t, secret, time.Now())
+	next := totpCodeAt(t, secret, time.Now().Add(totpPeriod))
+	steps := []struct {
+		name   string
+		fields string
+		want   int
+	}{
+		{"missing code", ``, http.StatusBadRequest},
+		{"reused code", `, "code": "` + used + `"`, http.StatusUnauthorized},
+		{"next code", `, "code": "` + next + `"`, http.StatusOK},
+		{"recovery code", `, "recovery_code": "` + strings.ToUpper(recoveryCodes[3]) + `"`, http.StatusOK},
+		{"used recovery code", `, "recovery_code": "` + recoveryCodes[3] + `"`, http.StatusUnauthorized},
+	}
+	// Each step comes from a new IP, past any back-off, so that only the code matters.
+	for i, step := range steps {
+		*now = now.Add(time.Minute)
+		ip := fmt.Sprintf("192.0.2.%d", i)
+		mfaToken := mfaChallengeFor(t, "alice", "alicepassword", ip)
+		rr := postMFALogin(`{"mfa_token": "`+mfaToken+`"`+step.fields+`}`, ip)
+		if rr.Code != step.want {
+			t.Fatalf("%s: expected %d, got %d: %s", step.name, step.want, rr.Code, rr.Body.String())
+		}
+		if rr.Code != http.StatusOK {
+			continue
+		}
+		var tokens tokenResponse
+		if err := json.NewDecoder(rr.Body).Decode(&tokens); err != nil {
+			t.Fatal(err)
+		}
+		claims, err := parseAccessToken(tokens.AccessToken)
+		if err != nil || !newPrincipal(claims).HasMFA() {
+			t.Errorf("%s: expected an access token with the mfa amr, got %v (%v)", step.name, claims["amr"], err)
+		}
+		if rr := postMFALogin(`{"mfa_token": "`+mfaToken+`", "recovery_code": "`+recoveryCodes[0]+`"}`, ip); rr.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected an answered challenge not to be reusable, got %d", step.name, rr.Code)
+		}
+
+		// Refreshing keeps the second factor.
+		rr = postRefresh(tokens.RefreshToken)
+		if err := json.NewDecoder(rr.Body).Decode(&tokens); err != nil {
+			t.Fatal(err)
+		}
+		if claims, err := parseAccessToken(tokens.AccessToken); err != nil || !newPrincipal(claims).HasMFA() {
+			t.Errorf("%s: expected a refreshed access token with the mfa amr, got %v (%v)", step.name, claims["amr"], err)
+		}
+	}
+	if stored, _ := userStore.GetByID(user.ID); len(stored.RecoveryCodes) != recoveryCodeCount-1 {
+		t.Errorf("expected the used recovery code to be removed, got %d left", len(stored.RecoveryCodes))
+	}
+
+	if rr := postMFALogin(`{"mfa_token": "unknown", "code": "123456"}`, "192.0.2.100"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected an unknown MFA token to be rejected, got %d", rr.Code)
+	}
+	*now = now.Add(time.Minute)
+	req := httptest.NewRequest("GET", "/login?username=alice&password=alicepassword", nil)
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "mfa_token") {
+		t.Errorf("expected the legacy login to challenge for a second factor too, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+// TestMFAManagement tests that replacing recovery codes and disabling two-factor
+// authentication need a token obtained with a second factor.
+func TestMFAManagement(t *testing.T) {
+	useRateLimits(t)
+	useLoginGuard(t, defaultLoginGuardConfig)
+	useRevocationStore(t, newMemoryRevocationStore())
+	user := newTestUser(t, "alice", "alicepassword")
+	enrolToken, _ := issueAccessToken(user, "", tokenGrant{AMR: amrPassword})
+	_, original := enrollTestTOTP(t, enrolToken, "alicepassword")
+
+	// Enrolling revoked the tokens issued within the same second, so start afresh.
+	useRevocationStore(t, newMemoryRevocationStore())
+	passwordToken, _ := issueAccessToken(user, "", tokenGrant{AMR: amrPassword})
+	mfaToken, _ := issueAccessToken(user, "", tokenGrant{AMR: amrMFA})
+
+	rr := postJSON("/api/me/mfa/recovery-codes", passwordToken, "")
+	if rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Header().Get("WWW-Authenticate"), "insufficient_user_authentication") {
+		t.Errorf("expected a password-only token to be refused, got %d %q", rr.Code, rr.Header().Get("WWW-Authenticate"))
+	}
+	rr = postJSON("/api/me/mfa/recovery-codes", mfaToken, "")
+	var codes recoveryCodesResponse
+	if err := json.NewDecoder(rr.Body).Decode(&codes); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("expected new recovery codes, got %d: %v", rr.Code, err)
+	}
+	if stored, _ := userStore.GetByID(user.ID); containsString(stored.RecoveryCodes, hashRecoveryCode(original[0])) || !containsString(stored.RecoveryCodes, hashRecoveryCode(codes.RecoveryCodes[0])) {
+		t.Errorf("expected the recovery codes to be replaced")
+	}
+
+	if rr := authorizedRequest("DELETE", "/api/me/mfa/totp", passwordToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected a password-only token not to disable two-factor authentication, got %d", rr.Code)
+	}
+	if rr := authorizedRequest("DELETE", "/api/me/mfa/totp", mfaToken); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected two-factor authentication to be disabled, got %d", rr.Code)
+	}
+	if stored, _ := userStore.GetByID(user.ID); stored.MFAEnabled() || len(stored.RecoveryCodes) != 0 {
+		t.Errorf("expected the secret and recovery codes to be discarded, got %+v", stored)
+	}
+}
+
+// TestMFALockout tests that wrong codes count towards the user's lockout, and that a correct
+// password alone does not clear them.
+func TestMFALockout(t *testing.T) {
+	useRateLimits(t)
+	_, now := useLoginGuard(t, defaultLoginGuardConfig)
+	useRevocationStore(t, newMemoryRevocationStore())
+	user := newTestUser(t, "alice", "alicepassword")
+	token, _ := issueAccessToken(user, "", tokenGrant{AMR: amrPassword})
+	secret, _ := enrollTestTOTP(t, token, "alicepassword")
+
+	var mfaChallenge string
+	for i := 0; i < defaultLoginGuardConfig.maxUserFailures; i++ {
+		*now = now.Add(time.Minute) // Past any back-off.
+		ip := fmt.Sprintf("192.0.2.%d", i)
+		mfaChallenge = mfaChallengeFor(t, "alice", "alicepassword", ip)
+		if rr := postMFALogin(`{"mfa_token": "`+mfaChallenge+`", "code": "000000"}`, ip); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected a wrong code to be rejected, got %d", i, rr.Code)
+		}
+	}
+	if rr := postLogin("alice", "alicepassword", "192.0.2.100"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the account to be locked out after repeated wrong codes, got %d", rr.Code)
+	}
+	if rr := postMFALogin(`{"mfa_token": "`+mfaChallenge+`", "code": "`+totpCodeAt(t, secret, time.Now().Add(totpPeriod))+`"}`, "192.0.2.100"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the right code to be refused during the lockout, got %d", rr.Code)
+	}
+}
+
+// TestRequireMFA tests that admin routes, and revoking other users' API keys, can require a
+// second factor.
+func TestRequireMFA(t *testing.T) {
+	useRateLimits(t)
+	useRevocationStore(t, newMemoryRevocationStore())
+	useAPIKeyStore(t, newMemoryAPIKeyStore())
+	store := newMemoryUserStore()
+	useUserStore(t, store)
+	originalMFA := adminMFARequired
+	t.Cleanup(func() { adminMFARequired = originalMFA })
+	admin, err := registerUser(store, "admin", "adminpassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	useAdminUserIDs(t, admin.ID)
+	passwordToken, _ := issueAccessToken(admin, "", tokenGrant{AMR: amrPassword})
+	mfaToken, _ := issueAccessToken(admin, "", tokenGrant{AMR: amrMFA})
+	target := "/api/admin/users/" + admin.ID + "/unlock"
+	reader, err := registerUser(store, "reader", "readerpassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		required bool
+		token    string
+		want     int
+		wantKey  int // Status of revoking another user's API key.
+	}{
+		{"not required", false, passwordToken, http.StatusNoContent, http.StatusNoContent},
+		{"password only", true, passwordToken, http.StatusUnauthorized, http.StatusNotFound},
+		{"second factor", true, mfaToken, http.StatusNoContent, http.StatusNoContent},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			adminMFARequired = tc.required
+			rr := authorizedRequest("POST", target, tc.token)
+			if rr.Code != tc.want {
+				t.Fatalf("expected %d, got %d: %s", tc.want, rr.Code, rr.Body.String())
+			}
+			if rr.Code == http.StatusUnauthorized && !strings.Contains(rr.Body.String(), "insufficient_user_authentication") {
+				t.Errorf("expected an insufficient_user_authentication error, got %s", rr.Body.String())
+			}
+
+			_, key, err := createAPIKey(reader, grantedScopes(reader), "reader's key", []string{scopeBooksRead}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rr := authorizedRequest("DELETE", "/api/keys/"+key.ID, tc.token); rr.Code != tc.wantKey {
+				t.Errorf("expected revoking another user's API key to give %d, got %d", tc.wantKey, rr.Code)
+			}
+		})
+	}
+}
+
+// TestMFAChallengeExpiry tests that challenges expire.
+func TestMFAChallengeExpiry(t *testing.T) {
+	s := newMFAChallengeStore()
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	token := s.create("u1")
+	if userID, ok := s.lookup(token); !ok || userID != "u1" {
+		t.Fatalf("expected the challenge for u1, got %q, %v", userID, ok)
+	}
+	now = now.Add(mfaChallengeTTL + time.Second)
+	if _, ok := s.lookup(token); ok {
+		t.Error("expected the challenge to have expired")
+	}
+	s.create("u2")
+	if len(s.challenges) != 1 {
+		t.Errorf("expected expired challenges to be dropped, got %d", len(s.challenges))
+	}
+}
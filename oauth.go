@@ -0,0 +1,680 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// How OAuth clients authenticate at the token endpoint (RFC 7591 section 2).
+const (
+	clientAuthBasic = "client_secret_basic"
+	clientAuthPost  = "client_secret_post"
+	clientAuthNone  = "none" // Public clients, such as single-page and native apps, which rely on PKCE alone.
+)
+
+// authorizationCodeTTL is how long a client has to exchange an authorization code for tokens.
+const authorizationCodeTTL = time.Minute
+
+var (
+	// ErrOAuthClientNotFound is returned by an OAuthClientStore when no client matches.
+	ErrOAuthClientNotFound = errors.New("OAuth client not found")
+	// ErrInvalidClient is returned by authenticateClient for an unknown client or wrong secret.
+	ErrInvalidClient = errors.New("invalid client")
+	// ErrInvalidAuthorizationCode is returned for an unknown, expired, reused or mismatched
+	// authorization code, or a wrong PKCE code verifier.
+	ErrInvalidAuthorizationCode = errors.New("invalid authorization code")
+	// ErrAuthorizationCodeReused is returned by authorizationCodeStore.redeem for a code that
+	// was already exchanged.
+	ErrAuthorizationCodeReused = errors.New("authorization code reused")
+)
+
+// OAuthClient is an application registered to let users log in with go-books through the
+// authorization code flow.
+type OAuthClient struct {
+	ID           string
+	SecretHash   string // SHA-256 of the client secret; empty for public clients.
+	Name         string
+	RedirectURIs []string
+	AuthMethod   string // How the client authenticates at the token endpoint.
+	CreatedAt    time.Time
+}
+
+// OAuthClientStore persists registered OAuth clients. Implementations must be safe for
+// concurrent use and return copies.
+type OAuthClientStore interface {
+	// Create stores a new client.
+	Create(c *OAuthClient) error
+	// Get returns the client with the given ID.
+	Get(id string) (*OAuthClient, error)
+}
+
+// memoryOAuthClientStore is an OAuthClientStore that keeps clients in memory.
+type memoryOAuthClientStore struct {
+	mu      sync.Mutex
+	clients map[string]OAuthClient // By ID.
+}
+
+// newMemoryOAuthClientStore returns an empty in-memory OAuth client store.
+func newMemoryOAuthClientStore() *memoryOAuthClientStore {
+	return &memoryOAuthClientStore{clients: make(map[string]OAuthClient)}
+}
+
+// cloneOAuthClient returns a copy of c that shares no slices with it.
+func cloneOAuthClient(c OAuthClient) *OAuthClient {
+	c.RedirectURIs = append([]string(nil), c.RedirectURIs...)
+	return &c
+}
+
+func (s *memoryOAuthClientStore) Create(c *OAuthClient) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.clients[c.ID]; ok {
+		return fmt.Errorf("duplicate OAuth client ID %q", c.ID)
+	}
+	s.clients[c.ID] = *cloneOAuthClient(*c)
+	return nil
+}
+
+func (s *memoryOAuthClientStore) Get(id string) (*OAuthClient, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.clients[id]
+	if !ok {
+		return nil, ErrOAuthClientNotFound
+	}
+	return cloneOAuthClient(c), nil
+}
+
+// oauthClients holds the registered OAuth clients.
+var oauthClients OAuthClientStore = newMemoryOAuthClientStore()
+
+// validRedirectURI reports whether uri may be registered as a redirect URI: an absolute URL
+// without a fragment, using HTTPS, or HTTP on a loopback address for native apps (RFC 8252).
+func validRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		ip := net.ParseIP(u.Hostname())
+		return u.Hostname() == "localhost" || (ip != nil && ip.IsLoopback())
+	}
+	return false
+}
+
+// createOAuthClient registers a client. Confidential clients get a secret, which is returned
+// and only its hash stored; public clients, registered with clientAuthNone, do not.
+func createOAuthClient(name string, redirectURIs []string, authMethod string) (string, *OAuthClient, error) {
+	if authMethod == "" {
+		authMethod = clientAuthBasic
+	}
+	switch {
+	case strings.TrimSpace(name) == "":
+		return "", nil, errors.New("client_name is required")
+	case len(redirectURIs) == 0:
+		return "", nil, errors.New("at least one redirect URI is required")
+	case authMethod != clientAuthBasic && authMethod != clientAuthPost && authMethod != clientAuthNone:
+		return "", nil, fmt.Errorf("unsupported token_endpoint_auth_method %q", authMethod)
+	}
+	for _, uri := range redirectURIs {
+		if !validRedirectURI(uri) {
+			return "", nil, fmt.Errorf("invalid redirect URI %q", uri)
+		}
+	}
+
+	c := &OAuthClient{
+		ID:           newID(),
+		Name:         strings.TrimSpace(name),
+		RedirectURIs: redirectURIs,
+		AuthMethod:   authMethod,
+		CreatedAt:    time.Now(),
+	}
+	secret := ""
+	if authMethod != clientAuthNone {
+		secret = newOpaqueToken()
+		c.SecretHash = hashToken(secret)
+	}
+	if err := oauthClients.Create(c); err != nil {
+		return "", nil, err
+	}
+	return secret, c, nil
+}
+
+// clientRegistrationRequest is the body of POST /api/admin/oauth/clients, a subset of the
+// client metadata of RFC 7591.
+type clientRegistrationRequest struct {
+	ClientName              string   `json:"client_name"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+}
+
+// clientRegistrationResponse describes a registered client (RFC 7591 section 3.2.1). The
+// secret is only ever shown here.
+type clientRegistrationResponse struct {
+	ClientID                string   `json:"client_id"`
+	ClientSecret            string   `json:"client_secret,omitempty"`
+	ClientIDIssuedAt        int64    `json:"client_id_issued_at"`
+	ClientName              string   `json:"client_name"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+	GrantTypes              []string `json:"grant_types"`
+	ResponseTypes           []string `json:"response_types"`
+}
+
+// registerClientHandler registers an OAuth client from RFC 7591 client metadata.
+func registerClientHandler(w http.ResponseWriter, r *http.Request) {
+	var req clientRegistrationRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxAuthBodyBytes)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONStatus(w, http.StatusBadRequest, oauthError{Error: "invalid_client_metadata", ErrorDescription: err.Error()})
+		return
+	}
+	secret, c, err := createOAuthClient(req.ClientName, req.RedirectURIs, req.TokenEndpointAuthMethod)
+	if err != nil {
+		code := "invalid_client_metadata"
+		if strings.Contains(err.Error(), "redirect URI") {
+			code = "invalid_redirect_uri"
+		}
+		writeJSONStatus(w, http.StatusBadRequest, oauthError{Error: code, ErrorDescription: err.Error()})
+		return
+	}
+	auditLog(r).Infof("Registered OAuth client %s (%s) for %v", c.ID, c.Name, c.RedirectURIs)
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSONStatus(w, http.StatusCreated, clientRegistrationResponse{
+		ClientID:                c.ID,
+		ClientSecret:            secret,
+		ClientIDIssuedAt:        c.CreatedAt.Unix(),
+		ClientName:              c.Name,
+		RedirectURIs:            c.RedirectURIs,
+		TokenEndpointAuthMethod: c.AuthMethod,
+		GrantTypes:              []string{"authorization_code", "refresh_token"},
+		ResponseTypes:           []string{"code"},
+	})
+}
+
+// authorizationCode is an authorization granted to a client, waiting to be exchanged for tokens.
+type authorizationCode struct {
+	clientID      string
+	userID        string
+	redirectURI   string
+	scopes        []string
+	nonce         string // Echoed in the ID token (OpenID Connect Core section 3.1.2.1).
+	codeChallenge string // The S256 PKCE code challenge (RFC 7636).
+	amr           []string
+	authTime      time.Time
+	expiresAt     time.Time
+	familyID      string // The refresh token family of the tokens issued for the code.
+	used          bool
+}
+
+// authorizationCodeStore keeps issued authorization codes until they expire.
+type authorizationCodeStore struct {
+	mu    sync.Mutex
+	codes map[string]authorizationCode // By hash of the code.
+	now   func() time.Time
+}
+
+// newAuthorizationCodeStore returns a store with no codes.
+func newAuthorizationCodeStore() *authorizationCodeStore {
+	return &authorizationCodeStore{codes: make(map[string]authorizationCode), now: time.Now}
+}
+
+// authorizationCodes holds the issued authorization codes.
+var authorizationCodes = newAuthorizationCodeStore()
+
+// create stores c, valid for authorizationCodeTTL, and returns the code, dropping expired codes.
+func (s *authorizationCodeStore) create(c authorizationCode) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for hash, old := range s.codes {
+		if now.After(old.expiresAt) {
+			delete(s.codes, hash)
+		}
+	}
+	code := newOpaqueToken()
+	c.expiresAt = now.Add(authorizationCodeTTL)
+	c.familyID = newID()
+	s.codes[hashToken(code)] = c
+	return code
+}
+
+// redeem marks a code as used and returns it. It returns ErrInvalidAuthorizationCode for an
+// unknown or expired code, and the code together with ErrAuthorizationCodeReused for one that
+// was already redeemed.
+func (s *authorizationCodeStore) redeem(code string) (authorizationCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.codes[hashToken(code)]
+	switch {
+	case !ok || s.now().After(c.expiresAt):
+		return authorizationCode{}, ErrInvalidAuthorizationCode
+	case c.used:
+		return c, ErrAuthorizationCodeReused
+	}
+	c.used = true
+	s.codes[hashToken(code)] = c
+	return c, nil
+}
+
+// validCodeChallenge matches an S256 code challenge: the unpadded base64url of a SHA-256.
+var validCodeChallenge = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+
+// validCodeVerifier matches a PKCE code verifier (RFC 7636 section 4.1).
+var validCodeVerifier = regexp.MustCompile(`^[A-Za-z0-9._~-]{43,128}$`)
+
+// verifyCodeChallenge reports whether verifier is the one an S256 code challenge was made from.
+func verifyCodeChallenge(challenge, verifier string) bool {
+	if !validCodeVerifier.MatchString(verifier) {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(challenge)) == 1
+}
+
+// authorizeParams are the parameters of an authorization request that the login form passes on.
+var authorizeParams = []string{"response_type", "client_id", "redirect_uri", "scope", "state", "nonce", "code_challenge", "code_challenge_method"}
+
+// authorizeRequest is a validated authorization request.
+type authorizeRequest struct {
+	client        *OAuthClient
+	redirectURI   string
+	scopes        []string
+	state         string
+	nonce         string
+	codeChallenge string
+}
+
+// authorizeError is an error in an authorization request that is reported to the client by
+// redirecting back to it (RFC 6749 section 4.1.2.1).
+type authorizeError struct {
+	code        string
+	description string
+}
+
+func (e *authorizeError) Error() string {
+	return e.code + ": " + e.description
+}
+
+// parseAuthorizeRequest validates the parameters of an authorization request. If the client or
+// redirect URI is invalid it returns a nil request and an error to show the user, since the
+// request cannot safely be redirected back. Other errors are *authorizeError, returned along
+// with the request to redirect them to.
+func parseAuthorizeRequest(params url.Values) (*authorizeRequest, error) {
+	client, err := oauthClients.Get(params.Get("client_id"))
+	if errors.Is(err, ErrOAuthClientNotFound) {
+		return nil, errors.New("unknown client_id")
+	}
+	if err != nil {
+		return nil, err
+	}
+	redirectURI := params.Get("redirect_uri")
+	if !containsString(client.RedirectURIs, redirectURI) {
+		return nil, errors.New("redirect_uri is not registered for the client")
+	}
+
+	req := &authorizeRequest{
+		client:        client,
+		redirectURI:   redirectURI,
+		scopes:        strings.Fields(params.Get("scope")),
+		state:         params.Get("state"),
+		nonce:         params.Get("nonce"),
+		codeChallenge: params.Get("code_challenge"),
+	}
+	switch {
+	case params.Get("response_type") != "code":
+		return req, &authorizeError{"unsupported_response_type", "response_type must be code"}
+	case !validCodeChallenge.MatchString(req.codeChallenge) || params.Get("code_challenge_method") != "S256":
+		return req, &authorizeError{"invalid_request", "a PKCE code_challenge with code_challenge_method S256 is required"}
+	case params.Get("prompt") == "none":
+		return req, &authorizeError{"login_required", "the user must log in"}
+	}
+	for _, scope := range req.scopes {
+		if !isOIDCScope(scope) && !isKnownScope(scope) {
+			return req, &authorizeError{"invalid_scope", fmt.Sprintf("unknown scope %q", scope)}
+		}
+		if isFirstPartyScope(scope) {
+			return req, &authorizeError{"invalid_scope", fmt.Sprintf("scope %q is not available to OAuth clients", scope)}
+		}
+	}
+	return req, nil
+}
+
+// redirect sends the user back to the client with params and the request's state.
+func (req *authorizeRequest) redirect(w http.ResponseWriter, r *http.Request, params url.Values) {
+	u, _ := url.Parse(req.redirectURI) // Validated when the client was registered.
+	q := u.Query()
+	for name := range params {
+		q.Set(name, params.Get(name))
+	}
+	if req.state != "" {
+		q.Set("state", req.state)
+	}
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
+
+// authorizeForm is the data of authorizeTemplate.
+type authorizeForm struct {
+	ClientName string
+	Scopes     []string
+	Params     map[string]string
+	Username   string
+	MFAToken   string // Set once the password is right, to ask for the second factor.
+	Error      string
+}
+
+// authorizeTemplate is the login form of the authorization endpoint.
+var authorizeTemplate = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Log in to {{.ClientName}}</title></head>
+<body>
+<h1>Log in with go-books</h1>
+<p>{{.ClientName}} wants to access your go-books account{{if .Scopes}} with the scopes:{{range .Scopes}} <code>{{.}}</code>{{end}}{{end}}.</p>
+{{if .Error}}<p role="alert">{{.Error}}</p>
+{{end}}<form method="post" action="/oauth/authorize">
+{{range $name, $value := .Params}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+{{end}}{{if .MFAToken}}<input type="hidden" name="mfa_token" value="{{.MFAToken}}">
+<label>Two-factor authentication or recovery code <input name="code" autocomplete="one-time-code" required autofocus></label>
+{{else}}<label>Username <input name="username" value="{{.Username}}" autocomplete="username" required></label>
+<label>Password <input type="password" name="password" autocomplete="current-password" required></label>
+{{end}}<button type="submit">Log in</button>
+</form>
+</body>
+</html>
+`))
+
+// writeAuthorizeForm renders the login form for req with status.
+func writeAuthorizeForm(w http.ResponseWriter, status int, req *authorizeRequest, params url.Values, form authorizeForm) {
+	form.ClientName = req.client.Name
+	form.Scopes = req.scopes
+	form.Params = make(map[string]string)
+	for _, name := range authorizeParams {
+		if v := params.Get(name); v != "" {
+			form.Params[name] = v
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+	w.WriteHeader(status)
+	if err := authorizeTemplate.Execute(w, form); err != nil {
+		logrus.Errorf("Error rendering the authorization form: %v", err)
+	}
+}
+
+// authorizeHandler is the authorization endpoint of the authorization code flow with PKCE. A GET
+// shows a login form for the request in its query, which posts back here. Once the user has
+// given their password, and their second factor if they have one, they are redirected back to
+// the client with an authorization code to exchange at POST /oauth/token. Clients are trusted
+// first-party applications, so there is no separate consent step.
+func authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	if r.Method == http.MethodPost {
+		r.Body = http.MaxBytesReader(w, r.Body, maxAuthBodyBytes)
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Invalid form body", http.StatusBadRequest)
+			return
+		}
+		params = r.PostForm
+	}
+
+	req, err := parseAuthorizeRequest(params)
+	if req == nil {
+		http.Error(w, fmt.Sprintf("Invalid authorization request: %v", err), http.StatusBadRequest)
+		return
+	}
+	var authErr *authorizeError
+	if errors.As(err, &authErr) {
+		req.redirect(w, r, url.Values{"error": {authErr.code}, "error_description": {authErr.description}})
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeAuthorizeForm(w, http.StatusOK, req, params, authorizeForm{})
+		return
+	}
+
+	var user *User
+	amr := amrPassword
+	if mfaToken := params.Get("mfa_token"); mfaToken != "" {
+		code, recoveryCode := params.Get("code"), ""
+		if len(code) != totpDigits {
+			code, recoveryCode = "", code
+		}
+		user, err = loginSecondFactor(r, mfaToken, code, recoveryCode)
+		amr = amrMFA
+	} else {
+		user, err = login(r, params.Get("username"), params.Get("password"))
+	}
+	var throttled *throttledError
+	switch {
+	case errors.As(err, &throttled):
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(throttled.retryAfter)))
+		writeAuthorizeForm(w, http.StatusTooManyRequests, req, params, authorizeForm{Username: params.Get("username"), Error: "Too many failed login attempts. Try again later."})
+		return
+	case errors.Is(err, ErrInvalidCredentials):
+		writeAuthorizeForm(w, http.StatusUnauthorized, req, params, authorizeForm{Username: params.Get("username"), Error: "Invalid username or password."})
+		return
+	case errors.Is(err, ErrInvalidMFAChallenge):
+		writeAuthorizeForm(w, http.StatusUnauthorized, req, params, authorizeForm{Error: "The login took too long. Log in again."})
+		return
+	case errors.Is(err, ErrInvalidSecondFactor):
+		writeAuthorizeForm(w, http.StatusUnauthorized, req, params, authorizeForm{MFAToken: params.Get("mfa_token"), Error: "Invalid code."})
+		return
+	case err != nil:
+		http.Error(w, "Error checking credentials", http.StatusInternalServerError)
+		return
+	}
+	if params.Get("mfa_token") == "" && user.MFAEnabled() {
+		writeAuthorizeForm(w, http.StatusOK, req, params, authorizeForm{MFAToken: mfaChallenges.create(user.ID)})
+		return
+	}
+
+	code := authorizationCodes.create(authorizationCode{
+		clientID:      req.client.ID,
+		userID:        user.ID,
+		redirectURI:   req.redirectURI,
+		scopes:        req.scopes,
+		nonce:         req.nonce,
+		codeChallenge: req.codeChallenge,
+		amr:           amr,
+		authTime:      time.Now(),
+	})
+	auditLog(r).Infof("User %s (%s) authorized OAuth client %s (%s)", user.ID, user.Username, req.client.ID, req.client.Name)
+	req.redirect(w, r, url.Values{"code": {code}})
+}
+
+// authenticateClient returns the client authenticating a token request with HTTP Basic
+// authentication or client_id and client_secret in body, whichever it registered. Public
+// clients send just their client_id.
+func authenticateClient(r *http.Request, body map[string]string) (*OAuthClient, error) {
+	id, secret, basic := r.BasicAuth()
+	if basic {
+		// The credentials are form-encoded before being put in the header (RFC 6749 section 2.3.1).
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+		if body["client_id"] != "" && body["client_id"] != id {
+			return nil, ErrInvalidClient
+		}
+	} else {
+		id, secret = body["client_id"], body["client_secret"]
+	}
+
+	c, err := oauthClients.Get(id)
+	if errors.Is(err, ErrOAuthClientNotFound) {
+		return nil, ErrInvalidClient
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch c.AuthMethod {
+	case clientAuthNone:
+		if basic || secret != "" {
+			return nil, ErrInvalidClient
+		}
+		return c, nil
+	case clientAuthBasic:
+		if !basic {
+			return nil, ErrInvalidClient
+		}
+	case clientAuthPost:
+		if basic {
+			return nil, ErrInvalidClient
+		}
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(c.SecretHash)) != 1 {
+		return nil, ErrInvalidClient
+	}
+	return c, nil
+}
+
+// exchangeAuthorizationCode issues tokens to client for an authorization code, which must have
+// been issued to it for redirectURI, with the PKCE verifier of its code challenge. An ID token
+// is included if the openid scope was granted. Exchanging a code twice means it has leaked, so
+// the access and refresh tokens issued for it are revoked.
+func exchangeAuthorizationCode(client *OAuthClient, code, redirectURI, verifier string) (tokenResponse, error) {
+	c, err := authorizationCodes.redeem(code)
+	if errors.Is(err, ErrAuthorizationCodeReused) {
+		logrus.Warnf("Authorization code reuse detected for client %s; revoking token family %s", c.clientID, c.familyID)
+		if err := revokeSession(c.familyID); err != nil {
+			return tokenResponse{}, err
+		}
+		return tokenResponse{}, ErrInvalidAuthorizationCode
+	}
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	if c.clientID != client.ID || c.redirectURI != redirectURI || !verifyCodeChallenge(c.codeChallenge, verifier) {
+		return tokenResponse{}, ErrInvalidAuthorizationCode
+	}
+
+	user, err := userStore.GetByID(c.userID)
+	if errors.Is(err, ErrUserNotFound) {
+		return tokenResponse{}, ErrInvalidAuthorizationCode
+	}
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	resp, err := issueTokens(user, c.familyID, tokenGrant{AMR: c.amr, ClientID: client.ID, Scopes: c.scopes})
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	if containsString(c.scopes, scopeOpenID) {
+		if resp.IDToken, err = issueIDToken(user, client.ID, c.nonce, c.authTime, c.amr, c.scopes); err != nil {
+			return tokenResponse{}, err
+		}
+	}
+	return resp, nil
+}
+
+// tokenRequest is a token endpoint request read by authenticateTokenRequest.
+type tokenRequest struct {
+	body      map[string]string
+	bodyErr   error
+	client    *OAuthClient // Nil unless the client authenticated.
+	clientErr error
+}
+
+// tokenRequestContextKey is the request context key of the tokenRequest.
+type tokenRequestContextKey struct{}
+
+// readTokenRequest reads the body of a token endpoint request and authenticates its client.
+func readTokenRequest(w http.ResponseWriter, r *http.Request) *tokenRequest {
+	req := &tokenRequest{}
+	if req.body, req.bodyErr = readAuthBody(w, r); req.bodyErr == nil {
+		req.client, req.clientErr = authenticateClient(r, req.body)
+	}
+	return req
+}
+
+// authenticateTokenRequest is middleware that reads a token endpoint request and authenticates
+// its client ahead of the handler, so that the rate limit policy between them can key on the
+// client. Requests whose client did not authenticate are passed on for the handler to reject.
+func authenticateTokenRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), tokenRequestContextKey{}, readTokenRequest(w, r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// tokenRequestClient returns the client authenticateTokenRequest authenticated, if any.
+func tokenRequestClient(ctx context.Context) *OAuthClient {
+	if req, ok := ctx.Value(tokenRequestContextKey{}).(*tokenRequest); ok {
+		return req.client
+	}
+	return nil
+}
+
+// oauthTokenHandler is the token endpoint for OAuth clients. It exchanges authorization codes
+// and refresh tokens issued to the authenticated client for new tokens.
+func oauthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	req, ok := r.Context().Value(tokenRequestContextKey{}).(*tokenRequest)
+	if !ok {
+		req = readTokenRequest(w, r)
+	}
+	if req.bodyErr != nil {
+		writeJSONStatus(w, http.StatusBadRequest, oauthError{Error: "invalid_request", ErrorDescription: req.bodyErr.Error()})
+		return
+	}
+	if errors.Is(req.clientErr, ErrInvalidClient) {
+		if _, _, basic := r.BasicAuth(); basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="go-books"`)
+		}
+		writeJSONStatus(w, http.StatusUnauthorized, oauthError{Error: "invalid_client", ErrorDescription: "Client authentication failed"})
+		return
+	}
+	if req.clientErr != nil {
+		writeJSONStatus(w, http.StatusInternalServerError, oauthError{Error: "server_error"})
+		return
+	}
+	body, client := req.body, req.client
+
+	var resp tokenResponse
+	var err error
+	switch body["grant_type"] {
+	case "authorization_code":
+		resp, err = exchangeAuthorizationCode(client, body["code"], body["redirect_uri"], body["code_verifier"])
+	case "refresh_token":
+		resp, err = rotateRefreshToken(body["refresh_token"], client.ID)
+	default:
+		writeJSONStatus(w, http.StatusBadRequest, oauthError{Error: "unsupported_grant_type"})
+		return
+	}
+	if errors.Is(err, ErrInvalidAuthorizationCode) || errors.Is(err, ErrInvalidRefreshToken) {
+		writeJSONStatus(w, http.StatusBadRequest, oauthError{Error: "invalid_grant", ErrorDescription: err.Error()})
+		return
+	}
+	if err != nil {
+		writeJSONStatus(w, http.StatusInternalServerError, oauthError{Error: "server_error"})
+		return
+	}
+	writeJSON(w, resp)
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// testRedirectURI is the redirect URI of test clients.
+const testRedirectURI = "https://app.example.com/callback"
+
+// useOAuthClientStore swaps oauthClients for the duration of a test.
+func useOAuthClientStore(t *testing.T, store OAuthClientStore) {
+	original := oauthClients
+	oauthClients = store
+	t.Cleanup(func() { oauthClients = original })
+}
+
+// newTestClient registers a client with the given token endpoint auth method in a fresh store
+// and returns it with its secret.
+func newTestClient(t *testing.T, authMethod string) (*OAuthClient, string) {
+	t.Helper()
+	useOAuthClientStore(t, newMemoryOAuthClientStore())
+	secret, c, err := createOAuthClient("Reading list", []string{testRedirectURI}, authMethod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, secret
+}
+
+// newPKCE returns a PKCE code verifier and its S256 code challenge.
+func newPKCE() (string, string) {
+	verifier := newOpaqueToken()
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// authorizeQuery returns the parameters of a valid authorization request by client.
+func authorizeQuery(client *OAuthClient, challenge, scope string) url.Values {
+	return url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ID},
+		"redirect_uri":          {testRedirectURI},
+		"scope":                 {scope},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6_WzA2Mj"},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+}
+
+// postAuthorize posts the login form of the authorization endpoint through the application router.
+func postAuthorize(form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/oauth/authorize", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+// redirectParams checks that rr redirects to the test client and returns the parameters.
+func redirectParams(t *testing.T, rr *httptest.ResponseRecorder) url.Values {
+	t.Helper()
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("expected a redirect to the client, got %d: %s", rr.Code, rr.Body.String())
+	}
+	u, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil || !strings.HasPrefix(u.String(), testRedirectURI+"?") {
+		t.Fatalf("expected a redirect to %s, got %q", testRedirectURI, rr.Header().Get("Location"))
+	}
+	return u.Query()
+}
+
+// postToken posts form to the token endpoint from ip, authenticating as clientID with secret
+// over HTTP Basic authentication unless secret is empty.
+func postToken(clientID, secret string, form url.Values, ip string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = ip + ":1234"
+	if secret != "" {
+		req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(secret))
+	}
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+// TestAuthorizationCodeFlow tests logging in to a client with the authorization code flow and
+// PKCE, and using the tokens it gets.
+func TestAuthorizationCodeFlow(t *testing.T) {
+	useRateLimits(t)
+	_, now := useLoginGuard(t, defaultLoginGuardConfig)
+	useRevocationStore(t, newMemoryRevocationStore())
+	useRefreshTokenStore(t, newMemoryRefreshTokenStore())
+	useProvider(t, &fakeProvider{search: func(q SearchQuery) (*SearchResult, error) {
+		return &SearchResult{Docs: []Book{{Title: "Test Book"}}}, nil
+	}})
+	user := newTestUser(t, "alice", "alicepassword")
+	client, secret := newTestClient(t, clientAuthBasic)
+	verifier, challenge := newPKCE()
+	params := authorizeQuery(client, challenge, "openid profile books:read cache:read")
+	params.Set("state", `"><script>alert(1)</script>`)
+
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, httptest.NewRequest("GET", "/oauth/authorize?"+params.Encode(), nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "Reading list") {
+		t.Fatalf("expected the login form, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if strings.Contains(rr.Body.String(), "<script>") || rr.Header().Get("X-Frame-Options") != "DENY" {
+		t.Errorf("expected the login form to escape parameters and refuse framing")
+	}
+
+	form := url.Values{"username": {"alice"}, "password": {"wrong-password"}}
+	for name := range params {
+		form.Set(name, params.Get(name))
+	}
+	if rr := postAuthorize(form); rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Body.String(), "Invalid username or password") {
+		t.Errorf("expected a wrong password to show the form again, got %d", rr.Code)
+	}
+	*now = now.Add(time.Minute)
+	form.Set("password", "alicepassword")
+	redirect := redirectParams(t, postAuthorize(form))
+	if redirect.Get("state") != params.Get("state") || redirect.Get("code") == "" {
+		t.Fatalf("expected a code and the state, got %v", redirect)
+	}
+
+	exchange := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {redirect.Get("code")},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {verifier},
+	}
+	rr = postToken(client.ID, secret, exchange, "192.0.2.10")
+	if rr.Code != http.StatusOK || rr.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("expected tokens, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var tokens tokenResponse
+	if err := json.NewDecoder(rr.Body).Decode(&tokens); err != nil {
+		t.Fatal(err)
+	}
+	// Readers are not granted cache:read, whatever the client asks for.
+	if tokens.Scope != "books:read openid profile" || tokens.IDToken == "" || tokens.RefreshToken == "" {
+		t.Fatalf("unexpected token response %+v", tokens)
+	}
+
+	idToken, err := signingKeys.parse(tokens.IDToken, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := idToken.Claims.(jwt.MapClaims)
+	if claims["aud"] != client.ID || claims["sub"] != user.ID || claims["nonce"] != "n-0S6_WzA2Mj" || claims["preferred_username"] != "alice" || claims["iss"] != tokenSettings.issuer {
+		t.Errorf("unexpected ID token claims %v", claims)
+	}
+	if _, err := parseAccessToken(tokens.IDToken); err == nil {
+		t.Error("expected the ID token not to be accepted as an access token")
+	}
+
+	accessClaims, err := parseAccessToken(tokens.AccessToken)
+	if err != nil || accessClaims["client_id"] != client.ID {
+		t.Fatalf("expected an access token for the client, got %v (%v)", accessClaims, err)
+	}
+	if rr := authorizedRequest("GET", "/api/search?q=go", tokens.AccessToken); rr.Code != http.StatusOK {
+		t.Errorf("expected the access token to reach the book API, got %d", rr.Code)
+	}
+	if rr := authorizedRequest("GET", "/api/cache/stats", tokens.AccessToken); rr.Code != http.StatusForbidden {
+		t.Errorf("expected the access token to be limited to the granted scopes, got %d", rr.Code)
+	}
+	if rr := authorizedRequest("GET", "/userinfo", tokens.AccessToken); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"preferred_username":"alice"`) {
+		t.Errorf("expected the user's claims from /userinfo, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// Refreshing at the token endpoint keeps the granted scopes.
+	rr = postToken(client.ID, secret, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {tokens.RefreshToken}}, "192.0.2.11")
+	var refreshed tokenResponse
+	if err := json.NewDecoder(rr.Body).Decode(&refreshed); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("expected the refresh token to be rotated, got %d: %v", rr.Code, err)
+	}
+	if refreshed.Scope != tokens.Scope {
+		t.Errorf("expected the scopes %q to be kept, got %q", tokens.Scope, refreshed.Scope)
+	}
+
+	// Exchanging the code again revokes the tokens issued for it.
+	if rr := postToken(client.ID, secret, exchange, "192.0.2.12"); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "invalid_grant") {
+		t.Errorf("expected a reused code to be rejected, got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = postToken(client.ID, secret, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshed.RefreshToken}}, "192.0.2.13")
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected the refresh tokens of a reused code to be revoked, got %d", rr.Code)
+	}
+	for _, accessToken := range []string{tokens.AccessToken, refreshed.AccessToken} {
+		if rr := authorizedRequest("GET", "/api/search?q=go", accessToken); rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected the access tokens of a reused code to be revoked, got %d", rr.Code)
+		}
+	}
+}
+
+// TestAuthorizationCodeFlowMFA tests that users with two-factor authentication present their
+// second factor at the authorization endpoint, and that the ID token says so.
+func TestAuthorizationCodeFlowMFA(t *testing.T) {
+	useRateLimits(t)
+	_, now := useLoginGuard(t, defaultLoginGuardConfig)
+	useRevocationStore(t, newMemoryRevocationStore())
+	useRefreshTokenStore(t, newMemoryRefreshTokenStore())
+	user := newTestUser(t, "alice", "alicepassword")
+	token, _ := issueAccessToken(user, "", tokenGrant{AMR: amrPassword})
+	_, recoveryCodes := enrollTestTOTP(t, token, "alicepassword")
+	useRevocationStore(t, newMemoryRevocationStore()) // Enrolling revoked the tokens issued within the same second.
+	client, _ := newTestClient(t, clientAuthNone)
+	verifier, challenge := newPKCE()
+
+	form := authorizeQuery(client, challenge, "openid")
+	form.Set("username", "alice")
+	form.Set("password", "alicepassword")
+	rr := postAuthorize(form)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `name="mfa_token"`) {
+		t.Fatalf("expected to be asked for a second factor, got %d: %s", rr.Code, rr.Body.String())
+	}
+	body := rr.Body.String()
+	start := strings.Index(body, `name="mfa_token" value="`) + len(`name="mfa_token" value="`)
+	mfaToken := body[start : start+strings.Index(body[start:], `"`)]
+
+	form = authorizeQuery(client, challenge, "openid")
+	form.Set("mfa_token", mfaToken)
+	form.Set("code", "000000")
+	if rr := postAuthorize(form); rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Body.String(), "Invalid code") {
+		t.Errorf("expected a wrong code to ask again, got %d", rr.Code)
+	}
+	// A wrong code backs off further attempts, as at /auth/login/mfa.
+	*now = now.Add(time.Minute)
+	form.Set("code", recoveryCodes[0])
+	redirect := redirectParams(t, postAuthorize(form))
+
+	// Public clients authenticate with their client_id and PKCE alone.
+	rr = postToken("", "", url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {client.ID},
+		"code":          {redirect.Get("code")},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {verifier},
+	}, "192.0.2.10")
+	var tokens tokenResponse
+	if err := json.NewDecoder(rr.Body).Decode(&tokens); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("expected tokens, got %d: %v", rr.Code, err)
+	}
+	idToken, err := signingKeys.parse(tokens.IDToken, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if amr := stringsClaim(idToken.Claims.(jwt.MapClaims), "amr"); !containsString(amr, amrMethodMFA) {
+		t.Errorf("expected the ID token's amr to include mfa, got %v", amr)
+	}
+	if _, ok := idToken.Claims.(jwt.MapClaims)["preferred_username"]; ok {
+		t.Error("expected no username without the profile scope")
+	}
+
+	if rr := authorizedRequest("GET", "/userinfo", tokens.AccessToken); rr.Code != http.StatusOK {
+		t.Fatalf("expected the access token to be accepted, got %d", rr.Code)
+	}
+
+	// Refresh tokens issued to a client only work for that client.
+	if rr := postRefresh(tokens.RefreshToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected a client's refresh token to be refused at /auth/refresh, got %d", rr.Code)
+	}
+	rr = postToken("", "", url.Values{"grant_type": {"refresh_token"}, "client_id": {client.ID}, "refresh_token": {tokens.RefreshToken}}, "192.0.2.11")
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected the misused refresh token to be revoked, got %d", rr.Code)
+	}
+	if rr := authorizedRequest("GET", "/userinfo", tokens.AccessToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected the access token of the misused refresh token to be revoked, got %d", rr.Code)
+	}
+}
+
+// TestTokenEndpointRateLimit tests that the token endpoint limits each client on its own rather
+// than by IP, and public clients and failed authentications by IP as well.
+func TestTokenEndpointRateLimit(t *testing.T) {
+	useRateLimits(t)
+	useRefreshTokenStore(t, newMemoryRefreshTokenStore())
+	useOAuthClientStore(t, newMemoryOAuthClientStore())
+	secretA, a, _ := createOAuthClient("a", []string{testRedirectURI}, clientAuthBasic)
+	secretB, b, _ := createOAuthClient("b", []string{testRedirectURI}, clientAuthBasic)
+	_, public, _ := createOAuthClient("public", []string{testRedirectURI}, clientAuthNone)
+	refresh := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {"unknown"}}
+	publicRefresh := url.Values{"grant_type": {"refresh_token"}, "client_id": {public.ID}, "refresh_token": {"unknown"}}
+
+	burst := defaultPolicyConfigs["token"].limit.Burst
+	if burst <= defaultPolicyConfigs["login"].limit.Burst {
+		t.Fatalf("expected the token policy to allow more than the login policy")
+	}
+	for i := 0; i < burst; i++ {
+		if rr := postToken(a.ID, secretA, refresh, "192.0.2.1"); rr.Code != http.StatusBadRequest {
+			t.Fatalf("expected request %d of client a to reach the handler, got %d", i+1, rr.Code)
+		}
+	}
+	if rr := postToken(a.ID, secretA, refresh, "192.0.2.2"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected client a to be limited from any IP, got %d", rr.Code)
+	}
+	if rr := postToken(b.ID, secretB, refresh, "192.0.2.1"); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected client b to have its own allowance, got %d", rr.Code)
+	}
+	if rr := postToken("", "", publicRefresh, "192.0.2.1"); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected public client requests to have their own allowance, got %d", rr.Code)
+	}
+
+	for i := 0; i < burst; i++ {
+		postToken(a.ID, "wrong", refresh, "192.0.2.3")
+	}
+	if rr := postToken(a.ID, "wrong", refresh, "192.0.2.3"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected failed client authentications to be limited by IP, got %d", rr.Code)
+	}
+	if rr := postToken(b.ID, secretB, refresh, "192.0.2.3"); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected an authenticated client not to share the IP's allowance, got %d", rr.Code)
+	}
+}
+
+// TestParseAuthorizeRequest tests the validation of authorization requests, and which errors
+// are redirected back to the client.
+func TestParseAuthorizeRequest(t *testing.T) {
+	client, _ := newTestClient(t, clientAuthBasic)
+	_, challenge := newPKCE()
+
+	tests := []struct {
+		name         string
+		change       func(url.Values)
+		wantRedirect bool
+		wantError    string
+	}{
+		{"valid", func(url.Values) {}, true, ""},
+		{"unknown client", func(v url.Values) { v.Set("client_id", "unknown") }, false, ""},
+		{"unregistered redirect URI", func(v url.Values) { v.Set("redirect_uri", "https://evil.example.com/callback") }, false, ""},
+		{"implicit flow", func(v url.Values) { v.Set("response_type", "token") }, true, "unsupported_response_type"},
+		{"no PKCE", func(v url.Values) { v.Del("code_challenge") }, true, "invalid_request"},
+		{"plain PKCE", func(v url.Values) { v.Set("code_challenge_method", "plain") }, true, "invalid_request"},
+		{"unknown scope", func(v url.Values) { v.Set("scope", "openid email") }, true, "invalid_scope"},
+		{"first-party scope", func(v url.Values) { v.Set("scope", "openid users:admin") }, true, "invalid_scope"},
+		{"no login prompt", func(v url.Values) { v.Set("prompt", "none") }, true, "login_required"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			params := authorizeQuery(client, challenge, "openid books:read")
+			tc.change(params)
+			req, err := parseAuthorizeRequest(params)
+			if (req != nil) != tc.wantRedirect {
+				t.Fatalf("expected a redirectable request %v, got %+v, %v", tc.wantRedirect, req, err)
+			}
+			var authErr *authorizeError
+			if errors.As(err, &authErr) != (tc.wantError != "") || (authErr != nil && authErr.code != tc.wantError) {
+				t.Errorf("expected error %q, got %v", tc.wantError, err)
+			}
+		})
+	}
+}
+
+// TestAuthenticateClient tests that clients must authenticate the way they registered.
+func TestAuthenticateClient(t *testing.T) {
+	useOAuthClientStore(t, newMemoryOAuthClientStore())
+	basicSecret, basic, _ := createOAuthClient("basic", []string{testRedirectURI}, clientAuthBasic)
+	postSecret, post, _ := createOAuthClient("post", []string{testRedirectURI}, clientAuthPost)
+	_, public, _ := createOAuthClient("public", []string{testRedirectURI}, clientAuthNone)
+
+	tests := []struct {
+		name    string
+		basic   []string // Client ID and secret for HTTP Basic authentication.
+		body    map[string]string
+		wantErr bool
+	}{
+		{"basic", []string{basic.ID, basicSecret}, nil, false},
+		{"basic with wrong secret", []string{basic.ID, postSecret}, nil, true},
+		{"basic client in body", nil, map[string]string{"client_id": basic.ID, "client_secret": basicSecret}, true},
+		{"post", nil, map[string]string{"client_id": post.ID, "client_secret": postSecret}, false},
+		{"post client with basic", []string{post.ID, postSecret}, nil, true},
+		{"public", nil, map[string]string{"client_id": public.ID}, false},
+		{"public with secret", nil, map[string]string{"client_id": public.ID, "client_secret": "guess"}, true},
+		{"confidential without secret", nil, map[string]string{"client_id": post.ID}, true},
+		{"unknown client", nil, map[string]string{"client_id": "unknown"}, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/oauth/token", nil)
+			if tc.basic != nil {
+				req.SetBasicAuth(tc.basic[0], tc.basic[1])
+			}
+			_, err := authenticateClient(req, tc.body)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("expected error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+// TestExchangeAuthorizationCode tests that codes only work for the client, redirect URI and
+// PKCE verifier they were issued for, and only until they expire.
+func TestExchangeAuthorizationCode(t *testing.T) {
+	useRefreshTokenStore(t, newMemoryRefreshTokenStore())
+	user := newTestUser(t, "alice", "alicepassword")
+	client, _ := newTestClient(t, clientAuthBasic)
+	_, other, _ := createOAuthClient("Other", []string{testRedirectURI}, clientAuthBasic)
+	verifier, challenge := newPKCE()
+	now := time.Now()
+	authorizationCodes.now = func() time.Time { return now }
+	t.Cleanup(func() { authorizationCodes.now = time.Now })
+
+	tests := []struct {
+		name        string
+		client      *OAuthClient
+		redirectURI string
+		verifier    string
+		elapsed     time.Duration
+		wantErr     bool
+	}{
+		{"valid", client, testRedirectURI, verifier, 0, false},
+		{"other client", other, testRedirectURI, verifier, 0, true},
+		{"other redirect URI", client, "https://app.example.com/other", verifier, 0, true},
+		{"wrong verifier", client, testRedirectURI, strings.Repeat("a", 43), 0, true},
+		{"no verifier", client, testRedirectURI, "", 0, true},
+		{"expired", client, testRedirectURI, verifier, authorizationCodeTTL + time.Second, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			code := authorizationCodes.create(authorizationCode{
+				clientID:      client.ID,
+				userID:        user.ID,
+				redirectURI:   testRedirectURI,
+				scopes:        []string{"books:read"},
+				codeChallenge: challenge,
+				amr:           amrPassword,
+				authTime:      now,
+			})
+			now = now.Add(tc.elapsed)
+			resp, err := exchangeAuthorizationCode(tc.client, code, tc.redirectURI, tc.verifier)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+			}
+			if err == nil && (resp.AccessToken == "" || resp.IDToken != "") {
+				t.Errorf("expected an access token and no ID token without openid, got %+v", resp)
+			}
+		})
+	}
+}
+
+// TestRegisterClient tests that admins can register clients, and others cannot.
+func TestRegisterClient(t *testing.T) {
+	useRateLimits(t)
+	useRevocationStore(t, newMemoryRevocationStore())
+	useOAuthClientStore(t, newMemoryOAuthClientStore())
+	adminToken, _ := issueAccessToken(&User{ID: "admin-id", Username: "admin", Roles: []string{roleAdmin}}, "", tokenGrant{})
+	readerToken, _ := issueAccessToken(&User{ID: "reader-id", Username: "reader"}, "", tokenGrant{})
+
+	tests := []struct {
+		name  string
+		token string
+		body  string
+		want  int
+	}{
+		{"confidential", adminToken, `{"client_name": "Reading list", "redirect_uris": ["https://app.example.com/callback"]}`, http.StatusCreated},
+		{"public native app", adminToken, `{"client_name": "CLI", "redirect_uris": ["http://127.0.0.1:8400/callback"], "token_endpoint_auth_method": "none"}`, http.StatusCreated},
+		{"plain HTTP", adminToken, `{"client_name": "App", "redirect_uris": ["http://app.example.com/callback"]}`, http.StatusBadRequest},
+		{"fragment", adminToken, `{"client_name": "App", "redirect_uris": ["https://app.example.com/#callback"]}`, http.StatusBadRequest},
+		{"no redirect URIs", adminToken, `{"client_name": "App"}`, http.StatusBadRequest},
+		{"no name", adminToken, `{"redirect_uris": ["https://app.example.com/callback"]}`, http.StatusBadRequest},
+		{"unknown auth method", adminToken, `{"client_name": "App", "redirect_uris": ["https://app.example.com/callback"], "token_endpoint_auth_method": "private_key_jwt"}`, http.StatusBadRequest},
+		{"not an admin", readerToken, `{"client_name": "App", "redirect_uris": ["https://app.example.com/callback"]}`, http.StatusForbidden},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := postJSON("/api/admin/oauth/clients", tc.token, tc.body)
+			if rr.Code != tc.want {
+				t.Fatalf("expected %d, got %d: %s", tc.want, rr.Code, rr.Body.String())
+			}
+			if rr.Code != http.StatusCreated {
+				return
+			}
+			var resp clientRegistrationResponse
+			if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			stored, err := oauthClients.Get(resp.ClientID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (resp.ClientSecret == "") != (resp.TokenEndpointAuthMethod == clientAuthNone) || stored.SecretHash != hashTokenIfSet(resp.ClientSecret) {
+				t.Errorf("expected confidential clients to get a secret stored hashed, got %+v and %+v", resp, stored)
+			}
+		})
+	}
+}
+
+// hashTokenIfSet returns the hash of token, or "" if it is empty.
+func hashTokenIfSet(token string) string {
+	if token == "" {
+		return ""
+	}
+	return hashToken(token)
+}
+
+// TestClientTokensCannotManageAccount tests that access tokens issued to OAuth clients are
+// refused by the account management and admin routes, whatever the user could do with a login
+// of their own.
+func TestClientTokensCannotManageAccount(t *testing.T) {
+	useRateLimits(t)
+	useRevocationStore(t, newMemoryRevocationStore())
+	useAPIKeyStore(t, newMemoryAPIKeyStore())
+	store := newMemoryUserStore()
+	useUserStore(t, store)
+	admin, err := registerUser(store, "admin", "adminpassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	useAdminUserIDs(t, admin.ID)
+	clientToken, _ := issueAccessToken(admin, "", tokenGrant{ClientID: "c1", Scopes: []string{scopeOpenID, scopeUsersAdmin}})
+	loginToken, _ := issueAccessToken(admin, "", tokenGrant{AMR: amrPassword})
+
+	tests := []struct {
+		method, target, body string
+	}{
+		{"POST", "/api/keys", `{"name": "backdoor", "scopes": ["users:admin"]}`},
+		{"GET", "/api/keys", ""},
+		{"GET", "/api/me/quota", ""},
+		{"POST", "/api/me/mfa/totp", ""},
+		{"POST", "/api/admin/users/" + admin.ID + "/revoke-sessions", ""},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+		req.Header.Set("Authorization", "Bearer "+clientToken)
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		newRouter().ServeHTTP(rr, req)
+		if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "insufficient_scope") {
+			t.Errorf("%s %s: expected a client token to be forbidden, got %d: %s", tc.method, tc.target, rr.Code, rr.Body.String())
+		}
+	}
+	if keys, _ := apiKeys.ListByUser(admin.ID); len(keys) != 0 {
+		t.Errorf("expected no API keys to be created, got %+v", keys)
+	}
+
+	if rr := postJSON("/api/keys", loginToken, `{"name": "ops", "scopes": ["users:admin"]}`); rr.Code != http.StatusCreated {
+		t.Errorf("expected the user's own login to create keys, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// OpenID Connect scopes clients can ask for alongside the API scopes.
+const (
+	scopeOpenID  = "openid"  // Issue an ID token and allow /userinfo.
+	scopeProfile = "profile" // Include the username in the ID token and /userinfo.
+)
+
+// isOIDCScope reports whether scope is an OpenID Connect scope.
+func isOIDCScope(scope string) bool {
+	return scope == scopeOpenID || scope == scopeProfile
+}
+
+// publicURL is the base URL clients reach the service at, from PUBLIC_URL. If it is empty,
+// the base URL is taken from each request.
+var publicURL = ""
+
+// publicURLFromEnv reads and validates PUBLIC_URL.
+func publicURLFromEnv() (string, error) {
+	v := strings.TrimRight(os.Getenv("PUBLIC_URL"), "/")
+	if v == "" {
+		return "", nil
+	}
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("PUBLIC_URL must be an absolute http or https URL, got %q", v)
+	}
+	return v, nil
+}
+
+// baseURL returns the URL of the service for links in responses to r.
+func baseURL(r *http.Request) string {
+	if publicURL != "" {
+		return publicURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// issueIDToken signs an OpenID Connect ID token asserting that user authenticated by amr at
+// authTime, for the client clientID. nonce is the one the client sent with its authorization
+// request, if any. The username is included if scopes include profile.
+func issueIDToken(user *User, clientID, nonce string, authTime time.Time, amr, scopes []string) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":       tokenSettings.issuer,
+		"sub":       user.ID,
+		"aud":       clientID,
+		"iat":       now.Unix(),
+		"exp":       now.Add(tokenSettings.accessTTL).Unix(),
+		"auth_time": authTime.Unix(),
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	if len(amr) > 0 {
+		claims["amr"] = amr
+	}
+	if containsString(scopes, scopeProfile) {
+		claims["preferred_username"] = user.Username
+	}
+	return signingKeys.sign(claims)
+}
+
+// userinfoResponse is the body of /userinfo (OpenID Connect Core section 5.3).
+type userinfoResponse struct {
+	Sub               string `json:"sub"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+}
+
+// userinfoHandler returns the claims about the user an access token with the openid scope
+// was issued for. It must run after jwtMiddleware and RequireScope(scopeOpenID).
+func userinfoHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := PrincipalFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	user, err := userStore.GetByID(p.UserID)
+	if errors.Is(err, ErrUserNotFound) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error looking up user", http.StatusInternalServerError)
+		return
+	}
+
+	resp := userinfoResponse{Sub: user.ID}
+	if p.HasScope(scopeProfile) {
+		resp.PreferredUsername = user.Username
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, resp)
+}
+
+// openIDConfiguration is the OpenID Connect discovery document.
+type openIDConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// openIDConfigurationHandler serves the discovery document (OpenID Connect Discovery 1.0).
+func openIDConfigurationHandler(w http.ResponseWriter, r *http.Request) {
+	base := baseURL(r)
+	scopes := []string{scopeOpenID, scopeProfile}
+	for _, granted := range roleScopes {
+		for _, scope := range granted {
+			if !isFirstPartyScope(scope) && !containsString(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	sort.Strings(scopes[2:])
+
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, openIDConfiguration{
+		Issuer:                            tokenSettings.issuer,
+		AuthorizationEndpoint:             base + "/oauth/authorize",
+		TokenEndpoint:                     base + "/oauth/token",
+		UserinfoEndpoint:                  base + "/userinfo",
+		JWKSURI:                           base + "/.well-known/jwks.json",
+		ScopesSupported:                   scopes,
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code", "refresh_token"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{signingKeys.current.method.Alg()},
+		TokenEndpointAuthMethodsSupported: []string{clientAuthBasic, clientAuthPost, clientAuthNone},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported:                   []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "amr", "preferred_username"},
+	})
+}
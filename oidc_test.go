@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestOpenIDConfiguration tests the discovery document with and without PUBLIC_URL.
+func TestOpenIDConfiguration(t *testing.T) {
+	tests := []struct {
+		name      string
+		publicURL string
+		wantBase  string
+	}{
+		{"from request", "", "http://books.example.com"},
+		{"PUBLIC_URL", "https://books.example.org/go-books", "https://books.example.org/go-books"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("PUBLIC_URL", tc.publicURL)
+			public, err := publicURLFromEnv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			original := publicURL
+			publicURL = public
+			t.Cleanup(func() { publicURL = original })
+
+			rr := httptest.NewRecorder()
+			newRouter().ServeHTTP(rr, httptest.NewRequest("GET", "http://books.example.com/.well-known/openid-configuration", nil))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d", rr.Code)
+			}
+			var cfg openIDConfiguration
+			if err := json.NewDecoder(rr.Body).Decode(&cfg); err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Issuer != tokenSettings.issuer || cfg.AuthorizationEndpoint != tc.wantBase+"/oauth/authorize" || cfg.TokenEndpoint != tc.wantBase+"/oauth/token" ||
+				cfg.UserinfoEndpoint != tc.wantBase+"/userinfo" || cfg.JWKSURI != tc.wantBase+"/.well-known/jwks.json" {
+				t.Errorf("unexpected endpoints in %+v", cfg)
+			}
+			if !containsString(cfg.ScopesSupported, scopeOpenID) || !containsString(cfg.ScopesSupported, scopeBooksRead) || containsString(cfg.ScopesSupported, scopeUsersAdmin) || cfg.CodeChallengeMethodsSupported[0] != "S256" {
+				t.Errorf("unexpected capabilities in %+v", cfg)
+			}
+			if cfg.IDTokenSigningAlgValuesSupported[0] != signingKeys.current.method.Alg() {
+				t.Errorf("expected ID tokens signed with %s, got %v", signingKeys.current.method.Alg(), cfg.IDTokenSigningAlgValuesSupported)
+			}
+		})
+	}
+
+	t.Setenv("PUBLIC_URL", "books.example.com")
+	if _, err := publicURLFromEnv(); err == nil {
+		t.Error("expected a PUBLIC_URL without a scheme to be an error")
+	}
+}
+
+// TestUserinfo tests that /userinfo needs a token with the openid scope for an existing user.
+func TestUserinfo(t *testing.T) {
+	useRevocationStore(t, newMemoryRevocationStore())
+	user := newTestUser(t, "alice", "alicepassword")
+	openID, _ := issueAccessToken(user, "", tokenGrant{ClientID: "c1", Scopes: []string{scopeOpenID}})
+	firstParty, _ := issueAccessToken(user, "", tokenGrant{})
+	deleted, _ := issueAccessToken(&User{ID: "deleted"}, "", tokenGrant{ClientID: "c1", Scopes: []string{scopeOpenID}})
+
+	tests := []struct {
+		name     string
+		token    string
+		want     int
+		wantBody string
+	}{
+		{"openid", openID, http.StatusOK, `{"sub":"` + user.ID + `"}` + "\n"},
+		{"no openid scope", firstParty, http.StatusForbidden, ""},
+		{"deleted user", deleted, http.StatusUnauthorized, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := authorizedRequest("GET", "/userinfo", tc.token)
+			if rr.Code != tc.want {
+				t.Fatalf("expected %d, got %d: %s", tc.want, rr.Code, rr.Body.String())
+			}
+			if tc.wantBody != "" && rr.Body.String() != tc.wantBody {
+				t.Errorf("expected %q, got %q", tc.wantBody, rr.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// defaultOpenLibraryURL is the public Open Library API.
+const defaultOpenLibraryURL = "https://openlibrary.org"
+
+// openLibraryCoverURL is the Covers API URL for a medium-sized cover image, formatted with a cover ID.
+const openLibraryCoverURL = "https://covers.openlibrary.org/b/id/%d-M.jpg"
+
+// openLibrarySearchFields restricts /search.json to the fields decoded into olSearchDoc.
+const openLibrarySearchFields = "key,title,subtitle,author_name,author_key,first_publish_year,isbn,publisher," +
+	"language,number_of_pages_median,subject,cover_i,edition_count"
+
+var (
+	openLibraryWorkID    = regexp.MustCompile(`^OL[0-9]+W$`)
+	openLibraryEditionID = regexp.MustCompile(`^OL[0-9]+M$`)
+)
+
+// openLibrary is a BookProvider backed by the Open Library API (or a mirror of it).
+type openLibrary struct {
+	baseURL  string
+	upstream *upstreamClient
+}
+
+// newOpenLibrary returns an Open Library provider that sends requests to baseURL through upstream.
+func newOpenLibrary(baseURL string, upstream *upstreamClient) *openLibrary {
+	return &openLibrary{baseURL: strings.TrimRight(baseURL, "/"), upstream: upstream}
+}
+
+// Search queries /search.json.
+func (o *openLibrary) Search(ctx context.Context, q SearchQuery) (*SearchResult, error) {
+	var raw olSearchResponse
+	if err := o.getJSON(ctx, o.searchPath(q), &raw); err != nil {
+		return nil, err
+	}
+
+	results := &SearchResult{NumFound: raw.NumFound, Start: raw.Start, Docs: make([]Book, 0, len(raw.Docs))}
+	for _, doc := range raw.Docs {
+		results.Docs = append(results.Docs, doc.book())
+	}
+	return results, nil
+}
+
+// searchPath returns the /search.json path and query string for q. Identical queries produce
+// identical paths, so the path doubles as the cache and coalescing key.
+func (o *openLibrary) searchPath(q SearchQuery) string {
+	params := url.Values{}
+	params.Set("q", openLibraryQuery(q))
+	params.Set("fields", openLibrarySearchFields)
+	if q.Limit > 0 {
+		params.Set("limit", strconv.Itoa(q.Limit))
+		params.Set("offset", strconv.Itoa(q.Offset()))
+	}
+	if q.Sort != "" {
+		params.Set("sort", string(q.Sort))
+	}
+	return "/search.json?" + params.Encode()
+}
+
+// openLibraryQuery translates q into Open Library's Solr query syntax, joining the criteria with AND.
+func openLibraryQuery(q SearchQuery) string {
+	var clauses []string
+	if q.Text != "" {
+		clauses = append(clauses, "("+solrEscape(q.Text)+")")
+	}
+	phrase := func(field, value string) {
+		if value != "" {
+			clauses = append(clauses, field+`:"`+solrPhraseEscape(value)+`"`)
+		}
+	}
+	phrase("author_name", q.Author)
+	phrase("title", q.Title)
+	phrase("subject", q.Subject)
+	phrase("isbn", q.ISBN)
+	phrase("publisher", q.Publisher)
+	phrase("language", q.Language)
+	if q.FirstPublishYearMin != 0 || q.FirstPublishYearMax != 0 {
+		clauses = append(clauses, fmt.Sprintf("first_publish_year:[%s TO %s]",
+			solrRangeBound(q.FirstPublishYearMin), solrRangeBound(q.FirstPublishYearMax)))
+	}
+	return strings.Join(clauses, " AND ")
+}
+
+// solrSpecialChars replaces every character with special meaning in a Solr query by its escaped form.
+var solrSpecialChars = strings.NewReplacer(
+	`\`, `\\`, `+`, `\+`, `-`, `\-`, `&`, `\&`, `|`, `\|`, `!`, `\!`, `(`, `\(`, `)`, `\)`,
+	`{`, `\{`, `}`, `\}`, `[`, `\[`, `]`, `\]`, `^`, `\^`, `"`, `\"`, `~`, `\~`, `*`, `\*`,
+	`?`, `\?`, `:`, `\:`, `/`, `\/`,
+)
+
+// solrEscape escapes free text so that it is matched as plain terms.
+func solrEscape(s string) string {
+	return solrSpecialChars.Replace(s)
+}
+
+// solrPhraseEscape escapes a value for use inside a quoted Solr phrase.
+func solrPhraseEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+// solrRangeBound formats a year range bound, using * for an unbounded (0) end.
+func solrRangeBound(year int) string {
+	if year == 0 {
+		return "*"
+	}
+	return strconv.Itoa(year)
+}
+
+// GetWork fetches /works/{id}.json. The id has the form "OL45883W".
+func (o *openLibrary) GetWork(ctx context.Context, id string) (*Work, error) {
+	if !openLibraryWorkID.MatchString(id) {
+		return nil, ErrNotFound
+	}
+	var raw olWork
+	if err := o.getJSON(ctx, "/works/"+id+".json", &raw); err != nil {
+		return nil, err
+	}
+	return raw.work(), nil
+}
+
+// GetEdition fetches /books/{id}.json. The id has the form "OL7353617M".
+func (o *openLibrary) GetEdition(ctx context.Context, id string) (*Edition, error) {
+	if !openLibraryEditionID.MatchString(id) {
+		return nil, ErrNotFound
+	}
+	var raw olEdition
+	if err := o.getJSON(ctx, "/books/"+id+".json", &raw); err != nil {
+		return nil, err
+	}
+	return raw.edition(), nil
+}
+
+// getJSON fetches path relative to the base URL and decodes the response body into v.
+func (o *openLibrary) getJSON(ctx context.Context, path string, v interface{}) error {
+	body, err := o.upstream.get(ctx, o.baseURL+path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedResponse, err)
+	}
+	return nil
+}
+
+// olSearchResponse is the body of an Open Library /search.json response.
+type olSearchResponse struct {
+	NumFound int           `json:"numFound"`
+	Start    int           `json:"start"`
+	Docs     []olSearchDoc `json:"docs"`
+}
+
+// olSearchDoc is a single work in an Open Library search response.
+type olSearchDoc struct {
+	Key                 string   `json:"key"`
+	Title               string   `json:"title"`
+	Subtitle            string   `json:"subtitle"`
+	AuthorName          []string `json:"author_name"`
+	AuthorKey           []string `json:"author_key"`
+	FirstPublishYear    int      `json:"first_publish_year"`
+	ISBN                []string `json:"isbn"`
+	Publisher           []string `json:"publisher"`
+	Language            []string `json:"language"`
+	NumberOfPagesMedian int      `json:"number_of_pages_median"`
+	Subject             []string `json:"subject"`
+	CoverI              int      `json:"cover_i"`
+	EditionCount        int      `json:"edition_count"`
+}
+
+// book converts the search doc to the provider-neutral Book model.
+func (d olSearchDoc) book() Book {
+	authors := make([]Author, 0, len(d.AuthorName))
+	for i, name := range d.AuthorName {
+		author := Author{Name: strings.TrimSpace(name)}
+		if i < len(d.AuthorKey) {
+			author.Key = olKeyID(d.AuthorKey[i])
+		}
+		authors = append(authors, author)
+	}
+	return Book{
+		Key:              olKeyID(d.Key),
+		Title:            strings.TrimSpace(d.Title),
+		Subtitle:         strings.TrimSpace(d.Subtitle),
+		Authors:          authors,
+		FirstPublishYear: d.FirstPublishYear,
+		ISBNs:            normalizeISBNs(d.ISBN),
+		Publishers:       normalizeStrings(d.Publisher),
+		Languages:        normalizeStrings(d.Language),
+		NumberOfPages:    d.NumberOfPagesMedian,
+		Subjects:         normalizeStrings(d.Subject),
+		CoverID:          d.CoverI,
+		CoverURL:         olCoverURL(d.CoverI),
+		EditionCount:     d.EditionCount,
+	}
+}
+
+// olRef is a reference to another Open Library record, e.g. {"key": "/authors/OL23919A"}.
+type olRef struct {
+	Key string `json:"key"`
+}
+
+// olText is a text field that Open Library returns either as a plain string
+// or as {"type": "/type/text", "value": "..."}.
+type olText string
+
+// UnmarshalJSON accepts both representations of a text field.
+func (t *olText) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*t = olText(s)
+		return nil
+	}
+	var typed struct {
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(data, &typed); err != nil {
+		return err
+	}
+	*t = olText(typed.Value)
+	return nil
+}
+
+// olWork is the body of an Open Library /works/{id}.json response.
+type olWork struct {
+	Key         string `json:"key"`
+	Title       string `json:"title"`
+	Subtitle    string `json:"subtitle"`
+	Description olText `json:"description"`
+	Authors     []struct {
+		Author olRef `json:"author"`
+	} `json:"authors"`
+	FirstPublishDate string   `json:"first_publish_date"`
+	Subjects         []string `json:"subjects"`
+	Covers           []int    `json:"covers"`
+}
+
+// work converts the Open Library work to the provider-neutral Work model.
+func (w olWork) work() *Work {
+	authors := make([]Author, 0, len(w.Authors))
+	for _, a := range w.Authors {
+		authors = append(authors, Author{Key: olKeyID(a.Author.Key)})
+	}
+	coverID := olFirstCover(w.Covers)
+	return &Work{
+		Key:              olKeyID(w.Key),
+		Title:            strings.TrimSpace(w.Title),
+		Subtitle:         strings.TrimSpace(w.Subtitle),
+		Description:      strings.TrimSpace(string(w.Description)),
+		Authors:          authors,
+		FirstPublishDate: strings.TrimSpace(w.FirstPublishDate),
+		Subjects:         normalizeStrings(w.Subjects),
+		CoverID:          coverID,
+		CoverURL:         olCoverURL(coverID),
+	}
+}
+
+// olEdition is the body of an Open Library /books/{id}.json response.
+type olEdition struct {
+	Key           string   `json:"key"`
+	Title         string   `json:"title"`
+	Subtitle      string   `json:"subtitle"`
+	Works         []olRef  `json:"works"`
+	Authors       []olRef  `json:"authors"`
+	Publishers    []string `json:"publishers"`
+	PublishDate   string   `json:"publish_date"`
+	ISBN10        []string `json:"isbn_10"`
+	ISBN13        []string `json:"isbn_13"`
+	Languages     []olRef  `json:"languages"`
+	NumberOfPages int      `json:"number_of_pages"`
+	Covers        []int    `json:"covers"`
+}
+
+// edition converts the Open Library edition to the provider-neutral Edition model.
+func (e olEdition) edition() *Edition {
+	works := make([]string, 0, len(e.Works))
+	for _, w := range e.Works {
+		works = append(works, olKeyID(w.Key))
+	}
+	authors := make([]Author, 0, len(e.Authors))
+	for _, a := range e.Authors {
+		authors = append(authors, Author{Key: olKeyID(a.Key)})
+	}
+	languages := make([]string, 0, len(e.Languages))
+	for _, l := range e.Languages {
+		languages = append(languages, olKeyID(l.Key))
+	}
+	coverID := olFirstCover(e.Covers)
+	return &Edition{
+		Key:           olKeyID(e.Key),
+		Title:         strings.TrimSpace(e.Title),
+		Subtitle:      strings.TrimSpace(e.Subtitle),
+		Works:         normalizeStrings(works),
+		Authors:       authors,
+		Publishers:    normalizeStrings(e.Publishers),
+		PublishDate:   strings.TrimSpace(e.PublishDate),
+		ISBNs:         normalizeISBNs(append(append([]string{}, e.ISBN13...), e.ISBN10...)),
+		Languages:     normalizeStrings(languages),
+		NumberOfPages: e.NumberOfPages,
+		CoverID:       coverID,
+		CoverURL:      olCoverURL(coverID),
+	}
+}
+
+// olKeyID strips the type prefix from an Open Library key, e.g. "/works/OL45883W" becomes "OL45883W".
+func olKeyID(key string) string {
+	key = strings.TrimSpace(key)
+	return key[strings.LastIndex(key, "/")+1:]
+}
+
+// olFirstCover returns the first valid cover ID. Open Library uses -1 for deleted covers.
+func olFirstCover(covers []int) int {
+	for _, id := range covers {
+		if id > 0 {
+			return id
+		}
+	}
+	return 0
+}
+
+// olCoverURL returns the cover image URL for a cover ID, or "" if there is no cover.
+func olCoverURL(coverID int) string {
+	if coverID <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(openLibraryCoverURL, coverID)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// newTestUpstreamClient returns an upstream client whose requests are served by rt, without
+// retry delays so tests of failing upstreams stay fast.
+func newTestUpstreamClient(rt RoundTripFunc, cache *responseCache) *upstreamClient {
+	u := newUpstreamClient(&http.Client{Transport: rt}, cache)
+	u.retry.baseDelay, u.retry.maxDelay = 0, 0
+	return u
+}
+
+// newTestOpenLibrary returns an Open Library provider whose requests are served by rt.
+func newTestOpenLibrary(rt RoundTripFunc) *openLibrary {
+	return newOpenLibrary("https://openlibrary.test", newTestUpstreamClient(rt, nil))
+}
+
+// TestOpenLibrarySearch tests decoding and error handling of /search.json responses.
+func TestOpenLibrarySearch(t *testing.T) {
+	provider := newTestOpenLibrary(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/search.json" {
+			t.Errorf("unexpected path %q", req.URL.Path)
+		}
+		switch req.URL.Query().Get("q") {
+		case `author_name:"error"`:
+			return nil, errors.New("simulated network error")
+		case `author_name:"badjson"`:
+			return newResponse(200, "not json"), nil
+		case `author_name:"unavailable"`:
+			return newResponse(503, "down"), nil
+		default:
+			return newResponse(200, `{"docs": [{"title": "Test Book"}]}`), nil
+		}
+	})
+
+	tests := []struct {
+		author    string
+		wantErr   bool
+		wantIs    error
+		wantTitle string
+	}{
+		{author: "error", wantErr: true},
+		{author: "badjson", wantErr: true, wantIs: ErrMalformedResponse},
+		{author: "unavailable", wantErr: true},
+		{author: "someauthor", wantTitle: "Test Book"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.author, func(t *testing.T) {
+			results, err := provider.Search(context.Background(), SearchQuery{Author: tc.author})
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if tc.wantIs != nil && !errors.Is(err, tc.wantIs) {
+					t.Errorf("expected error %v, got %v", tc.wantIs, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(results.Docs) != 1 || results.Docs[0].Title != tc.wantTitle {
+				t.Errorf("unexpected results %+v", results)
+			}
+		})
+	}
+}
+
+// TestOpenLibraryLookups tests the work and edition endpoints.
+func TestOpenLibraryLookups(t *testing.T) {
+	provider := newTestOpenLibrary(func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/works/OL1W.json":
+			return newResponse(200, `{"key": "/works/OL1W", "title": "A Work"}`), nil
+		case "/books/OL1M.json":
+			return newResponse(200, `{"key": "/books/OL1M", "title": "An Edition"}`), nil
+		default:
+			return newResponse(404, `{"error": "notfound"}`), nil
+		}
+	})
+	ctx := context.Background()
+
+	if work, err := provider.GetWork(ctx, "OL1W"); err != nil || work.Title != "A Work" {
+		t.Errorf("GetWork: got %+v, %v", work, err)
+	}
+	if _, err := provider.GetWork(ctx, "OL2W"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetWork missing: expected ErrNotFound, got %v", err)
+	}
+	if _, err := provider.GetWork(ctx, "../search"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetWork invalid id: expected ErrNotFound, got %v", err)
+	}
+	if edition, err := provider.GetEdition(ctx, "OL1M"); err != nil || edition.Title != "An Edition" {
+		t.Errorf("GetEdition: got %+v, %v", edition, err)
+	}
+	if _, err := provider.GetEdition(ctx, "OL1W"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetEdition with work id: expected ErrNotFound, got %v", err)
+	}
+}
+
+// TestOpenLibraryDecoding tests that Open Library documents are normalized into the Book, Work and Edition models.
+func TestOpenLibraryDecoding(t *testing.T) {
+	provider := newTestOpenLibrary(func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/search.json":
+			if fields := req.URL.Query().Get("fields"); fields != openLibrarySearchFields {
+				t.Errorf("expected fields %q, got %q", openLibrarySearchFields, fields)
+			}
+			return newResponse(200, `{"numFound": 1, "docs": [{
+				"key": "/works/OL27448W",
+				"title": " The Lord of the Rings ",
+				"author_name": ["J.R.R. Tolkien"],
+				"author_key": ["OL26320A"],
+				"first_publish_year": 1954,
+				"isbn": ["978-0-618-64015-7", "0618640150", "9780618640157", "bogus"],
+				"publisher": ["Houghton Mifflin", "Houghton Mifflin", ""],
+				"language": ["eng"],
+				"number_of_pages_median": 1193,
+				"subject": ["Fantasy"],
+				"cover_i": 9255566,
+				"edition_count": 241
+			}]}`), nil
+		case "/works/OL27448W.json":
+			return newResponse(200, `{
+				"key": "/works/OL27448W",
+				"title": "The Lord of the Rings",
+				"description": {"type": "/type/text", "value": "An epic."},
+				"authors": [{"author": {"key": "/authors/OL26320A"}}],
+				"covers": [-1, 9255566]
+			}`), nil
+		case "/books/OL7353617M.json":
+			return newResponse(200, `{
+				"key": "/books/OL7353617M",
+				"title": "Fantastic Mr. Fox",
+				"works": [{"key": "/works/OL45804W"}],
+				"publishers": ["Puffin"],
+				"isbn_10": ["0140328726"],
+				"isbn_13": ["9780140328721"],
+				"languages": [{"key": "/languages/eng"}],
+				"number_of_pages": 96
+			}`), nil
+		}
+		return newResponse(404, ""), nil
+	})
+	ctx := context.Background()
+
+	results, err := provider.Search(ctx, SearchQuery{Author: "tolkien"})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if results.NumFound != 1 {
+		t.Errorf("expected numFound 1, got %d", results.NumFound)
+	}
+	book := results.Docs[0]
+	if book.Key != "OL27448W" || book.Title != "The Lord of the Rings" {
+		t.Errorf("unexpected key/title %q/%q", book.Key, book.Title)
+	}
+	if len(book.Authors) != 1 || book.Authors[0] != (Author{Key: "OL26320A", Name: "J.R.R. Tolkien"}) {
+		t.Errorf("unexpected authors %+v", book.Authors)
+	}
+	if got := strings.Join(book.ISBNs, ","); got != "9780618640157,0618640150" {
+		t.Errorf("unexpected ISBNs %q", got)
+	}
+	if got := strings.Join(book.Publishers, ","); got != "Houghton Mifflin" {
+		t.Errorf("unexpected publishers %q", got)
+	}
+	if book.FirstPublishYear != 1954 || book.NumberOfPages != 1193 || book.EditionCount != 241 {
+		t.Errorf("unexpected counts %+v", book)
+	}
+	if book.CoverURL != "https://covers.openlibrary.org/b/id/9255566-M.jpg" {
+		t.Errorf("unexpected cover URL %q", book.CoverURL)
+	}
+
+	work, err := provider.GetWork(ctx, "OL27448W")
+	if err != nil {
+		t.Fatalf("GetWork: %v", err)
+	}
+	if work.Description != "An epic." || work.CoverID != 9255566 || work.Authors[0].Key != "OL26320A" {
+		t.Errorf("unexpected work %+v", work)
+	}
+
+	edition, err := provider.GetEdition(ctx, "OL7353617M")
+	if err != nil {
+		t.Fatalf("GetEdition: %v", err)
+	}
+	if edition.Key != "OL7353617M" || edition.Works[0] != "OL45804W" || edition.Languages[0] != "eng" {
+		t.Errorf("unexpected edition %+v", edition)
+	}
+	if got := strings.Join(edition.ISBNs, ","); got != "9780140328721,0140328726" {
+		t.Errorf("unexpected edition ISBNs %q", got)
+	}
+}
+
+// TestOpenLibraryQuery tests the translation of search criteria into Open Library's query syntax.
+func TestOpenLibraryQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query SearchQuery
+		want  string
+	}{
+		{"author", SearchQuery{Author: "Tolkien"}, `author_name:"Tolkien"`},
+		{"free text is escaped", SearchQuery{Text: "c++ (3rd ed)"}, `(c\+\+ \(3rd ed\))`},
+		{"phrase quotes are escaped", SearchQuery{Title: `say "hi"`}, `title:"say \"hi\""`},
+		{
+			"combined with AND",
+			SearchQuery{Subject: "fantasy", ISBN: "9780618640157", Publisher: "Allen", Language: "eng"},
+			`subject:"fantasy" AND isbn:"9780618640157" AND publisher:"Allen" AND language:"eng"`,
+		},
+		{"year range", SearchQuery{FirstPublishYearMin: 1950, FirstPublishYearMax: 1960}, "first_publish_year:[1950 TO 1960]"},
+		{"open year range", SearchQuery{FirstPublishYearMin: 1950}, "first_publish_year:[1950 TO *]"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := openLibraryQuery(tc.query); got != tc.want {
+				t.Errorf("expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+// TestOpenLibraryPaging tests that page, limit and sort are passed to /search.json.
+func TestOpenLibraryPaging(t *testing.T) {
+	provider := newTestOpenLibrary(func(req *http.Request) (*http.Response, error) {
+		params := req.URL.Query()
+		if params.Get("limit") != "10" || params.Get("offset") != "20" || params.Get("sort") != "editions" {
+			t.Errorf("unexpected paging parameters %v", params)
+		}
+		return newResponse(200, `{"numFound": 42, "start": 20, "docs": []}`), nil
+	})
+
+	results, err := provider.Search(context.Background(), SearchQuery{Author: "x", Page: 3, Limit: 10, Sort: SortEditions})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if results.NumFound != 42 || results.Start != 20 {
+		t.Errorf("unexpected results %+v", results)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Plan is a tier of service for the book API: a short-window burst limit and daily and
+// monthly quotas, all measured in request cost (see requestCost).
+type Plan struct {
+	Name    string
+	Burst   rateLimit // Zero Requests for no burst limit.
+	Daily   int64     // Cost allowed per UTC day; 0 for no daily quota.
+	Monthly int64     // Cost allowed per UTC calendar month; 0 for no monthly quota.
+	limiter Limiter   // Enforces Burst; nil without one.
+}
+
+// planQuota is one of a plan's quotas.
+type planQuota struct {
+	period string // "daily" or "monthly".
+	limit  int64
+}
+
+// quotas returns the plan's quotas.
+func (p *Plan) quotas() []planQuota {
+	var quotas []planQuota
+	if p.Daily > 0 {
+		quotas = append(quotas, planQuota{"daily", p.Daily})
+	}
+	if p.Monthly > 0 {
+		quotas = append(quotas, planQuota{"monthly", p.Monthly})
+	}
+	return quotas
+}
+
+// quotaWindow returns an identifier for the quota period containing now and when it resets:
+// midnight UTC for daily quotas and the first of the month for monthly ones.
+func quotaWindow(period string, now time.Time) (string, time.Time) {
+	y, m, d := now.UTC().Date()
+	if period == "monthly" {
+		start := time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+		return start.Format("2006-01"), start.AddDate(0, 1, 0)
+	}
+	start := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	return start.Format("2006-01-02"), start.AddDate(0, 0, 1)
+}
+
+// planSet holds the plans, who is on which, and their quota usage.
+type planSet struct {
+	plans       map[string]*Plan
+	defaultPlan *Plan            // For callers not assigned a plan; nil leaves them unmetered.
+	users       map[string]*Plan // By user ID.
+	apiKeys     map[string]*Plan // By API key ID.
+	store       LimiterStore     // Quota counters.
+	now         func() time.Time
+}
+
+// plans meter callers of the book API, or are nil to meter no one. They are replaced at
+// startup by newPlansFromEnv.
+var plans *planSet
+
+// planConfig is a plan in the plans file. Period is a duration such as "1m".
+type planConfig struct {
+	Requests int    `json:"requests"`
+	Period   string `json:"period"`
+	Burst    int    `json:"burst"`
+	Daily    int64  `json:"daily"`
+	Monthly  int64  `json:"monthly"`
+}
+
+// plansConfig is the format of the plans file.
+type plansConfig struct {
+	DefaultPlan string                `json:"default_plan"`
+	Plans       map[string]planConfig `json:"plans"`
+	Users       map[string]string     `json:"users"`    // User ID to plan name.
+	APIKeys     map[string]string     `json:"api_keys"` // API key ID to plan name.
+}
+
+// parsePlans builds plans from the JSON plans file in data. Burst limits use algorithm and,
+// like quotas, keep their state in store, or in process if it is nil.
+func parsePlans(data []byte, store LimiterStore, algorithm string) (*planSet, error) {
+	var cfg plansConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid plans: %v", err)
+	}
+	if len(cfg.Plans) == 0 {
+		return nil, fmt.Errorf("invalid plans: no plans defined")
+	}
+
+	s := &planSet{
+		plans:   make(map[string]*Plan),
+		users:   make(map[string]*Plan),
+		apiKeys: make(map[string]*Plan),
+		store:   store,
+		now:     time.Now,
+	}
+	if s.store == nil {
+		s.store = newMemoryLimiterStore()
+	}
+	for name, pc := range cfg.Plans {
+		p := &Plan{Name: name, Burst: rateLimit{Requests: pc.Requests, Burst: pc.Burst}, Daily: pc.Daily, Monthly: pc.Monthly}
+		if pc.Requests < 0 || pc.Burst < 0 || pc.Daily < 0 || pc.Monthly < 0 {
+			return nil, fmt.Errorf("plan %s: limits must not be negative", name)
+		}
+		if pc.Requests > 0 {
+			period, err := time.ParseDuration(pc.Period)
+			if err != nil {
+				return nil, fmt.Errorf("plan %s: invalid period %q", name, pc.Period)
+			}
+			p.Burst.Period = period
+			limiter, err := newLimiter("go-books:plan:"+name, policyConfig{algorithm: algorithm, limit: p.Burst, store: store}.withDefaults())
+			if err != nil {
+				return nil, fmt.Errorf("plan %s: %v", name, err)
+			}
+			p.limiter = limiter
+		}
+		s.plans[name] = p
+	}
+
+	lookup := func(name string) (*Plan, error) {
+		p, ok := s.plans[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid plans: unknown plan %q", name)
+		}
+		return p, nil
+	}
+	var err error
+	if cfg.DefaultPlan != "" {
+		if s.defaultPlan, err = lookup(cfg.DefaultPlan); err != nil {
+			return nil, err
+		}
+	}
+	for id, name := range cfg.Users {
+		if s.users[id], err = lookup(name); err != nil {
+			return nil, err
+		}
+	}
+	for id, name := range cfg.APIKeys {
+		if s.apiKeys[id], err = lookup(name); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// newPlansFromEnv loads the plans file named by RATE_LIMIT_PLANS_FILE, keeping usage in
+// store. It returns nil if no file is configured.
+func newPlansFromEnv(store LimiterStore) (*planSet, error) {
+	path := os.Getenv("RATE_LIMIT_PLANS_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parsePlans(data, store, os.Getenv("RATE_LIMIT_ALGORITHM"))
+}
+
+// planFor returns the caller's plan, or nil if they are not metered, and the client their
+// usage is counted for. An API key assigned a plan of its own has its own usage; other keys
+// count towards their user's.
+func (s *planSet) planFor(p *Principal) (*Plan, string) {
+	if plan, ok := s.apiKeys[p.APIKeyID]; ok && p.APIKeyID != "" {
+		return plan, "api-key:" + p.APIKeyID
+	}
+	if plan, ok := s.users[p.UserID]; ok {
+		return plan, "user:" + p.UserID
+	}
+	return s.defaultPlan, "user:" + p.UserID
+}
+
+// quotaKey returns the key of the client's counter for a quota period containing now, and
+// when the period ends.
+func (s *planSet) quotaKey(client, period string, now time.Time) (string, time.Time) {
+	id, reset := quotaWindow(period, now)
+	return "go-books:quota:" + client + ":" + period + ":" + id, reset
+}
+
+// increment adds cost to the client's usage of quota and returns the new usage and when the
+// quota resets. Counters are kept for an hour past their reset, to allow for clock skew.
+func (s *planSet) increment(client string, quota planQuota, cost int64) (int64, time.Time, error) {
+	now := s.now()
+	key, reset := s.quotaKey(client, quota.period, now)
+	used, err := s.store.Increment(key, cost, reset.Sub(now)+time.Hour)
+	return used, reset, err
+}
+
+// admit counts a request from client against its plan at a cost of 1, unless that would
+// exceed the plan's burst limit or one of its quotas. If it would, it returns the reason and
+// when to retry. If the quota store is unavailable requests are admitted.
+func (s *planSet) admit(plan *Plan, client string) (string, time.Duration) {
+	var counted []planQuota
+	refund := func() {
+		for _, quota := range counted {
+			if _, _, err := s.increment(client, quota, -1); err != nil {
+				logrus.Warnf("Could not refund rejected request to quota store: %v", err)
+			}
+		}
+	}
+
+	for _, quota := range plan.quotas() {
+		used, reset, err := s.increment(client, quota, 1)
+		if err != nil {
+			logrus.Warnf("Quota store unavailable, admitting request: %v", err)
+			continue
+		}
+		counted = append(counted, quota)
+		if used > quota.limit {
+			refund()
+			if quota.period == "monthly" {
+				return "Monthly quota exceeded", reset.Sub(s.now())
+			}
+			return "Daily quota exceeded", reset.Sub(s.now())
+		}
+	}
+
+	if plan.limiter != nil {
+		if d := plan.limiter.Allow(client); !d.Allowed {
+			refund()
+			return "Too many requests", d.RetryAfter
+		}
+	}
+	return "", 0
+}
+
+// charge adds a further cost for a request that was admitted. A negative cost refunds it.
+func (s *planSet) charge(plan *Plan, client string, cost int) {
+	if plan.limiter != nil {
+		plan.limiter.Charge(client, cost)
+	}
+	for _, quota := range plan.quotas() {
+		if _, _, err := s.increment(client, quota, int64(cost)); err != nil {
+			logrus.Warnf("Could not charge request to quota store: %v", err)
+		}
+	}
+}
+
+// quotaCount is a caller's usage of a limit.
+type quotaCount struct {
+	Limit     int64 `json:"limit"`
+	Remaining int64 `json:"remaining"`
+	Reset     int   `json:"reset"` // Seconds until the full allowance is available.
+}
+
+// planUsage is a caller's usage of their plan.
+type planUsage struct {
+	Name    string      `json:"name"`
+	Burst   *quotaCount `json:"burst,omitempty"`
+	Daily   *quotaCount `json:"daily,omitempty"`
+	Monthly *quotaCount `json:"monthly,omitempty"`
+}
+
+// usage reports the client's usage of plan without using any of it up.
+func (s *planSet) usage(plan *Plan, client string) planUsage {
+	u := planUsage{Name: plan.Name}
+	if plan.limiter != nil {
+		d := plan.limiter.Peek(client)
+		u.Burst = &quotaCount{Limit: int64(d.Limit), Remaining: int64(d.Remaining), Reset: ceilSeconds(d.Reset)}
+	}
+	for _, quota := range plan.quotas() {
+		used, reset, err := s.increment(client, quota, 0)
+		if err != nil {
+			logrus.Warnf("Quota store unavailable: %v", err)
+			continue
+		}
+		c := &quotaCount{Limit: quota.limit, Remaining: quota.limit - used, Reset: ceilSeconds(reset.Sub(s.now()))}
+		if c.Remaining < 0 {
+			c.Remaining = 0
+		}
+		if quota.period == "monthly" {
+			u.Monthly = c
+		} else {
+			u.Daily = c
+		}
+	}
+	return u
+}
+
+// planMiddleware meters authenticated callers by their plan, rejecting requests over its burst
+// limit or quotas with 429 and Retry-After. Each request is admitted at a cost of 1; any
+// further cost of the upstream calls it made is charged once it has been handled. Requests
+// rejected by a rate limit policy further in are not charged. It must run after jwtMiddleware.
+func planMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := PrincipalFromContext(r.Context())
+		if plans == nil || !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		plan, client := plans.planFor(p)
+		if plan == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if reason, retryAfter := plans.admit(plan, client); reason != "" {
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+			http.Error(w, reason, http.StatusTooManyRequests)
+			return
+		}
+
+		ctx, info := withFetchInfo(r.Context())
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		cost := requestCost(info)
+		if rec.status == http.StatusTooManyRequests {
+			cost = 0
+		}
+		if cost != 1 {
+			plans.charge(plan, client, cost-1)
+		}
+	})
+}
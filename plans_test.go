@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testPlans is a plans file with a free plan for everyone and a pro plan for alice, user u2,
+// and one of bob's API keys.
+const testPlans = `{
+	"default_plan": "free",
+	"plans": {
+		"free": {"requests": 60, "period": "1m", "burst": 10, "daily": 3, "monthly": 5},
+		"pro": {"daily": 1000}
+	},
+	"users": {"u2": "pro"},
+	"api_keys": {"0123456789abcdef": "pro"}
+}`
+
+// usePlans swaps plans for the duration of a test.
+func usePlans(t *testing.T, s *planSet) {
+	t.Helper()
+	original := plans
+	plans = s
+	t.Cleanup(func() { plans = original })
+}
+
+// newTestPlans parses testPlans with a fake clock for quotas.
+func newTestPlans(t *testing.T) (*planSet, *time.Time) {
+	t.Helper()
+	s, err := parsePlans([]byte(testPlans), nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 30, 23, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	s.store.(*memoryLimiterStore).now = s.now
+	return s, &now
+}
+
+// TestParsePlans tests validation of the plans file.
+func TestParsePlans(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{"valid", testPlans, false},
+		{"no default plan", `{"plans": {"free": {"daily": 10}}}`, false},
+		{"malformed", `{"plans": [`, true},
+		{"no plans", `{"plans": {}}`, true},
+		{"unknown default plan", `{"default_plan": "gold", "plans": {"free": {"daily": 10}}}`, true},
+		{"unknown user plan", `{"plans": {"free": {"daily": 10}}, "users": {"u2": "gold"}}`, true},
+		{"unknown API key plan", `{"plans": {"free": {"daily": 10}}, "api_keys": {"k1": "gold"}}`, true},
+		{"invalid period", `{"plans": {"free": {"requests": 10, "period": "soon"}}}`, true},
+		{"negative quota", `{"plans": {"free": {"daily": -1}}}`, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parsePlans([]byte(tc.data), nil, "")
+			if (err != nil) != tc.wantErr {
+				t.Errorf("expected error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+
+	if _, err := parsePlans([]byte(testPlans), newMemoryLimiterStore(), algorithmTokenBucket); err == nil {
+		t.Error("expected a token bucket burst limit with a store to be an error")
+	}
+}
+
+// TestPlanFor tests which plan callers are on and whose usage they count towards.
+func TestPlanFor(t *testing.T) {
+	s, _ := newTestPlans(t)
+	tests := []struct {
+		name       string
+		principal  Principal
+		wantPlan   string
+		wantClient string
+	}{
+		{"default", Principal{UserID: "u1", Username: "carol"}, "free", "user:u1"},
+		{"user", Principal{UserID: "u2", Username: "alice"}, "pro", "user:u2"},
+		{"API key of user", Principal{UserID: "u2", Username: "alice", APIKeyID: "fedcba9876543210"}, "pro", "user:u2"},
+		{"API key with own plan", Principal{UserID: "u3", Username: "bob", APIKeyID: "0123456789abcdef"}, "pro", "api-key:0123456789abcdef"},
+		{"username matching a planned user's ID", Principal{UserID: "u4", Username: "u2"}, "free", "user:u4"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			plan, client := s.planFor(&tc.principal)
+			if plan == nil || plan.Name != tc.wantPlan || client != tc.wantClient {
+				t.Errorf("expected plan %s for %s, got %+v for %s", tc.wantPlan, tc.wantClient, plan, client)
+			}
+		})
+	}
+
+	s.defaultPlan = nil
+	if plan, _ := s.planFor(&Principal{UserID: "u1", Username: "carol"}); plan != nil {
+		t.Errorf("expected callers without a plan not to be metered, got %+v", plan)
+	}
+}
+
+// TestPlanQuotas tests that daily and monthly quotas are enforced and reset on schedule.
+func TestPlanQuotas(t *testing.T) {
+	s, now := newTestPlans(t)
+	free := s.plans["free"]
+
+	admit := func(n int) (admitted int, reason string, retryAfter time.Duration) {
+		for i := 0; i < n; i++ {
+			if reason, retryAfter = s.admit(free, "user:u1"); reason != "" {
+				return admitted, reason, retryAfter
+			}
+			admitted++
+		}
+		return admitted, "", 0
+	}
+
+	if n, reason, retry := admit(5); n != 3 || reason != "Daily quota exceeded" || retry != time.Hour {
+		t.Errorf("expected 3 requests on Jan 30, then to retry at midnight, got %d, %q, %v", n, reason, retry)
+	}
+	*now = now.Add(time.Hour) // Jan 31, 00:00.
+	if n, reason, retry := admit(5); n != 2 || reason != "Monthly quota exceeded" || retry != 24*time.Hour {
+		t.Errorf("expected 2 more requests in January, then to retry on Feb 1, got %d, %q, %v", n, reason, retry)
+	}
+	if u := s.usage(free, "user:u1"); u.Daily.Remaining != 1 || u.Monthly.Remaining != 0 || u.Monthly.Reset != 86400 {
+		t.Errorf("expected rejected requests not to count, got daily %+v and monthly %+v", u.Daily, u.Monthly)
+	}
+
+	*now = now.Add(24 * time.Hour) // Feb 1.
+	if n, _, _ := admit(5); n != 3 {
+		t.Errorf("expected the quotas to reset in February, got %d requests", n)
+	}
+}
+
+// TestPlanMiddleware tests that requests are charged by cost, and that requests rejected by a
+// rate limit policy are refunded.
+func TestPlanMiddleware(t *testing.T) {
+	s, err := parsePlans([]byte(`{"default_plan": "metered", "plans": {"metered": {"daily": 12}}}`), nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	usePlans(t, s)
+
+	handler := planMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("fetch") {
+		case "upstream":
+			recordFetch(r.Context(), "MISS", true)
+		case "limited":
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		default:
+			recordFetch(r.Context(), "HIT", false)
+		}
+	}))
+	request := func(fetch string) int {
+		req := httptest.NewRequest("GET", "/api/works/OL1W?fetch="+fetch, nil)
+		req = req.WithContext(withPrincipal(req.Context(), &Principal{UserID: "u1", Username: "carol"}))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	steps := []struct {
+		fetch     string
+		want      int
+		remaining int64
+	}{
+		{"upstream", http.StatusOK, 7},
+		{"limited", http.StatusTooManyRequests, 7},
+		{"upstream", http.StatusOK, 2},
+		{"hit", http.StatusOK, 1},
+		{"hit", http.StatusOK, 0},
+		{"hit", http.StatusTooManyRequests, 0},
+	}
+	for i, step := range steps {
+		if got := request(step.fetch); got != step.want {
+			t.Errorf("step %d: expected %d, got %d", i, step.want, got)
+		}
+		if u := s.usage(s.defaultPlan, "user:u1"); u.Daily.Remaining != step.remaining {
+			t.Errorf("step %d: expected %d remaining, got %d", i, step.remaining, u.Daily.Remaining)
+		}
+	}
+}
+
+// TestQuotaHandlerPlan tests that the caller's plan is reported with their quotas.
+func TestQuotaHandlerPlan(t *testing.T) {
+	useRateLimits(t)
+	useRevocationStore(t, newMemoryRevocationStore())
+	s, _ := newTestPlans(t)
+	usePlans(t, s)
+	token, _ := issueAccessToken(&User{ID: "u1", Username: "carol"}, "", tokenGrant{})
+
+	rr := authorizedRequest("GET", "/api/me/quota", token)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	var resp quotaResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Plan == nil || resp.Plan.Name != "free" || resp.Plan.Burst.Limit != 10 || resp.Plan.Daily.Remaining != 3 || resp.Plan.Monthly.Limit != 5 {
+		t.Errorf("expected the free plan with its limits unused, got %+v", resp.Plan)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// Principal is the authenticated caller of a request, taken from its verified access token
+// or API key.
+type Principal struct {
+	UserID    string
+	Username  string
+	Roles     []string
+	Scopes    []string
+	AMR       []string  // How the user authenticated, from the access token's amr claim.
+	TokenID   string    // The access token's jti; empty for API keys.
+	SessionID string    // The refresh token family the access token was issued with, if any.
+	APIKeyID  string    // The API key's ID; empty for access tokens.
+	ClientID  string    // The OAuth client the access token was issued to; empty for first-party logins.
+	ExpiresAt time.Time // When the token or key expires; zero for keys that do not expire.
+}
+
+// newPrincipal builds a Principal from verified access token claims.
+func newPrincipal(claims jwt.MapClaims) *Principal {
+	return &Principal{
+		UserID:    stringClaim(claims, "sub"),
+		Username:  stringClaim(claims, "username"),
+		Roles:     stringsClaim(claims, "roles"),
+		Scopes:    strings.Fields(stringClaim(claims, "scope")),
+		AMR:       stringsClaim(claims, "amr"),
+		TokenID:   stringClaim(claims, "jti"),
+		SessionID: stringClaim(claims, "sid"),
+		ClientID:  stringClaim(claims, "client_id"),
+		ExpiresAt: claimTime(claims, "exp"),
+	}
+}
+
+// stringClaim returns a string claim, or "" if it is missing or not a string.
+func stringClaim(claims jwt.MapClaims, name string) string {
+	s, _ := claims[name].(string)
+	return s
+}
+
+// stringsClaim returns the strings in an array claim, skipping any other values.
+func stringsClaim(claims jwt.MapClaims, name string) []string {
+	var list []string
+	// JSON arrays decode as []interface{}.
+	values, _ := claims[name].([]interface{})
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// HasRole reports whether the principal has role.
+func (p *Principal) HasRole(role string) bool {
+	return containsString(p.Roles, role)
+}
+
+// HasMFA reports whether the user presented a second factor to obtain the access token.
+func (p *Principal) HasMFA() bool {
+	return containsString(p.AMR, amrMethodMFA)
+}
+
+// HasScope reports whether the principal's token grants scope.
+func (p *Principal) HasScope(scope string) bool {
+	return containsString(p.Scopes, scope)
+}
+
+// principalContextKey is the request context key of the Principal.
+type principalContextKey struct{}
+
+// withPrincipal returns a copy of ctx carrying p.
+func withPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, p)
+}
+
+// PrincipalFromContext returns the caller jwtMiddleware authenticated, if any.
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalContextKey{}).(*Principal)
+	return p, ok && p != nil
+}
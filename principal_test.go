@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// TestPrincipalFromContext tests that jwtMiddleware exposes the caller to handlers.
+func TestPrincipalFromContext(t *testing.T) {
+	useRevocationStore(t, newMemoryRevocationStore())
+	user := &User{ID: "u1", Username: "lib", Roles: []string{roleLibrarian}}
+	token, err := issueAccessToken(user, "session-1", tokenGrant{AMR: amrMFA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := parseAccessToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got *Principal
+	handler := jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := PrincipalFromContext(r.Context())
+		if !ok {
+			t.Fatal("expected a principal in the request context")
+		}
+		got = p
+	}))
+	req := httptest.NewRequest("GET", "/api/search", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	want := &Principal{
+		UserID:    "u1",
+		Username:  "lib",
+		Roles:     []string{"librarian"},
+		Scopes:    []string{"books:read", "cache:read"},
+		AMR:       []string{"mfa", "otp", "pwd"},
+		TokenID:   claims["jti"].(string),
+		SessionID: "session-1",
+		ExpiresAt: claimTime(claims, "exp"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+	if !got.HasRole(roleLibrarian) || got.HasRole(roleAdmin) {
+		t.Errorf("unexpected HasRole results for %v", got.Roles)
+	}
+	if !got.HasScope(scopeCacheRead) || got.HasScope(scopeUsersAdmin) {
+		t.Errorf("unexpected HasScope results for %v", got.Scopes)
+	}
+
+	if !got.HasMFA() || (&Principal{AMR: amrPassword}).HasMFA() {
+		t.Errorf("unexpected HasMFA results for %v", got.AMR)
+	}
+
+	if _, ok := PrincipalFromContext(httptest.NewRequest("GET", "/", nil).Context()); ok {
+		t.Error("expected no principal outside jwtMiddleware")
+	}
+}
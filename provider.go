@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// ErrNotFound is returned by a BookProvider when the requested work or edition does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrMalformedResponse is returned by a BookProvider when the upstream catalogue sends a body it cannot decode.
+var ErrMalformedResponse = errors.New("malformed upstream response")
+
+// BookProvider is a catalogue that books can be searched and looked up in.
+type BookProvider interface {
+	// Search returns the books matching q.
+	Search(ctx context.Context, q SearchQuery) (*SearchResult, error)
+	// GetWork returns the work with the given provider-specific ID.
+	GetWork(ctx context.Context, id string) (*Work, error)
+	// GetEdition returns the edition with the given provider-specific ID.
+	GetEdition(ctx context.Context, id string) (*Edition, error)
+}
+
+// SearchResult holds one page of the books returned by a search.
+type SearchResult struct {
+	NumFound int    `json:"numFound"` // Total number of matches across all pages.
+	Start    int    `json:"start"`    // Zero-based index of Docs[0] among all matches.
+	Docs     []Book `json:"docs"`
+}
+
+// bookProvider is the catalogue used by the search handlers. It is replaced at startup
+// by newBookProviderFromEnv.
+var bookProvider BookProvider = newOpenLibrary(defaultOpenLibraryURL, newUpstreamClient(http.DefaultClient, nil))
+
+// newBookProviderFromEnv builds the BookProvider selected by the BOOK_PROVIDER environment variable.
+// Upstream responses are cached in upstreamCache, and the upstream client is configured by
+// newUpstreamClientFromEnv.
+// Supported providers:
+//   - "openlibrary" (default): configured with OPENLIBRARY_URL to point at a mirror.
+func newBookProviderFromEnv() (BookProvider, error) {
+	switch name := os.Getenv("BOOK_PROVIDER"); name {
+	case "", "openlibrary":
+		baseURL := os.Getenv("OPENLIBRARY_URL")
+		if baseURL == "" {
+			baseURL = defaultOpenLibraryURL
+		}
+		upstream, err := newUpstreamClientFromEnv(upstreamCache)
+		if err != nil {
+			return nil, err
+		}
+		return newOpenLibrary(baseURL, upstream), nil
+	default:
+		return nil, fmt.Errorf("unknown book provider %q", name)
+	}
+}
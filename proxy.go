@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// trustedProxies are the networks of reverse proxies whose forwarding headers are believed.
+// It is replaced at startup by trustedProxiesFromEnv.
+var trustedProxies []*net.IPNet
+
+// trustedProxiesFromEnv parses the comma-separated CIDRs or IP addresses in TRUSTED_PROXIES.
+func trustedProxiesFromEnv() ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range splitList(os.Getenv("TRUSTED_PROXIES")) {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", entry, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// forwardedHeader is the header the trusted proxies record the forwarding chain in, either
+// X-Forwarded-For or the RFC 7239 Forwarded header. It is replaced at startup by
+// forwardedHeaderFromEnv. Only that header is read: a proxy passes on any other unchanged,
+// with whatever the client put in it.
+var forwardedHeader = "X-Forwarded-For"
+
+// forwardedHeaderFromEnv reads PROXY_HEADER, which is x-forwarded-for or forwarded.
+func forwardedHeaderFromEnv() (string, error) {
+	switch v := strings.ToLower(strings.TrimSpace(os.Getenv("PROXY_HEADER"))); v {
+	case "", "x-forwarded-for":
+		return "X-Forwarded-For", nil
+	case "forwarded":
+		return "Forwarded", nil
+	default:
+		return "", fmt.Errorf("PROXY_HEADER must be x-forwarded-for or forwarded, got %q", v)
+	}
+}
+
+// isTrustedProxy reports whether ip belongs to a trusted proxy.
+func isTrustedProxy(ip net.IP) bool {
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client that sent r. If the request came through
+// trusted proxies, the forwarding chain in forwardedHeader is walked from the right, skipping
+// trusted proxies, and the first other address is the client. Each proxy appends the address
+// it received the request from, so only the addresses left of it by untrusted parties can be
+// forged.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrustedProxy(ip) {
+		return host
+	}
+
+	var hops []string
+	if values := r.Header.Values(forwardedHeader); len(values) > 0 {
+		if forwardedHeader == "Forwarded" {
+			hops = parseForwarded(strings.Join(values, ","))
+		} else {
+			for _, hop := range strings.Split(strings.Join(values, ","), ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseForwardedIP(hops[i])
+		if hop == nil {
+			// An obfuscated or malformed address: nothing further left can be trusted, so the
+			// nearest known address stands in for the client.
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// parseForwarded returns the for= parameters of the elements of an RFC 7239 Forwarded header,
+// in order. Elements without one yield "".
+func parseForwarded(header string) []string {
+	var hops []string
+	for _, element := range splitForwarded(header, ',') {
+		hop := ""
+		for _, pair := range splitForwarded(element, ';') {
+			name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(name, "for") {
+				hop = strings.Trim(value, `"`)
+			}
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// splitForwarded splits s at sep, except inside quoted strings.
+func splitForwarded(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseForwardedIP parses a forwarded address, which may carry a port and, for IPv6, brackets:
+// 192.0.2.43, 192.0.2.43:47011, [2001:db8::17] or [2001:db8::17]:4711. Obfuscated identifiers
+// such as "unknown" or "_hidden" return nil.
+func parseForwardedIP(s string) net.IP {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.Trim(s, "[]"))
+}
+
+// auditLog returns a logger for security-relevant events recording who made the request and from where.
+func auditLog(r *http.Request) *logrus.Entry {
+	fields := logrus.Fields{"client_ip": clientIP(r)}
+	if p, ok := PrincipalFromContext(r.Context()); ok {
+		fields["user_id"] = p.UserID
+		fields["username"] = p.Username
+	}
+	return logrus.WithFields(fields)
+}
+
+// statusRecorder records the status code written to a ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// logRequests logs each request with its resolved client IP, status and duration.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		logrus.WithFields(logrus.Fields{
+			"client_ip": clientIP(r),
+			"method":    r.Method,
+			"path":      r.URL.Path,
+			"status":    rec.status,
+			"duration":  time.Since(start).Round(time.Microsecond),
+		}).Info("Request")
+	})
+}
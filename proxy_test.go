@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// useTrustedProxies swaps trustedProxies for the duration of a test.
+func useTrustedProxies(t *testing.T, cidrs ...string) {
+	t.Helper()
+	t.Setenv("TRUSTED_PROXIES", strings.Join(cidrs, ","))
+	proxies, err := trustedProxiesFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := trustedProxies
+	trustedProxies = proxies
+	t.Cleanup(func() { trustedProxies = original })
+}
+
+// TestClientIP tests resolving the client IP through trusted proxies.
+func TestClientIP(t *testing.T) {
+	useTrustedProxies(t, "10.0.0.0/8", "2001:db8:ffff::/48", "192.0.2.200")
+
+	tests := []struct {
+		name       string
+		header     string // PROXY_HEADER; empty for the default.
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"direct", "", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"untrusted peer's headers are ignored", "", "203.0.113.7:5000", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy without headers", "", "10.0.0.2:5000", nil, "10.0.0.2"},
+		{"x-forwarded-for", "", "10.0.0.2:5000", map[string]string{"X-Forwarded-For": "203.0.113.7"}, "203.0.113.7"},
+		{"forged entries left of the client are ignored", "", "10.0.0.2:5000", map[string]string{"X-Forwarded-For": "198.51.100.1, 203.0.113.7"}, "203.0.113.7"},
+		{"chain of trusted proxies", "", "10.0.0.2:5000", map[string]string{"X-Forwarded-For": "203.0.113.7, 192.0.2.200, 10.1.1.1"}, "203.0.113.7"},
+		{"only trusted hops", "", "10.0.0.2:5000", map[string]string{"X-Forwarded-For": "10.1.1.1, 10.2.2.2"}, "10.1.1.1"},
+		{"malformed hop", "", "10.0.0.2:5000", map[string]string{"X-Forwarded-For": "203.0.113.7, garbage, 10.1.1.1"}, "10.1.1.1"},
+		{"forwarded", "forwarded", "10.0.0.2:5000", map[string]string{"Forwarded": `for=198.51.100.1, for="203.0.113.7:4711";proto=https`}, "203.0.113.7"},
+		{"forwarded ipv6", "forwarded", "[2001:db8:ffff::1]:443", map[string]string{"Forwarded": `for="[2001:db8:cafe::17]:4711"`}, "2001:db8:cafe::17"},
+		{"forwarded ignores x-forwarded-for", "forwarded", "10.0.0.2:5000", map[string]string{"Forwarded": "for=203.0.113.7", "X-Forwarded-For": "198.51.100.1"}, "203.0.113.7"},
+		// nginx.conf sets X-Forwarded-For and passes on whatever Forwarded the client sent.
+		{"client-supplied forwarded behind nginx", "", "10.0.0.2:5000", map[string]string{"Forwarded": "for=198.51.100.1", "X-Forwarded-For": "203.0.113.7"}, "203.0.113.7"},
+		{"client-supplied forwarded alone", "", "10.0.0.2:5000", map[string]string{"Forwarded": "for=198.51.100.1"}, "10.0.0.2"},
+		{"forwarded obfuscated", "forwarded", "10.0.0.2:5000", map[string]string{"Forwarded": "for=_hidden, for=10.1.1.1"}, "10.1.1.1"},
+		{"forwarded quoted separators", "forwarded", "10.0.0.2:5000", map[string]string{"Forwarded": `for=203.0.113.7;by="a,b;c"`}, "203.0.113.7"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("PROXY_HEADER", tc.header)
+			header, err := forwardedHeaderFromEnv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			original := forwardedHeader
+			forwardedHeader = header
+			t.Cleanup(func() { forwardedHeader = original })
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for name, value := range tc.headers {
+				req.Header.Set(name, value)
+			}
+			if got := clientIP(req); got != tc.want {
+				t.Errorf("expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+// TestTrustedProxiesFromEnv tests parsing TRUSTED_PROXIES.
+func TestTrustedProxiesFromEnv(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.0.2.1 ,::1")
+	proxies, err := trustedProxiesFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proxies) != 3 || !proxies[1].Contains(net.ParseIP("192.0.2.1")) || proxies[1].Contains(net.ParseIP("192.0.2.2")) {
+		t.Errorf("unexpected proxies %v", proxies)
+	}
+
+	for _, bad := range []string{"10.0.0.0/33", "not-an-ip"} {
+		t.Setenv("TRUSTED_PROXIES", bad)
+		if _, err := trustedProxiesFromEnv(); err == nil {
+			t.Errorf("expected %q to be invalid", bad)
+		}
+	}
+
+	t.Setenv("PROXY_HEADER", "x-real-ip")
+	if _, err := forwardedHeaderFromEnv(); err == nil {
+		t.Error("expected an unknown PROXY_HEADER to be invalid")
+	}
+}
+
+// TestLogRequests tests that the access log records the resolved client IP.
+func TestLogRequests(t *testing.T) {
+	useTrustedProxies(t, "10.0.0.0/8")
+	var buf bytes.Buffer
+	original := logrus.StandardLogger().Out
+	logrus.SetOutput(&buf)
+	t.Cleanup(func() { logrus.SetOutput(original) })
+
+	handler := logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	req := httptest.NewRequest("GET", "/login?username=reader&password=secret", nil)
+	req.RemoteAddr = "10.0.0.2:5000"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	line := buf.String()
+	for _, want := range []string{"client_ip=203.0.113.7", "status=418", "path=/login"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("expected %q in log line %q", want, line)
+		}
+	}
+	if strings.Contains(line, "secret") {
+		t.Errorf("expected the query string not to be logged, got %q", line)
+	}
+}
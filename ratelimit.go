@@ -0,0 +1,685 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Limiter decides whether a client, identified by key, may make another request.
+// Implementations must be safe for concurrent use.
+type Limiter interface {
+	// Allow records a request from the client and reports whether it is within the limit.
+	Allow(key string) rateDecision
+	// Charge records a further cost for a request that was already allowed, even if it takes
+	// the client over the limit; its next requests wait until the cost has been paid off.
+	Charge(key string, cost int)
+	// Peek reports the client's current usage without recording a request.
+	Peek(key string) rateDecision
+}
+
+// rateDecision is the outcome of a rate limit check and the client's remaining allowance.
+type rateDecision struct {
+	Allowed    bool
+	Limit      int           // Requests allowed in a burst or window.
+	Remaining  int           // Requests left right now.
+	Reset      time.Duration // Time until the full allowance is available again.
+	RetryAfter time.Duration // Time until the next request is allowed; zero if Remaining > 0.
+}
+
+// rateLimit is a rate: Requests per Period, with bursts of up to Burst requests. Burst is only
+// used by the token bucket algorithm; the sliding window allows at most Requests in any Period.
+type rateLimit struct {
+	Requests int
+	Period   time.Duration
+	Burst    int
+}
+
+// Rate limiting algorithms.
+const (
+	algorithmTokenBucket   = "token-bucket"
+	algorithmSlidingWindow = "sliding-window"
+)
+
+// limitState tracks one client's usage for a rate limiting algorithm.
+type limitState interface {
+	// allow records a request at now if it is within the limit.
+	allow(now time.Time) rateDecision
+	// peek reports the usage at now without recording a request.
+	peek(now time.Time) rateDecision
+	// charge records a further cost at now. A negative cost refunds requests, but never
+	// beyond the full allowance.
+	charge(now time.Time, cost int)
+}
+
+// seconds converts a fractional number of seconds to a duration.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// tokenBucket refills at rate tokens per second up to burst tokens; each request takes one.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens accrued since the last request.
+func (b *tokenBucket) refill(now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = b.burst
+	} else if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+func (b *tokenBucket) allow(now time.Time) rateDecision {
+	b.refill(now)
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	d := b.decision()
+	d.Allowed = allowed
+	return d
+}
+
+func (b *tokenBucket) charge(now time.Time, cost int) {
+	b.refill(now)
+	b.tokens = math.Min(b.tokens-float64(cost), b.burst)
+}
+
+func (b *tokenBucket) peek(now time.Time) rateDecision {
+	peeked := *b
+	peeked.refill(now)
+	d := peeked.decision()
+	d.Allowed = d.Remaining > 0
+	return d
+}
+
+// decision describes the bucket's current contents.
+func (b *tokenBucket) decision() rateDecision {
+	d := rateDecision{
+		Limit:     int(b.burst),
+		Remaining: int(math.Max(b.tokens, 0)),
+		Reset:     seconds((b.burst - b.tokens) / b.rate),
+	}
+	if b.tokens < 1 {
+		d.RetryAfter = seconds((1 - b.tokens) / b.rate)
+	}
+	return d
+}
+
+// slidingWindow approximates the number of requests in the last period from the counts of the
+// current and previous fixed windows, weighting the previous one by how much of it still
+// overlaps the sliding window.
+type slidingWindow struct {
+	limit  int
+	period time.Duration
+	start  time.Time // Start of the current fixed window.
+	count  int
+	prev   int
+}
+
+// advance moves to the fixed window containing now.
+func (s *slidingWindow) advance(now time.Time) {
+	if start := now.Truncate(s.period); !start.Equal(s.start) {
+		if start.Equal(s.start.Add(s.period)) {
+			s.prev = s.count
+		} else {
+			s.prev = 0
+		}
+		s.start, s.count = start, 0
+	}
+}
+
+func (s *slidingWindow) allow(now time.Time) rateDecision {
+	s.advance(now)
+	allowed := s.estimate(now)+1 <= float64(s.limit)
+	if allowed {
+		s.count++
+	}
+	d := s.decision(now)
+	d.Allowed = allowed
+	return d
+}
+
+func (s *slidingWindow) charge(now time.Time, cost int) {
+	s.advance(now)
+	if s.count += cost; s.count < 0 {
+		s.count = 0
+	}
+}
+
+func (s *slidingWindow) peek(now time.Time) rateDecision {
+	peeked := *s
+	peeked.advance(now)
+	d := peeked.decision(now)
+	d.Allowed = d.Remaining > 0
+	return d
+}
+
+// estimate returns the approximate number of requests in the period up to now.
+func (s *slidingWindow) estimate(now time.Time) float64 {
+	elapsed := float64(now.Sub(s.start)) / float64(s.period)
+	return float64(s.prev)*(1-elapsed) + float64(s.count)
+}
+
+// decision describes the window's usage at now.
+func (s *slidingWindow) decision(now time.Time) rateDecision {
+	estimate := s.estimate(now)
+	d := rateDecision{Limit: s.limit, Remaining: int(float64(s.limit) - estimate)}
+	if d.Remaining < 0 {
+		d.Remaining = 0
+	}
+
+	// The requests in the current window stop counting by the end of the next one.
+	end := s.start.Add(s.period)
+	if s.count > 0 {
+		d.Reset = end.Add(s.period).Sub(now)
+	} else if s.prev > 0 {
+		d.Reset = end.Sub(now)
+	}
+
+	if d.Remaining == 0 {
+		// Find when the estimate drops to limit-1: within this window if the previous window's
+		// weight can bring it there, otherwise part way through the next window.
+		room := float64(s.limit - 1 - s.count)
+		if room >= 0 && s.prev > 0 {
+			d.RetryAfter = s.start.Add(time.Duration((1 - room/float64(s.prev)) * float64(s.period))).Sub(now)
+		} else {
+			d.RetryAfter = end.Add(time.Duration((1 - float64(s.limit-1)/float64(s.count)) * float64(s.period))).Sub(now)
+		}
+		if d.RetryAfter < 0 {
+			d.RetryAfter = 0
+		}
+	}
+	return d
+}
+
+// limiterEntry is a client's state and when it was last seen.
+type limiterEntry struct {
+	state    limitState
+	lastSeen time.Time
+}
+
+// memoryLimiter is a Limiter that keeps per-client state in memory and forgets clients that
+// have been idle for idleTTL.
+type memoryLimiter struct {
+	mu        sync.Mutex
+	newState  func() limitState
+	clients   map[string]*limiterEntry
+	idleTTL   time.Duration
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// newMemoryLimiter returns a limiter applying limit with the given algorithm.
+func newMemoryLimiter(algorithm string, limit rateLimit, idleTTL time.Duration) (*memoryLimiter, error) {
+	if limit.Requests <= 0 || limit.Period <= 0 {
+		return nil, fmt.Errorf("rate limit must allow at least one request per period, got %d per %v", limit.Requests, limit.Period)
+	}
+	if limit.Burst <= 0 {
+		limit.Burst = limit.Requests
+	}
+
+	l := &memoryLimiter{clients: make(map[string]*limiterEntry), idleTTL: idleTTL, now: time.Now}
+	switch algorithm {
+	case algorithmTokenBucket:
+		rate := float64(limit.Requests) / limit.Period.Seconds()
+		l.newState = func() limitState { return &tokenBucket{rate: rate, burst: float64(limit.Burst)} }
+	case algorithmSlidingWindow:
+		l.newState = func() limitState { return &slidingWindow{limit: limit.Requests, period: limit.Period} }
+	default:
+		return nil, fmt.Errorf("unknown rate limiting algorithm %q", algorithm)
+	}
+	return l, nil
+}
+
+func (l *memoryLimiter) Allow(key string) rateDecision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	e, ok := l.clients[key]
+	if !ok {
+		e = &limiterEntry{state: l.newState()}
+		l.clients[key] = e
+	}
+	e.lastSeen = now
+	return e.state.allow(now)
+}
+
+func (l *memoryLimiter) Charge(key string, cost int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	e, ok := l.clients[key]
+	if !ok {
+		e = &limiterEntry{state: l.newState()}
+		l.clients[key] = e
+	}
+	e.lastSeen = now
+	e.state.charge(now, cost)
+}
+
+func (l *memoryLimiter) Peek(key string) rateDecision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e, ok := l.clients[key]; ok {
+		return e.state.peek(l.now())
+	}
+	return l.newState().peek(l.now())
+}
+
+// sweep forgets clients idle for longer than idleTTL. It runs at most once per idleTTL.
+// l.mu must be held.
+func (l *memoryLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.idleTTL {
+		return
+	}
+	l.lastSweep = now
+	for key, e := range l.clients {
+		if now.Sub(e.lastSeen) > l.idleTTL {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// size returns the number of clients being tracked.
+func (l *memoryLimiter) size() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.clients)
+}
+
+// keyFunc extracts part of the rate limiting key from a request, or "" if it does not apply.
+type keyFunc func(r *http.Request) string
+
+// keyFuncs are the key extractors rate limit policies can be configured with.
+var keyFuncs = map[string]keyFunc{
+	"ip":      clientIPKey,
+	"user":    userKey,
+	"api-key": apiKeyKey,
+	"route":   routeKey,
+	"client":  oauthClientKey,
+}
+
+// clientIPKey keys on the client's IP address, resolved through trusted proxies.
+func clientIPKey(r *http.Request) string {
+	return "ip:" + clientIP(r)
+}
+
+// userKey keys on the authenticated user.
+func userKey(r *http.Request) string {
+	if p, ok := PrincipalFromContext(r.Context()); ok {
+		return "user:" + p.UserID
+	}
+	return ""
+}
+
+// oauthClientKey keys on the OAuth client authenticated at the token endpoint. Public clients
+// have no secret, so anyone can send their client_id; they are keyed on the IP as well.
+func oauthClientKey(r *http.Request) string {
+	client := tokenRequestClient(r.Context())
+	switch {
+	case client == nil:
+		return ""
+	case client.AuthMethod == clientAuthNone:
+		return "client:" + client.ID + "|" + clientIPKey(r)
+	default:
+		return "client:" + client.ID
+	}
+}
+
+// apiKeyKey keys on the API key the request was made with.
+func apiKeyKey(r *http.Request) string {
+	if p, ok := PrincipalFromContext(r.Context()); ok && p.APIKeyID != "" {
+		return "api-key:" + p.APIKeyID
+	}
+	return ""
+}
+
+// routeTemplateContextKey overrides the route template routeKey sees, to compute the key a
+// request to another route would have.
+type routeTemplateContextKey struct{}
+
+// routeKey keys on the matched route's path template, such as /api/works/{id}.
+func routeKey(r *http.Request) string {
+	if tmpl, ok := r.Context().Value(routeTemplateContextKey{}).(string); ok {
+		return "route:" + tmpl
+	}
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			return "route:" + tmpl
+		}
+	}
+	return ""
+}
+
+// rateLimitPolicy limits requests with its own limiter, keyed by the combination of its key
+// extractors.
+type rateLimitPolicy struct {
+	name    string
+	limiter Limiter
+	keys    []keyFunc
+	// perRoute is set when the policy is keyed by route, giving each route its own allowance.
+	perRoute bool
+
+	mu     sync.Mutex
+	routes []string // Templates of the routes the policy limits.
+}
+
+// addRoute records that the policy limits route.
+func (p *rateLimitPolicy) addRoute(route *mux.Route) {
+	tmpl, err := route.GetPathTemplate()
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !containsString(p.routes, tmpl) {
+		p.routes = append(p.routes, tmpl)
+	}
+}
+
+// routeTemplates returns the templates of the routes the policy limits.
+func (p *rateLimitPolicy) routeTemplates() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.routes...)
+}
+
+// key returns the rate limiting key of r. Clients that none of the policy's extractors apply
+// to, such as anonymous callers of a policy keyed by user, are keyed by IP.
+func (p *rateLimitPolicy) key(r *http.Request) string {
+	var parts []string
+	for _, fn := range p.keys {
+		if part := fn(r); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return clientIPKey(r)
+	}
+	return strings.Join(parts, "|")
+}
+
+// rateLimitPolicies are the policies routes are limited by.
+type rateLimitPolicies struct {
+	Default *rateLimitPolicy // Book lookups and other endpoints.
+	Search  *rateLimitPolicy // /api/search, which is the most expensive upstream call.
+	Login   *rateLimitPolicy // /login and /auth/login, to slow down password guessing.
+	Token   *rateLimitPolicy // /oauth/token, which each client's backend calls for all its users.
+}
+
+// policyConfig is the configuration of a rate limit policy.
+type policyConfig struct {
+	algorithm string
+	limit     rateLimit
+	keys      []string
+	idleTTL   time.Duration
+	store     LimiterStore // Nil to keep the limiter's state in process.
+}
+
+// newLimiter returns a limiter for the configuration, keeping its state in the configured
+// store under prefix, or in process.
+func newLimiter(prefix string, cfg policyConfig) (Limiter, error) {
+	switch {
+	case cfg.store == nil:
+		return newMemoryLimiter(cfg.algorithm, cfg.limit, cfg.idleTTL)
+	case cfg.algorithm == algorithmSlidingWindow:
+		return newStoreLimiter(cfg.store, prefix, cfg.limit)
+	default:
+		return nil, fmt.Errorf("only the %s algorithm can use a rate limit store", algorithmSlidingWindow)
+	}
+}
+
+// newRateLimitPolicy builds a policy from its configuration.
+func newRateLimitPolicy(name string, cfg policyConfig) (*rateLimitPolicy, error) {
+	limiter, err := newLimiter("go-books:ratelimit:"+name, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s rate limit: %v", name, err)
+	}
+	p := &rateLimitPolicy{name: name, limiter: limiter}
+	for _, key := range cfg.keys {
+		fn, ok := keyFuncs[key]
+		if !ok {
+			return nil, fmt.Errorf("%s rate limit: unknown key %q", name, key)
+		}
+		p.keys = append(p.keys, fn)
+		p.perRoute = p.perRoute || key == "route"
+	}
+	return p, nil
+}
+
+// defaultPolicyConfigs are the built-in policy configurations by policy name.
+var defaultPolicyConfigs = map[string]policyConfig{
+	"default": {limit: rateLimit{Requests: 60, Period: time.Minute, Burst: 20}, keys: []string{"api-key", "user"}},
+	"search":  {limit: rateLimit{Requests: 30, Period: time.Minute, Burst: 10}, keys: []string{"api-key", "user", "route"}},
+	"login":   {limit: rateLimit{Requests: 10, Period: time.Minute, Burst: 5}, keys: []string{"ip"}},
+	"token":   {limit: rateLimit{Requests: 300, Period: time.Minute, Burst: 60}, keys: []string{"client"}},
+}
+
+// withDefaults fills in the algorithm and idle TTL if they are unset.
+func (cfg policyConfig) withDefaults() policyConfig {
+	if cfg.algorithm == "" && cfg.store != nil {
+		cfg.algorithm = algorithmSlidingWindow
+	} else if cfg.algorithm == "" {
+		cfg.algorithm = algorithmTokenBucket
+	}
+	if cfg.idleTTL == 0 {
+		cfg.idleTTL = 10 * time.Minute
+	}
+	return cfg
+}
+
+// newRateLimitPolicies builds the policies from their configurations by name.
+func newRateLimitPolicies(configs map[string]policyConfig) (rateLimitPolicies, error) {
+	policies := make(map[string]*rateLimitPolicy)
+	for name, cfg := range configs {
+		p, err := newRateLimitPolicy(name, cfg.withDefaults())
+		if err != nil {
+			return rateLimitPolicies{}, err
+		}
+		policies[name] = p
+	}
+	return rateLimitPolicies{Default: policies["default"], Search: policies["search"], Login: policies["login"], Token: policies["token"]}, nil
+}
+
+// newRateLimitPoliciesFromEnv builds the rate limit policies, keeping their state in store
+// unless it is nil. RATE_LIMIT_ALGORITHM and RATE_LIMIT_IDLE_TTL apply to all of them; each
+// policy reads <prefix>_REQUESTS, <prefix>_PERIOD, <prefix>_BURST and the comma-separated
+// <prefix>_KEY, where the prefix is RATE_LIMIT for the default policy, RATE_LIMIT_SEARCH,
+// RATE_LIMIT_LOGIN or RATE_LIMIT_TOKEN.
+func newRateLimitPoliciesFromEnv(store LimiterStore) (rateLimitPolicies, error) {
+	algorithm := os.Getenv("RATE_LIMIT_ALGORITHM")
+	idleTTL, err := envDuration("RATE_LIMIT_IDLE_TTL", 10*time.Minute)
+	if err != nil {
+		return rateLimitPolicies{}, err
+	}
+	if idleTTL <= 0 {
+		return rateLimitPolicies{}, fmt.Errorf("RATE_LIMIT_IDLE_TTL must be positive, got %s", idleTTL)
+	}
+
+	configs := make(map[string]policyConfig)
+	for name, cfg := range defaultPolicyConfigs {
+		prefix := "RATE_LIMIT_" + strings.ToUpper(name)
+		if name == "default" {
+			prefix = "RATE_LIMIT"
+		}
+		cfg.algorithm = algorithm
+		cfg.idleTTL = idleTTL
+		cfg.store = store
+		if cfg.limit.Requests, err = envInt(prefix+"_REQUESTS", cfg.limit.Requests); err != nil {
+			return rateLimitPolicies{}, err
+		}
+		if cfg.limit.Period, err = envDuration(prefix+"_PERIOD", cfg.limit.Period); err != nil {
+			return rateLimitPolicies{}, err
+		}
+		if cfg.limit.Burst, err = envInt(prefix+"_BURST", cfg.limit.Burst); err != nil {
+			return rateLimitPolicies{}, err
+		}
+		if keys := splitList(os.Getenv(prefix + "_KEY")); len(keys) > 0 {
+			cfg.keys = keys
+		}
+		configs[name] = cfg
+	}
+	return newRateLimitPolicies(configs)
+}
+
+// rateLimits holds the rate limit policies. It is replaced at startup by newRateLimitPoliciesFromEnv.
+var rateLimits = mustRateLimitPolicies(newRateLimitPolicies(defaultPolicyConfigs))
+
+// mustRateLimitPolicies panics if the policies could not be built; it is only used for the defaults.
+func mustRateLimitPolicies(p rateLimitPolicies, err error) rateLimitPolicies {
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// upstreamCallCost is what each call to the upstream adds to the cost of a request.
+// It is replaced at startup by upstreamCallCostFromEnv.
+var upstreamCallCost = 5
+
+// upstreamCallCostFromEnv reads RATE_LIMIT_UPSTREAM_COST, which must be at least 1 so that
+// upstream calls never cost less than cache hits.
+func upstreamCallCostFromEnv() (int, error) {
+	cost, err := envInt("RATE_LIMIT_UPSTREAM_COST", 5)
+	if err != nil {
+		return 0, err
+	}
+	if cost < 1 {
+		return 0, fmt.Errorf("RATE_LIMIT_UPSTREAM_COST must be at least 1, got %d", cost)
+	}
+	return cost, nil
+}
+
+// requestCost returns the cost of a request that made the fetches recorded in info. Requests
+// served from the cache cost 1; those that went to the upstream cost upstreamCallCost per call.
+func requestCost(info *fetchInfo) int {
+	if cost := info.UpstreamCalls() * upstreamCallCost; cost > 1 {
+		return cost
+	}
+	return 1
+}
+
+// rateLimitMiddleware returns middleware that rejects requests from clients exceeding the
+// policy's rate with 429 and Retry-After. Each request is allowed at a cost of 1; any further
+// cost of the upstream calls it made is charged once it has been handled. All responses carry
+// the client's allowance in RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers.
+// On authenticated routes it must run after jwtMiddleware.
+func rateLimitMiddleware(policy *rateLimitPolicy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := policy.key(r)
+			d := policy.limiter.Allow(key)
+			setRateLimitHeaders(w, d)
+			if !d.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(d.RetryAfter)))
+				http.Error(w, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
+
+			ctx, info := withFetchInfo(r.Context())
+			next.ServeHTTP(w, r.WithContext(ctx))
+			if extra := requestCost(info) - 1; extra > 0 {
+				policy.limiter.Charge(key, extra)
+			}
+		})
+	}
+}
+
+// handleLimited registers handler for path on router, rate limited by policy.
+func handleLimited(router *mux.Router, path string, policy *rateLimitPolicy, handler http.HandlerFunc) *mux.Route {
+	route := router.Handle(path, rateLimitMiddleware(policy)(handler))
+	policy.addRoute(route)
+	return route
+}
+
+// setRateLimitHeaders reports a rate limit decision in the RateLimit header fields of the
+// IETF draft (draft-ietf-httpapi-ratelimit-headers).
+func setRateLimitHeaders(w http.ResponseWriter, d rateDecision) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.Reset)))
+}
+
+// ceilSeconds rounds d up to whole seconds.
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// quotaUsage is a caller's usage of one rate limit policy.
+type quotaUsage struct {
+	Policy    string   `json:"policy"`
+	Routes    []string `json:"routes"`
+	Limit     int      `json:"limit"`
+	Remaining int      `json:"remaining"`
+	Reset     int      `json:"reset"` // Seconds until the full allowance is available.
+}
+
+// quotaResponse is the body of GET /api/me/quota.
+type quotaResponse struct {
+	Quotas []quotaUsage `json:"quotas"`
+	Plan   *planUsage   `json:"plan,omitempty"`
+}
+
+// quotaHandler reports the caller's current usage of every rate limit policy and of their
+// plan, if they have one. Policies that give each route its own allowance are reported once
+// per route. It does not use up any quota.
+func quotaHandler(w http.ResponseWriter, r *http.Request) {
+	usage := []quotaUsage{}
+	for _, policy := range []*rateLimitPolicy{rateLimits.Default, rateLimits.Search, rateLimits.Login, rateLimits.Token} {
+		routes := policy.routeTemplates()
+		sort.Strings(routes)
+		groups := [][]string{routes}
+		if policy.perRoute {
+			groups = groups[:0]
+			for _, route := range routes {
+				groups = append(groups, []string{route})
+			}
+		}
+		for _, group := range groups {
+			req := r
+			if len(group) == 1 {
+				req = r.WithContext(context.WithValue(r.Context(), routeTemplateContextKey{}, group[0]))
+			}
+			d := policy.limiter.Peek(policy.key(req))
+			usage = append(usage, quotaUsage{
+				Policy:    policy.name,
+				Routes:    group,
+				Limit:     d.Limit,
+				Remaining: d.Remaining,
+				Reset:     ceilSeconds(d.Reset),
+			})
+		}
+	}
+	resp := quotaResponse{Quotas: usage}
+	if p, ok := PrincipalFromContext(r.Context()); ok && plans != nil {
+		if plan, client := plans.planFor(p); plan != nil {
+			u := plans.usage(plan, client)
+			resp.Plan = &u
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, resp)
+}
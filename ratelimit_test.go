@@ -0,0 +1,504 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// newTestLimiter returns a limiter with a fake clock.
+func newTestLimiter(t *testing.T, algorithm string, limit rateLimit) (*memoryLimiter, *time.Time) {
+	t.Helper()
+	l, err := newMemoryLimiter(algorithm, limit, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+// useRateLimits swaps rateLimits for fresh default policies for the duration of a test, so
+// that requests made by other tests do not count against its limits.
+func useRateLimits(t *testing.T) {
+	t.Helper()
+	policies, err := newRateLimitPolicies(defaultPolicyConfigs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := rateLimits
+	rateLimits = policies
+	t.Cleanup(func() { rateLimits = original })
+}
+
+// allowed counts how many of n requests for key the limiter allows.
+func allowed(l Limiter, key string, n int) int {
+	count := 0
+	for i := 0; i < n; i++ {
+		if l.Allow(key).Allowed {
+			count++
+		}
+	}
+	return count
+}
+
+// TestTokenBucketLimiter tests bursts and refilling.
+func TestTokenBucketLimiter(t *testing.T) {
+	l, now := newTestLimiter(t, algorithmTokenBucket, rateLimit{Requests: 60, Period: time.Minute, Burst: 5})
+
+	if got := allowed(l, "a", 10); got != 5 {
+		t.Fatalf("expected a burst of 5, got %d", got)
+	}
+	if got := allowed(l, "b", 10); got != 5 {
+		t.Errorf("expected clients to be limited separately, got %d", got)
+	}
+
+	*now = now.Add(2 * time.Second)
+	if got := allowed(l, "a", 10); got != 2 {
+		t.Errorf("expected 2 requests after refilling for 2s at 1/s, got %d", got)
+	}
+
+	*now = now.Add(time.Hour)
+	if got := allowed(l, "a", 10); got != 5 {
+		t.Errorf("expected the bucket to refill to its burst only, got %d", got)
+	}
+}
+
+// TestSlidingWindowLimiter tests that at most Requests are allowed in any period.
+func TestSlidingWindowLimiter(t *testing.T) {
+	l, now := newTestLimiter(t, algorithmSlidingWindow, rateLimit{Requests: 10, Period: time.Minute})
+
+	if got := allowed(l, "a", 20); got != 10 {
+		t.Fatalf("expected 10 requests in the first window, got %d", got)
+	}
+
+	// Halfway through the next window, half of the previous window still counts.
+	*now = now.Add(90 * time.Second)
+	if got := allowed(l, "a", 20); got != 5 {
+		t.Errorf("expected 5 requests half a window later, got %d", got)
+	}
+
+	*now = now.Add(5 * time.Minute)
+	if got := allowed(l, "a", 20); got != 10 {
+		t.Errorf("expected a full allowance after being idle, got %d", got)
+	}
+}
+
+// TestLimiterEviction tests that idle clients are forgotten.
+func TestLimiterEviction(t *testing.T) {
+	l, now := newTestLimiter(t, algorithmTokenBucket, rateLimit{Requests: 1, Period: time.Minute})
+	l.idleTTL = 10 * time.Minute
+
+	for i := 0; i < 100; i++ {
+		l.Allow(fmt.Sprintf("client-%d", i))
+	}
+	*now = now.Add(5 * time.Minute)
+	l.Allow("recent")
+	if l.size() != 101 {
+		t.Fatalf("expected 101 clients, got %d", l.size())
+	}
+
+	*now = now.Add(6 * time.Minute)
+	l.Allow("new")
+	if l.size() != 2 {
+		t.Errorf("expected only the recent and new clients to remain, got %d", l.size())
+	}
+}
+
+// TestLimiterConcurrency hammers both limiters from many goroutines; run with -race. With the
+// clock frozen exactly the allowance must be granted, however the requests interleave.
+func TestLimiterConcurrency(t *testing.T) {
+	for _, algorithm := range []string{algorithmTokenBucket, algorithmSlidingWindow} {
+		t.Run(algorithm, func(t *testing.T) {
+			l, _ := newTestLimiter(t, algorithm, rateLimit{Requests: 50, Period: time.Minute})
+
+			var granted [4]int64
+			var wg sync.WaitGroup
+			for g := 0; g < 64; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					for i := 0; i < 100; i++ {
+						key := g % len(granted)
+						if l.Allow(fmt.Sprintf("client-%d", key)).Allowed {
+							atomic.AddInt64(&granted[key], 1)
+						}
+					}
+				}(g)
+			}
+			wg.Wait()
+
+			for key, n := range granted {
+				if n != 50 {
+					t.Errorf("client-%d: expected 50 requests to be allowed, got %d", key, n)
+				}
+			}
+		})
+	}
+}
+
+// TestRateLimitMiddleware tests that the middleware rejects requests over the limit with 429.
+func TestRateLimitMiddleware(t *testing.T) {
+	l, _ := newTestLimiter(t, algorithmTokenBucket, rateLimit{Requests: 2, Period: time.Minute})
+	policy := &rateLimitPolicy{name: "test", limiter: l, keys: []keyFunc{clientIPKey}}
+	handler := rateLimitMiddleware(policy)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		status                  int
+		remaining, reset, retry string
+	}{
+		{http.StatusOK, "1", "30", ""},
+		{http.StatusOK, "0", "60", ""},
+		{http.StatusTooManyRequests, "0", "60", "30"},
+	}
+	for i, tc := range tests {
+		req := httptest.NewRequest("GET", "/vulnerable", nil)
+		// Each request comes from a new connection; only the IP counts.
+		req.RemoteAddr = fmt.Sprintf("192.0.2.1:%d", 40000+i)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tc.status {
+			t.Errorf("request %d: expected %d, got %d", i, tc.status, rr.Code)
+		}
+		h := rr.Header()
+		if h.Get("RateLimit-Limit") != "2" || h.Get("RateLimit-Remaining") != tc.remaining || h.Get("RateLimit-Reset") != tc.reset {
+			t.Errorf("request %d: expected limit 2, remaining %s and reset %s, got %s, %s and %s", i, tc.remaining, tc.reset,
+				h.Get("RateLimit-Limit"), h.Get("RateLimit-Remaining"), h.Get("RateLimit-Reset"))
+		}
+		if got := h.Get("Retry-After"); got != tc.retry {
+			t.Errorf("request %d: expected Retry-After %q, got %q", i, tc.retry, got)
+		}
+	}
+}
+
+// TestRateDecision tests the allowance reported by each algorithm, and that Peek reports it
+// without using any up.
+func TestRateDecision(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		limit     rateLimit
+		requests  int
+		elapsed   time.Duration
+		want      rateDecision
+	}{
+		{algorithmTokenBucket, rateLimit{Requests: 60, Period: time.Minute, Burst: 10}, 0, 0,
+			rateDecision{Allowed: true, Limit: 10, Remaining: 10}},
+		{algorithmTokenBucket, rateLimit{Requests: 60, Period: time.Minute, Burst: 10}, 4, 0,
+			rateDecision{Allowed: true, Limit: 10, Remaining: 6, Reset: 4 * time.Second}},
+		{algorithmTokenBucket, rateLimit{Requests: 60, Period: time.Minute, Burst: 10}, 10, 500 * time.Millisecond,
+			rateDecision{Limit: 10, Reset: 9500 * time.Millisecond, RetryAfter: 500 * time.Millisecond}},
+		{algorithmSlidingWindow, rateLimit{Requests: 10, Period: time.Minute}, 0, 0,
+			rateDecision{Allowed: true, Limit: 10, Remaining: 10}},
+		{algorithmSlidingWindow, rateLimit{Requests: 10, Period: time.Minute}, 4, 15 * time.Second,
+			rateDecision{Allowed: true, Limit: 10, Remaining: 6, Reset: 105 * time.Second}},
+		// Full in the first window: the count must fall to 9 in the next, a tenth of the way in.
+		{algorithmSlidingWindow, rateLimit{Requests: 10, Period: time.Minute}, 10, 15 * time.Second,
+			rateDecision{Limit: 10, Reset: 105 * time.Second, RetryAfter: 51 * time.Second}},
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%s after %d", tc.algorithm, tc.requests), func(t *testing.T) {
+			l, now := newTestLimiter(t, tc.algorithm, tc.limit)
+			allowed(l, "a", tc.requests)
+			*now = now.Add(tc.elapsed)
+
+			got := l.Peek("a")
+			if got.Allowed != tc.want.Allowed || got.Limit != tc.want.Limit || got.Remaining != tc.want.Remaining ||
+				!closeTo(got.Reset, tc.want.Reset) || !closeTo(got.RetryAfter, tc.want.RetryAfter) {
+				t.Errorf("expected %+v, got %+v", tc.want, got)
+			}
+			if again := l.Peek("a"); again.Remaining != got.Remaining {
+				t.Errorf("expected Peek not to use up the allowance, remaining went from %d to %d", got.Remaining, again.Remaining)
+			}
+		})
+	}
+}
+
+// closeTo reports whether two durations are equal to within floating-point error.
+func closeTo(a, b time.Duration) bool {
+	d := a - b
+	return d > -time.Millisecond && d < time.Millisecond
+}
+
+// TestRateLimitCost tests that requests are charged the cost of their upstream calls once
+// handled, for both algorithms.
+func TestRateLimitCost(t *testing.T) {
+	for _, algorithm := range []string{algorithmTokenBucket, algorithmSlidingWindow} {
+		t.Run(algorithm, func(t *testing.T) {
+			l, _ := newTestLimiter(t, algorithm, rateLimit{Requests: 12, Period: time.Hour})
+			policy := &rateLimitPolicy{name: "test", limiter: l, keys: []keyFunc{clientIPKey}}
+			handler := rateLimitMiddleware(policy)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("fetch") == "upstream" {
+					recordFetch(r.Context(), "MISS", true)
+				}
+			}))
+
+			// Two upstream calls cost 5 each, leaving room for two cache hits.
+			for i, fetch := range []string{"upstream", "upstream", "hit", "hit", "hit"} {
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/search?fetch="+fetch, nil))
+				want := http.StatusOK
+				if i == 4 {
+					want = http.StatusTooManyRequests
+				}
+				if rr.Code != want {
+					t.Errorf("request %d (%s): expected %d, got %d", i, fetch, want, rr.Code)
+				}
+			}
+		})
+	}
+}
+
+// TestLimiterRefund tests that refunds never raise a client's allowance above the full one, for
+// both algorithms.
+func TestLimiterRefund(t *testing.T) {
+	for _, algorithm := range []string{algorithmTokenBucket, algorithmSlidingWindow} {
+		t.Run(algorithm, func(t *testing.T) {
+			l, _ := newTestLimiter(t, algorithm, rateLimit{Requests: 5, Period: time.Minute, Burst: 5})
+			l.Allow("a")
+			l.Charge("a", -10)
+			if d := l.Peek("a"); d.Remaining != 5 {
+				t.Errorf("expected the refund to restore the full allowance of 5 only, got %d", d.Remaining)
+			}
+			if got := allowed(l, "a", 20); got != 5 {
+				t.Errorf("expected 5 requests after the refund, got %d", got)
+			}
+		})
+	}
+}
+
+// TestRateLimitPolicyKey tests combining key extractors.
+func TestRateLimitPolicyKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		keys      []string
+		principal *Principal
+		want      string
+	}{
+		{"ip", []string{"ip"}, nil, "ip:192.0.2.1"},
+		{"anonymous user falls back to ip", []string{"user"}, nil, "ip:192.0.2.1"},
+		{"user", []string{"api-key", "user"}, &Principal{UserID: "u1"}, "user:u1"},
+		{"api key", []string{"api-key", "user"}, &Principal{UserID: "u1", APIKeyID: "k1"}, "api-key:k1|user:u1"},
+		{"user and route", []string{"user", "route"}, &Principal{UserID: "u1"}, "user:u1|route:/api/works/{id}"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			policy, err := newRateLimitPolicy("test", policyConfig{
+				algorithm: algorithmTokenBucket,
+				limit:     rateLimit{Requests: 1, Period: time.Minute},
+				keys:      tc.keys,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got string
+			router := mux.NewRouter()
+			router.HandleFunc("/api/works/{id}", func(w http.ResponseWriter, r *http.Request) {
+				if tc.principal != nil {
+					r = r.WithContext(withPrincipal(r.Context(), tc.principal))
+				}
+				got = policy.key(r)
+			})
+			req := httptest.NewRequest("GET", "/api/works/OL1W", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			router.ServeHTTP(httptest.NewRecorder(), req)
+			if got != tc.want {
+				t.Errorf("expected key %q, got %q", tc.want, got)
+			}
+		})
+	}
+
+	if _, err := newRateLimitPolicy("test", policyConfig{algorithm: algorithmTokenBucket, limit: rateLimit{Requests: 1, Period: time.Minute}, keys: []string{"cookie"}}); err == nil {
+		t.Error("expected an unknown key extractor to be an error")
+	}
+}
+
+// TestRateLimitPolicies tests that search and login have their own limits, and that users
+// are limited separately.
+func TestRateLimitPolicies(t *testing.T) {
+	useRateLimits(t)
+	useRevocationStore(t, newMemoryRevocationStore())
+	useProvider(t, &fakeProvider{
+		search: func(q SearchQuery) (*SearchResult, error) {
+			return &SearchResult{Docs: []Book{{Title: "Test Book"}}}, nil
+		},
+		getWork: func(id string) (*Work, error) { return &Work{Key: id}, nil },
+	})
+	alice, _ := issueAccessToken(&User{ID: "alice"}, "", tokenGrant{})
+	bob, _ := issueAccessToken(&User{ID: "bob"}, "", tokenGrant{})
+
+	count := func(target, token string, n int) int {
+		ok := 0
+		for i := 0; i < n; i++ {
+			if authorizedRequest("GET", target, token).Code == http.StatusOK {
+				ok++
+			}
+		}
+		return ok
+	}
+
+	search := defaultPolicyConfigs["search"].limit.Burst
+	if got := count("/api/search?q=go", alice, search+5); got != search {
+		t.Errorf("expected %d searches to be allowed, got %d", search, got)
+	}
+	if got := count("/api/works/OL1W", alice, 5); got != 5 {
+		t.Errorf("expected work lookups to have their own limit, got %d allowed", got)
+	}
+	if got := count("/api/search?q=go", bob, 1); got != 1 {
+		t.Errorf("expected other users to have their own limit, got %d allowed", got)
+	}
+
+	login := defaultPolicyConfigs["login"].limit.Burst
+	limited := 0
+	for i := 0; i < login+5; i++ {
+		rr := httptest.NewRecorder()
+		newRouter().ServeHTTP(rr, httptest.NewRequest("POST", "/auth/login", nil))
+		if rr.Code == http.StatusTooManyRequests {
+			limited++
+		}
+	}
+	if limited != 5 {
+		t.Errorf("expected 5 login attempts to be rate limited, got %d", limited)
+	}
+	// Registration and refresh are unauthenticated too, and share the login limit.
+	for _, target := range []string{"/register", "/auth/refresh"} {
+		rr := httptest.NewRecorder()
+		newRouter().ServeHTTP(rr, httptest.NewRequest("POST", target, nil))
+		if rr.Code != http.StatusTooManyRequests {
+			t.Errorf("expected %s to be rate limited, got %d", target, rr.Code)
+		}
+	}
+}
+
+// TestNewMemoryLimiter tests configuration validation.
+func TestNewMemoryLimiter(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		limit     rateLimit
+		wantErr   bool
+	}{
+		{algorithmTokenBucket, rateLimit{Requests: 1, Period: time.Second}, false},
+		{algorithmSlidingWindow, rateLimit{Requests: 1, Period: time.Second}, false},
+		{"leaky-bucket", rateLimit{Requests: 1, Period: time.Second}, true},
+		{algorithmTokenBucket, rateLimit{Requests: 0, Period: time.Second}, true},
+		{algorithmTokenBucket, rateLimit{Requests: 1}, true},
+	}
+	for _, tc := range tests {
+		_, err := newMemoryLimiter(tc.algorithm, tc.limit, time.Minute)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s %+v: expected error %v, got %v", tc.algorithm, tc.limit, tc.wantErr, err)
+		}
+	}
+}
+
+// TestNewRateLimitPoliciesFromEnv tests that invalid rate limit settings are rejected at startup.
+func TestNewRateLimitPoliciesFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		idleTTL string
+		wantErr bool
+	}{
+		{"default idle TTL", "", false},
+		{"custom idle TTL", "1m", false},
+		{"zero idle TTL", "0", true},
+		{"negative idle TTL", "-1m", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("RATE_LIMIT_IDLE_TTL", tc.idleTTL)
+			if _, err := newRateLimitPoliciesFromEnv(nil); (err != nil) != tc.wantErr {
+				t.Errorf("expected error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+// TestUpstreamCallCostFromEnv tests that an upstream cost below 1 is rejected at startup.
+func TestUpstreamCallCostFromEnv(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{"", 5, false},
+		{"1", 1, false},
+		{"10", 10, false},
+		{"0", 0, true},
+		{"-5", 0, true},
+		{"lots", 0, true},
+	}
+	for _, tc := range tests {
+		t.Setenv("RATE_LIMIT_UPSTREAM_COST", tc.value)
+		cost, err := upstreamCallCostFromEnv()
+		if (err != nil) != tc.wantErr || cost != tc.want {
+			t.Errorf("%q: expected %d and error %v, got %d, %v", tc.value, tc.want, tc.wantErr, cost, err)
+		}
+	}
+}
+
+// TestQuotaHandler tests that the caller's usage of each policy is reported, per route for
+// policies keyed by route, without using any of it up.
+func TestQuotaHandler(t *testing.T) {
+	useRateLimits(t)
+	useRevocationStore(t, newMemoryRevocationStore())
+	useProvider(t, &fakeProvider{
+		search: func(q SearchQuery) (*SearchResult, error) { return &SearchResult{}, nil },
+	})
+	token, _ := issueAccessToken(&User{ID: "alice"}, "", tokenGrant{})
+	for i := 0; i < 3; i++ {
+		authorizedRequest("GET", "/api/search?q=go", token)
+	}
+
+	quota := func() map[string]quotaUsage {
+		rr := authorizedRequest("GET", "/api/me/quota", token)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+		var resp struct {
+			Quotas []quotaUsage `json:"quotas"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		byRoute := make(map[string]quotaUsage)
+		for _, q := range resp.Quotas {
+			byRoute[q.Policy+" "+strings.Join(q.Routes, ",")] = q
+		}
+		return byRoute
+	}
+
+	got := quota()
+	search, ok := got["search /api/search"]
+	if !ok {
+		t.Fatalf("expected the search route to be reported, got %+v", got)
+	}
+	if burst := defaultPolicyConfigs["search"].limit.Burst; search.Limit != burst || search.Remaining != burst-3 || search.Reset != 6 {
+		t.Errorf("expected 3 of %d searches used, resetting in 6s, got %+v", burst, search)
+	}
+	def, ok := got["default /api/editions/{id},/api/works/{id},/vulnerable"]
+	if !ok {
+		t.Fatalf("expected the default policy's routes to be reported together, got %+v", got)
+	}
+	if def.Remaining != def.Limit {
+		t.Errorf("expected the default allowance to be unused, got %+v", def)
+	}
+	login := false
+	for _, q := range got {
+		login = login || (q.Policy == "login" && containsString(q.Routes, "/auth/login"))
+	}
+	if !login {
+		t.Errorf("expected the login policy to be reported, got %+v", got)
+	}
+
+	if again := quota()["search /api/search"]; again.Remaining != search.Remaining {
+		t.Errorf("expected checking the quota not to use it up, remaining went from %d to %d", search.Remaining, again.Remaining)
+	}
+}
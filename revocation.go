@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+)
+
+// RevocationStore records revoked access tokens until they would have expired anyway.
+// Implementations must be safe for concurrent use.
+type RevocationStore interface {
+	// Revoke revokes the token with the given jti, which expires at expiresAt.
+	Revoke(jti string, expiresAt time.Time) error
+	// RevokeUser revokes every token issued to userID up to and including the second of before.
+	// Tokens issued later, e.g. after the user logs in again, are not affected.
+	RevokeUser(userID string, before time.Time) error
+	// RevokeSession revokes every token issued with the given session ID in its sid claim.
+	RevokeSession(sessionID string) error
+	// IsRevoked reports whether a token with the given jti, subject, session ID and issue time
+	// is revoked.
+	IsRevoked(jti, userID, sessionID string, issuedAt time.Time) (bool, error)
+}
+
+// memoryRevocationStore is a RevocationStore that keeps revocations in memory.
+type memoryRevocationStore struct {
+	mu        sync.Mutex
+	tokens    map[string]time.Time // jti -> token expiry.
+	users     map[string]userRevocation
+	sessions  map[string]time.Time // Session ID -> expiry of its last token.
+	maxTTL    func() time.Duration // Longest lifetime of an access token.
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// userRevocation revokes a user's tokens issued up to before. It is dropped at expiresAt,
+// once every such token has expired.
+type userRevocation struct {
+	before    time.Time
+	expiresAt time.Time
+}
+
+// newMemoryRevocationStore returns an empty in-memory revocation store.
+func newMemoryRevocationStore() *memoryRevocationStore {
+	return &memoryRevocationStore{
+		tokens:   make(map[string]time.Time),
+		users:    make(map[string]userRevocation),
+		sessions: make(map[string]time.Time),
+		maxTTL:   func() time.Duration { return tokenSettings.accessTTL },
+		now:      time.Now,
+	}
+}
+
+func (s *memoryRevocationStore) Revoke(jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep()
+	s.tokens[jti] = expiresAt
+	return nil
+}
+
+func (s *memoryRevocationStore) RevokeUser(userID string, before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep()
+	s.users[userID] = userRevocation{before: before, expiresAt: before.Add(s.maxTTL())}
+	return nil
+}
+
+func (s *memoryRevocationStore) RevokeSession(sessionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep()
+	s.sessions[sessionID] = s.now().Add(s.maxTTL())
+	return nil
+}
+
+func (s *memoryRevocationStore) IsRevoked(jti, userID, sessionID string, issuedAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tokens[jti]; ok {
+		return true, nil
+	}
+	if _, ok := s.sessions[sessionID]; ok && sessionID != "" {
+		return true, nil
+	}
+	if u, ok := s.users[userID]; ok && issuedAt.Unix() <= u.before.Unix() {
+		return true, nil
+	}
+	return false, nil
+}
+
+// sweep drops revocations of tokens that have expired anyway. It runs at most once a minute.
+// s.mu must be held.
+func (s *memoryRevocationStore) sweep() {
+	now := s.now()
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for jti, expiresAt := range s.tokens {
+		if now.After(expiresAt) {
+			delete(s.tokens, jti)
+		}
+	}
+	for userID, u := range s.users {
+		if now.After(u.expiresAt) {
+			delete(s.users, userID)
+		}
+	}
+	for sessionID, expiresAt := range s.sessions {
+		if now.After(expiresAt) {
+			delete(s.sessions, sessionID)
+		}
+	}
+}
+
+// revokedTokens holds the revoked access tokens.
+var revokedTokens RevocationStore = newMemoryRevocationStore()
+
+// checkNotRevoked returns an error if the access token with claims has been revoked.
+func checkNotRevoked(claims jwt.MapClaims) error {
+	jti := stringClaim(claims, "jti")
+	if jti == "" {
+		return errors.New("token has no jti")
+	}
+	revoked, err := revokedTokens.IsRevoked(jti, stringClaim(claims, "sub"), stringClaim(claims, "sid"), claimTime(claims, "iat"))
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return errors.New("token has been revoked")
+	}
+	return nil
+}
+
+// claimTime returns a NumericDate claim as a time, or the zero time if it is missing.
+func claimTime(claims jwt.MapClaims, name string) time.Time {
+	if v, ok := claims[name].(float64); ok {
+		return time.Unix(int64(v), 0)
+	}
+	return time.Time{}
+}
+
+// bearerToken returns the token from an "Authorization: Bearer <token>" header.
+func bearerToken(r *http.Request) (string, error) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return "", errors.New("Missing Authorization header")
+	}
+	// Expected format: "Bearer <token>"
+	parts := strings.Split(authHeader, " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return "", errors.New("Invalid Authorization header format")
+	}
+	return parts[1], nil
+}
+
+// logoutHandler revokes the access token the request was made with, together with the other
+// access and refresh tokens of its session. It must run after jwtMiddleware.
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := tokenPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	if err := revokedTokens.Revoke(p.TokenID, p.ExpiresAt); err != nil {
+		http.Error(w, "Error revoking token", http.StatusInternalServerError)
+		return
+	}
+	if p.SessionID != "" {
+		if err := revokeSession(p.SessionID); err != nil {
+			http.Error(w, "Error revoking session", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeSession revokes the refresh tokens of a token family, and the access tokens issued with
+// them.
+func revokeSession(familyID string) error {
+	if err := refreshTokens.RevokeFamily(familyID); err != nil {
+		return err
+	}
+	return revokedTokens.RevokeSession(familyID)
+}
+
+// revokeAllSessions revokes every access token, refresh token and API key issued to a user so far.
+func revokeAllSessions(userID string) error {
+	if err := revokedTokens.RevokeUser(userID, time.Now()); err != nil {
+		return err
+	}
+	if err := refreshTokens.RevokeUser(userID); err != nil {
+		return err
+	}
+	return revokeUserAPIKeys(userID)
+}
+
+// revokeSessionsHandler revokes all sessions of the user named in the path.
+func revokeSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := userStore.GetByID(mux.Vars(r)["id"])
+	if errors.Is(err, ErrUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error looking up user", http.StatusInternalServerError)
+		return
+	}
+
+	if err := revokeAllSessions(user.ID); err != nil {
+		http.Error(w, "Error revoking sessions", http.StatusInternalServerError)
+		return
+	}
+	auditLog(r).Infof("Revoked all sessions of user %s (%s)", user.ID, user.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
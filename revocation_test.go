@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// useRevocationStore swaps revokedTokens for the duration of a test.
+func useRevocationStore(t *testing.T, store RevocationStore) {
+	original := revokedTokens
+	revokedTokens = store
+	t.Cleanup(func() { revokedTokens = original })
+}
+
+// authorizedRequest sends a request with a bearer token through the application router.
+func authorizedRequest(method, target, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+// TestMemoryRevocationStore tests revoking single tokens and all of a user's or a session's
+// tokens, and that revocations are dropped once the tokens have expired.
+func TestMemoryRevocationStore(t *testing.T) {
+	store := newMemoryRevocationStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	store.maxTTL = func() time.Duration { return time.Hour }
+
+	store.Revoke("jti-1", now.Add(time.Hour))
+	store.RevokeUser("user-1", now)
+	store.RevokeSession("session-1")
+
+	tests := []struct {
+		name      string
+		jti       string
+		userID    string
+		sessionID string
+		issuedAt  time.Time
+		want      bool
+	}{
+		{"revoked token", "jti-1", "user-2", "", now, true},
+		{"other token", "jti-2", "user-2", "", now, false},
+		{"user token issued before", "jti-3", "user-1", "", now.Add(-time.Minute), true},
+		{"user token issued in the same second", "jti-3", "user-1", "", now, true},
+		{"user token issued after", "jti-3", "user-1", "", now.Add(time.Second), false},
+		{"session token", "jti-5", "user-2", "session-1", now, true},
+		{"other session token", "jti-5", "user-2", "session-2", now, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := store.IsRevoked(tc.jti, tc.userID, tc.sessionID, tc.issuedAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("expected revoked %v, got %v", tc.want, got)
+			}
+		})
+	}
+
+	// Once the tokens would have expired the next write sweeps their revocations.
+	now = now.Add(2 * time.Hour)
+	store.Revoke("jti-4", now.Add(time.Hour))
+	if len(store.tokens) != 1 || len(store.users) != 0 || len(store.sessions) != 0 {
+		t.Errorf("expected expired revocations to be dropped, got %d tokens, %d users and %d sessions", len(store.tokens), len(store.users), len(store.sessions))
+	}
+}
+
+// TestLogoutHandler tests that logging out revokes the access token and the rest of its session.
+func TestLogoutHandler(t *testing.T) {
+	user := newTestUser(t, "reader", "readerpassword")
+	useRefreshTokenStore(t, newMemoryRefreshTokenStore())
+	useRevocationStore(t, newMemoryRevocationStore())
+
+	session, err := issueTokens(user, "", tokenGrant{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := postRefresh(session.RefreshToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected refresh to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var refreshed tokenResponse
+	if err := json.NewDecoder(rr.Body).Decode(&refreshed); err != nil {
+		t.Fatal(err)
+	}
+	other, err := issueTokens(user, "", tokenGrant{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rr := authorizedRequest("POST", "/auth/logout", session.AccessToken); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected logout to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := authorizedRequest("GET", "/api/cache/stats", session.AccessToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected the logged out token to be rejected, got %d", rr.Code)
+	}
+	if rr := authorizedRequest("POST", "/auth/logout", session.AccessToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected a second logout to be rejected, got %d", rr.Code)
+	}
+	if rr := authorizedRequest("GET", "/api/cache/stats", refreshed.AccessToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected the session's other access tokens to be revoked, got %d", rr.Code)
+	}
+	if rr := postRefresh(refreshed.RefreshToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected the session's refresh token to be revoked, got %d", rr.Code)
+	}
+
+	// Other sessions of the same user are unaffected.
+	if rr := authorizedRequest("GET", "/api/cache/stats", other.AccessToken); rr.Code == http.StatusUnauthorized {
+		t.Errorf("expected another session's token to keep working")
+	}
+	if rr := postRefresh(other.RefreshToken); rr.Code != http.StatusOK {
+		t.Errorf("expected another session's refresh token to keep working, got %d", rr.Code)
+	}
+}
+
+// TestRevokeSessionsHandler tests that an admin can revoke all sessions and API keys of a user.
+func TestRevokeSessionsHandler(t *testing.T) {
+	store := newMemoryUserStore()
+	useUserStore(t, store)
+	useRefreshTokenStore(t, newMemoryRefreshTokenStore())
+	useRevocationStore(t, newMemoryRevocationStore())
+	useAPIKeyStore(t, newMemoryAPIKeyStore())
+
+	admin, err := registerUser(store, "admin", "adminpassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	useAdminUserIDs(t, admin.ID)
+	reader, err := registerUser(store, "reader", "readerpassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminTokens, _ := issueTokens(admin, "", tokenGrant{})
+	first, _ := issueTokens(reader, "", tokenGrant{})
+	second, _ := issueTokens(reader, "", tokenGrant{})
+	key, _, err := createAPIKey(reader, grantedScopes(reader), "script", []string{scopeBooksRead}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticateAPIKey(key); err != nil {
+		t.Fatalf("expected the API key to work before revocation, got %v", err)
+	}
+
+	target := "/api/admin/users/" + reader.ID + "/revoke-sessions"
+	if rr := authorizedRequest("POST", target, first.AccessToken); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected a non-admin to be forbidden, got %d", rr.Code)
+	}
+	if rr := authorizedRequest("POST", "/api/admin/users/unknown/revoke-sessions", adminTokens.AccessToken); rr.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown user to be not found, got %d", rr.Code)
+	}
+	if rr := authorizedRequest("POST", target, adminTokens.AccessToken); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected the admin to revoke the sessions, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	for _, session := range []tokenResponse{first, second} {
+		if rr := authorizedRequest("GET", "/api/cache/stats", session.AccessToken); rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected a revoked access token to be rejected, got %d", rr.Code)
+		}
+		if rr := postRefresh(session.RefreshToken); rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected a revoked refresh token to be rejected, got %d", rr.Code)
+		}
+	}
+	if _, err := authenticateAPIKey(key); !errors.Is(err, ErrInvalidAPIKey) {
+		t.Errorf("expected a revoked API key to be rejected, got %v", err)
+	}
+	if rr := authorizedRequest("GET", "/api/cache/stats", adminTokens.AccessToken); rr.Code == http.StatusUnauthorized {
+		t.Errorf("expected the admin's own session to keep working")
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// SearchQuery holds the criteria for a book search. All non-empty criteria must match.
+type SearchQuery struct {
+	Text      string // Free-text query matched against any field.
+	Author    string
+	Title     string
+	Subject   string
+	ISBN      string
+	Publisher string
+	Language  string // ISO 639-2/MARC language code, e.g. "eng".
+
+	// FirstPublishYearMin and FirstPublishYearMax bound the first publication year, inclusive.
+	// Zero means unbounded.
+	FirstPublishYearMin int
+	FirstPublishYearMax int
+
+	Page  int        // 1-based page number.
+	Limit int        // Results per page.
+	Sort  SearchSort // Empty for the provider's relevance order.
+}
+
+// SearchSort is the order of search results.
+type SearchSort string
+
+// Supported search orders.
+const (
+	SortNewest   SearchSort = "new"
+	SortOldest   SearchSort = "old"
+	SortTitle    SearchSort = "title"
+	SortRating   SearchSort = "rating"
+	SortEditions SearchSort = "editions"
+)
+
+// Pagination defaults and bounds for /api/search.
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// errNoSearchCriteria is returned by parseSearchQuery when no criterion was given.
+var errNoSearchCriteria = errors.New("at least one of 'q', 'author', 'title', 'subject', 'isbn', 'publisher', " +
+	"'language' or 'first_publish_year' is required")
+
+// parseSearchQuery builds a SearchQuery from the /api/search query parameters.
+// first_publish_year is either a single year ("1954") or an inclusive range ("1950-1960",
+// "1950-", "-1960").
+func parseSearchQuery(params url.Values) (SearchQuery, error) {
+	get := func(name string) string { return strings.TrimSpace(params.Get(name)) }
+
+	q := SearchQuery{
+		Text:      get("q"),
+		Author:    get("author"),
+		Title:     get("title"),
+		Subject:   get("subject"),
+		Publisher: get("publisher"),
+		Language:  strings.ToLower(get("language")),
+	}
+
+	if isbn := get("isbn"); isbn != "" {
+		q.ISBN = normalizeISBN(isbn)
+		if q.ISBN == "" {
+			return SearchQuery{}, fmt.Errorf("invalid 'isbn' %q", isbn)
+		}
+	}
+
+	if years := get("first_publish_year"); years != "" {
+		min, max, err := parseYearRange(years)
+		if err != nil {
+			return SearchQuery{}, fmt.Errorf("invalid 'first_publish_year' %q: %v", years, err)
+		}
+		q.FirstPublishYearMin, q.FirstPublishYearMax = min, max
+	}
+
+	if q.IsEmpty() {
+		return SearchQuery{}, errNoSearchCriteria
+	}
+
+	var err error
+	if q.Page, err = parseBoundedInt(get("page"), 1, 1, 1<<20); err != nil {
+		return SearchQuery{}, fmt.Errorf("invalid 'page': %v", err)
+	}
+	if q.Limit, err = parseBoundedInt(get("limit"), defaultSearchLimit, 1, maxSearchLimit); err != nil {
+		return SearchQuery{}, fmt.Errorf("invalid 'limit': %v", err)
+	}
+	switch sort := SearchSort(strings.ToLower(get("sort"))); sort {
+	case "", SortNewest, SortOldest, SortTitle, SortRating, SortEditions:
+		q.Sort = sort
+	default:
+		return SearchQuery{}, fmt.Errorf("invalid 'sort' %q: must be one of new, old, title, rating, editions", sort)
+	}
+	return q, nil
+}
+
+// parseBoundedInt parses an integer parameter between min and max, returning def if s is empty.
+func parseBoundedInt(s string, def, min, max int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("%q must be a number between %d and %d", s, min, max)
+	}
+	return n, nil
+}
+
+// Offset returns the zero-based index of the first result on q's page.
+func (q SearchQuery) Offset() int {
+	if q.Page < 1 {
+		return 0
+	}
+	return (q.Page - 1) * q.Limit
+}
+
+// parseYearRange parses "1954", "1950-1960", "1950-" or "-1960". Unbounded ends are returned as 0.
+func parseYearRange(s string) (min, max int, err error) {
+	from, to, isRange := strings.Cut(s, "-")
+	if !isRange {
+		to = from
+	}
+	if min, err = parseYear(from); err != nil {
+		return 0, 0, err
+	}
+	if max, err = parseYear(to); err != nil {
+		return 0, 0, err
+	}
+	if min == 0 && max == 0 {
+		return 0, 0, errors.New("empty range")
+	}
+	if min != 0 && max != 0 && min > max {
+		return 0, 0, errors.New("start of range is after its end")
+	}
+	return min, max, nil
+}
+
+// parseYear parses a year between 1 and 9999. An empty string is returned as 0.
+func parseYear(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	year, err := strconv.Atoi(s)
+	if err != nil || year < 1 || year > 9999 {
+		return 0, fmt.Errorf("%q is not a year", s)
+	}
+	return year, nil
+}
+
+// searchResponse is the /api/search response envelope.
+type searchResponse struct {
+	NumFound int         `json:"numFound"`
+	Start    int         `json:"start"`
+	Page     int         `json:"page"`
+	Limit    int         `json:"limit"`
+	Docs     []Book      `json:"docs"`
+	Links    searchLinks `json:"links"`
+}
+
+// searchLinks holds the URLs of neighbouring result pages. Absent pages are omitted.
+type searchLinks struct {
+	Self string `json:"self"`
+	Next string `json:"next,omitempty"`
+	Prev string `json:"prev,omitempty"`
+}
+
+// newSearchResponse wraps results for q in the response envelope, building page links from reqURL.
+func newSearchResponse(reqURL *url.URL, q SearchQuery, results *SearchResult) searchResponse {
+	pageURL := func(page int) string {
+		params := reqURL.Query()
+		params.Set("page", strconv.Itoa(page))
+		return reqURL.Path + "?" + params.Encode()
+	}
+
+	resp := searchResponse{
+		NumFound: results.NumFound,
+		Start:    results.Start,
+		Page:     q.Page,
+		Limit:    q.Limit,
+		Docs:     results.Docs,
+		Links:    searchLinks{Self: pageURL(q.Page)},
+	}
+	if resp.Docs == nil {
+		resp.Docs = []Book{}
+	}
+	if results.Start+len(results.Docs) < results.NumFound {
+		resp.Links.Next = pageURL(q.Page + 1)
+	}
+	if q.Page > 1 {
+		resp.Links.Prev = pageURL(q.Page - 1)
+	}
+	return resp
+}
+
+// IsEmpty reports whether q has no criteria.
+func (q SearchQuery) IsEmpty() bool {
+	return q.Text == "" && q.Author == "" && q.Title == "" && q.Subject == "" && q.ISBN == "" &&
+		q.Publisher == "" && q.Language == "" && q.FirstPublishYearMin == 0 && q.FirstPublishYearMax == 0
+}
+
+// String describes the criteria of q for messages and logs, e.g. `author="tolkien" title="hobbit"`.
+func (q SearchQuery) String() string {
+	var parts []string
+	add := func(name, value string) {
+		if value != "" {
+			parts = append(parts, fmt.Sprintf("%s=%q", name, value))
+		}
+	}
+	add("q", q.Text)
+	add("author", q.Author)
+	add("title", q.Title)
+	add("subject", q.Subject)
+	add("isbn", q.ISBN)
+	add("publisher", q.Publisher)
+	add("language", q.Language)
+	if q.FirstPublishYearMin != 0 || q.FirstPublishYearMax != 0 {
+		parts = append(parts, fmt.Sprintf("first_publish_year=%s-%s",
+			formatYear(q.FirstPublishYearMin), formatYear(q.FirstPublishYearMax)))
+	}
+	return strings.Join(parts, " ")
+}
+
+// formatYear formats a range bound, leaving unbounded (0) ends empty.
+func formatYear(year int) string {
+	if year == 0 {
+		return ""
+	}
+	return strconv.Itoa(year)
+}
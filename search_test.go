@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestParseSearchQuery tests parsing of the /api/search query parameters.
+func TestParseSearchQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    SearchQuery
+		wantErr string
+	}{
+		{name: "no criteria", query: "", wantErr: "at least one of"},
+		{name: "blank criteria", query: "author=+&title=", wantErr: "at least one of"},
+		{name: "author only", query: "author=tolkien", want: SearchQuery{Author: "tolkien"}},
+		{
+			name:  "all fields",
+			query: "q=ring&title=hobbit&subject=fantasy&isbn=978-0-618-64015-7&publisher=Allen&language=ENG",
+			want: SearchQuery{Text: "ring", Title: "hobbit", Subject: "fantasy", ISBN: "9780618640157",
+				Publisher: "Allen", Language: "eng"},
+		},
+		{name: "single year", query: "first_publish_year=1954", want: SearchQuery{FirstPublishYearMin: 1954, FirstPublishYearMax: 1954}},
+		{name: "year range", query: "first_publish_year=1950-1960", want: SearchQuery{FirstPublishYearMin: 1950, FirstPublishYearMax: 1960}},
+		{name: "open start", query: "first_publish_year=-1960", want: SearchQuery{FirstPublishYearMax: 1960}},
+		{name: "open end", query: "first_publish_year=1950-", want: SearchQuery{FirstPublishYearMin: 1950}},
+		{name: "reversed range", query: "first_publish_year=1960-1950", wantErr: "after its end"},
+		{name: "bad year", query: "first_publish_year=soon", wantErr: "is not a year"},
+		{name: "empty range", query: "first_publish_year=-", wantErr: "empty range"},
+		{name: "bad isbn", query: "isbn=12345", wantErr: "invalid 'isbn'"},
+		{
+			name:  "paging and sort",
+			query: "author=tolkien&page=3&limit=50&sort=New",
+			want:  SearchQuery{Author: "tolkien", Page: 3, Limit: 50, Sort: SortNewest},
+		},
+		{name: "zero page", query: "author=tolkien&page=0", wantErr: "invalid 'page'"},
+		{name: "limit too large", query: "author=tolkien&limit=1000", wantErr: "invalid 'limit'"},
+		{name: "unknown sort", query: "author=tolkien&sort=random", wantErr: "invalid 'sort'"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			params, err := url.ParseQuery(tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseSearchQuery(params)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.want.Page == 0 {
+				tc.want.Page = 1
+			}
+			if tc.want.Limit == 0 {
+				tc.want.Limit = defaultSearchLimit
+			}
+			if got != tc.want {
+				t.Errorf("expected %#v, got %#v", tc.want, got)
+			}
+		})
+	}
+}
+
+// TestNewSearchResponse tests the page links in the /api/search response envelope.
+func TestNewSearchResponse(t *testing.T) {
+	reqURL, _ := url.Parse("/api/search?author=tolkien&limit=2&page=2")
+	q := SearchQuery{Author: "tolkien", Page: 2, Limit: 2}
+
+	resp := newSearchResponse(reqURL, q, &SearchResult{NumFound: 5, Start: 2, Docs: make([]Book, 2)})
+	if resp.NumFound != 5 || resp.Start != 2 || resp.Page != 2 || resp.Limit != 2 {
+		t.Errorf("unexpected envelope %+v", resp)
+	}
+	if resp.Links.Self != "/api/search?author=tolkien&limit=2&page=2" {
+		t.Errorf("unexpected self link %q", resp.Links.Self)
+	}
+	if resp.Links.Next != "/api/search?author=tolkien&limit=2&page=3" {
+		t.Errorf("unexpected next link %q", resp.Links.Next)
+	}
+	if resp.Links.Prev != "/api/search?author=tolkien&limit=2&page=1" {
+		t.Errorf("unexpected prev link %q", resp.Links.Prev)
+	}
+
+	last := newSearchResponse(reqURL, SearchQuery{Page: 3, Limit: 2}, &SearchResult{NumFound: 5, Start: 4, Docs: make([]Book, 1)})
+	if last.Links.Next != "" {
+		t.Errorf("expected no next link on the last page, got %q", last.Links.Next)
+	}
+
+	first := newSearchResponse(reqURL, SearchQuery{Page: 1, Limit: 2}, &SearchResult{NumFound: 5, Docs: make([]Book, 2)})
+	if first.Links.Prev != "" {
+		t.Errorf("expected no prev link on the first page, got %q", first.Links.Prev)
+	}
+}
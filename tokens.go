@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrInvalidRefreshToken is returned for an unknown, expired or revoked refresh token.
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused is returned by RefreshTokenStore.Consume for a token that was already rotated.
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// tokenConfig controls the claims and lifetimes of issued tokens.
+type tokenConfig struct {
+	issuer     string
+	audience   string
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+}
+
+// tokenSettings configures issued tokens. It is replaced at startup by newTokenConfigFromEnv.
+var tokenSettings = tokenConfig{
+	issuer:     "go-books",
+	audience:   "go-books-api",
+	accessTTL:  15 * time.Minute,
+	refreshTTL: 30 * 24 * time.Hour,
+}
+
+// newTokenConfigFromEnv reads JWT_ISSUER, JWT_AUDIENCE, ACCESS_TOKEN_TTL and REFRESH_TOKEN_TTL.
+func newTokenConfigFromEnv() (tokenConfig, error) {
+	cfg := tokenSettings
+	if v := os.Getenv("JWT_ISSUER"); v != "" {
+		cfg.issuer = v
+	}
+	if v := os.Getenv("JWT_AUDIENCE"); v != "" {
+		cfg.audience = v
+	}
+	var err error
+	if cfg.accessTTL, err = envDuration("ACCESS_TOKEN_TTL", cfg.accessTTL); err != nil {
+		return tokenConfig{}, err
+	}
+	if cfg.accessTTL <= 0 {
+		return tokenConfig{}, fmt.Errorf("ACCESS_TOKEN_TTL must be positive, got %s", cfg.accessTTL)
+	}
+	if cfg.refreshTTL, err = envDuration("REFRESH_TOKEN_TTL", cfg.refreshTTL); err != nil {
+		return tokenConfig{}, err
+	}
+	if cfg.refreshTTL <= 0 {
+		return tokenConfig{}, fmt.Errorf("REFRESH_TOKEN_TTL must be positive, got %s", cfg.refreshTTL)
+	}
+	return cfg, nil
+}
+
+// tokenGrant describes what tokens are issued for: how the user authenticated and, for tokens
+// issued to an OAuth client, which client and scopes.
+type tokenGrant struct {
+	AMR      []string // Authentication methods (RFC 8176), such as amrPassword or amrMFA.
+	ClientID string   // The OAuth client the tokens are for; empty for the user's own logins.
+	Scopes   []string // Scopes the client asked for; ignored for the user's own logins.
+}
+
+// scopes returns the scopes to grant user: those the client asked for that the user has, plus
+// any OpenID Connect scopes asked for, or all the user's scopes for the user's own logins.
+// Clients only get the scopes they asked for, even if they asked for none.
+func (g tokenGrant) scopes(user *User) []string {
+	granted := grantedScopes(user)
+	if g.ClientID == "" {
+		return granted
+	}
+	scopes := []string{}
+	for _, scope := range g.Scopes {
+		if (containsString(granted, scope) || isOIDCScope(scope)) && !containsString(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+// issueAccessToken signs a short-lived JWT for user carrying the user's roles and the scopes of
+// grant. sessionID links the token to the refresh token family it was issued with, so logging
+// out can revoke both; it may be empty. The token records how the user authenticated in its
+// amr claim, and the client it was issued to in its client_id claim (RFC 9068), if any.
+func issueAccessToken(user *User, sessionID string, grant tokenGrant) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"jti":      newID(),
+		"sub":      user.ID,
+		"username": user.Username,
+		"roles":    grantedRoles(user),
+		"scope":    strings.Join(grant.scopes(user), " "),
+		"iss":      tokenSettings.issuer,
+		"aud":      tokenSettings.audience,
+		"iat":      now.Unix(),
+		"nbf":      now.Unix(),
+		"exp":      now.Add(tokenSettings.accessTTL).Unix(),
+	}
+	if sessionID != "" {
+		claims["sid"] = sessionID
+	}
+	if len(grant.AMR) > 0 {
+		claims["amr"] = grant.AMR
+	}
+	if grant.ClientID != "" {
+		claims["client_id"] = grant.ClientID
+	}
+	return signingKeys.sign(claims)
+}
+
+// parseAccessToken verifies the signature, lifetime, issuer and audience of an access token.
+// It does not check whether the token has been revoked; see checkNotRevoked.
+func parseAccessToken(tokenStr string) (jwt.MapClaims, error) {
+	token, err := signingKeys.parse(tokenStr, jwt.MapClaims{})
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	// MapClaims.Valid only checks exp and nbf when they are present; they are required here.
+	now := time.Now().Unix()
+	switch {
+	case !claims.VerifyExpiresAt(now, true):
+		return nil, errors.New("token is expired or has no expiry")
+	case !claims.VerifyNotBefore(now, true):
+		return nil, errors.New("token is not valid yet")
+	case !claims.VerifyIssuer(tokenSettings.issuer, true):
+		return nil, errors.New("token has the wrong issuer")
+	case !claims.VerifyAudience(tokenSettings.audience, true):
+		return nil, errors.New("token has the wrong audience")
+	}
+	return claims, nil
+}
+
+// RefreshToken is the server-side record of an opaque refresh token. Tokens issued by
+// rotating each other share a FamilyID.
+type RefreshToken struct {
+	Hash      string // SHA-256 of the token; the token itself is never stored.
+	FamilyID  string
+	UserID    string
+	Grant     tokenGrant // What the family was issued for; carried over on rotation.
+	ExpiresAt time.Time
+	Used      bool // Set once the token has been exchanged for a new one.
+	Revoked   bool
+}
+
+// RefreshTokenStore persists refresh token records. Implementations must be safe for concurrent use.
+type RefreshTokenStore interface {
+	// Save stores a new refresh token.
+	Save(t RefreshToken) error
+	// Consume atomically marks the token with the given hash as used and returns it. It returns
+	// ErrInvalidRefreshToken if the token is unknown, expired or revoked, and the token together
+	// with ErrRefreshTokenReused if it was already used.
+	Consume(hash string) (RefreshToken, error)
+	// RevokeFamily revokes every token in a family.
+	RevokeFamily(familyID string) error
+	// RevokeUser revokes every token issued to a user.
+	RevokeUser(userID string) error
+}
+
+// memoryRefreshTokenStore is a RefreshTokenStore that keeps tokens in memory, dropping
+// them once they expire.
+type memoryRefreshTokenStore struct {
+	mu        sync.Mutex
+	tokens    map[string]RefreshToken // By hash.
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// newMemoryRefreshTokenStore returns an empty in-memory refresh token store.
+func newMemoryRefreshTokenStore() *memoryRefreshTokenStore {
+	return &memoryRefreshTokenStore{tokens: make(map[string]RefreshToken), now: time.Now}
+}
+
+func (s *memoryRefreshTokenStore) Save(t RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.lastSweep) > time.Minute {
+		for hash, old := range s.tokens {
+			if now.After(old.ExpiresAt) {
+				delete(s.tokens, hash)
+			}
+		}
+		s.lastSweep = now
+	}
+	s.tokens[t.Hash] = t
+	return nil
+}
+
+func (s *memoryRefreshTokenStore) Consume(hash string) (RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[hash]
+	switch {
+	case !ok || t.Revoked || s.now().After(t.ExpiresAt):
+		return RefreshToken{}, ErrInvalidRefreshToken
+	case t.Used:
+		return t, ErrRefreshTokenReused
+	}
+	t.Used = true
+	s.tokens[hash] = t
+	return t, nil
+}
+
+func (s *memoryRefreshTokenStore) RevokeFamily(familyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, t := range s.tokens {
+		if t.FamilyID == familyID {
+			t.Revoked = true
+			s.tokens[hash] = t
+		}
+	}
+	return nil
+}
+
+func (s *memoryRefreshTokenStore) RevokeUser(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, t := range s.tokens {
+		if t.UserID == userID {
+			t.Revoked = true
+			s.tokens[hash] = t
+		}
+	}
+	return nil
+}
+
+// refreshTokens holds the issued refresh tokens.
+var refreshTokens RefreshTokenStore = newMemoryRefreshTokenStore()
+
+// hashToken returns the hex SHA-256 of an opaque token, the form in which tokens are stored.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newOpaqueToken returns a random 256-bit token in URL-safe base64.
+func newOpaqueToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms.
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// issueTokens returns an access token and a refresh token for user, for grant. The refresh
+// token joins familyID, or starts a new family if familyID is empty.
+func issueTokens(user *User, familyID string, grant tokenGrant) (tokenResponse, error) {
+	if familyID == "" {
+		familyID = newID()
+	}
+	accessToken, err := issueAccessToken(user, familyID, grant)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+
+	refreshToken := newOpaqueToken()
+	err = refreshTokens.Save(RefreshToken{
+		Hash:      hashToken(refreshToken),
+		FamilyID:  familyID,
+		UserID:    user.ID,
+		Grant:     grant,
+		ExpiresAt: time.Now().Add(tokenSettings.refreshTTL),
+	})
+	if err != nil {
+		return tokenResponse{}, err
+	}
+
+	resp := tokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(tokenSettings.accessTTL.Seconds()),
+		RefreshToken: refreshToken,
+	}
+	if grant.ClientID != "" {
+		resp.Scope = strings.Join(grant.scopes(user), " ")
+	}
+	return resp, nil
+}
+
+// rotateRefreshToken exchanges a refresh token issued to the OAuth client clientID, or to the
+// user's own logins if it is empty, for a new access and refresh token. Presenting a refresh
+// token that was already exchanged, or one issued to another client, means it has leaked, so
+// its whole family is revoked, along with the access tokens issued with it.
+func rotateRefreshToken(refreshToken, clientID string) (tokenResponse, error) {
+	old, err := refreshTokens.Consume(hashToken(refreshToken))
+	if errors.Is(err, ErrRefreshTokenReused) {
+		logrus.Warnf("Refresh token reuse detected for user %s; revoking token family %s", old.UserID, old.FamilyID)
+		if err := revokeSession(old.FamilyID); err != nil {
+			return tokenResponse{}, err
+		}
+		return tokenResponse{}, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	if old.Grant.ClientID != clientID {
+		logrus.Warnf("Refresh token of client %q presented by client %q; revoking token family %s", old.Grant.ClientID, clientID, old.FamilyID)
+		if err := revokeSession(old.FamilyID); err != nil {
+			return tokenResponse{}, err
+		}
+		return tokenResponse{}, ErrInvalidRefreshToken
+	}
+
+	user, err := userStore.GetByID(old.UserID)
+	if errors.Is(err, ErrUserNotFound) {
+		return tokenResponse{}, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	return issueTokens(user, old.FamilyID, old.Grant)
+}
+
+// refreshHandler exchanges the refresh_token in a JSON or form body for new tokens.
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	body, err := readAuthBody(w, r)
+	if err != nil {
+		writeJSONStatus(w, http.StatusBadRequest, oauthError{Error: "invalid_request", ErrorDescription: err.Error()})
+		return
+	}
+	if grant := body["grant_type"]; grant != "" && grant != "refresh_token" {
+		writeJSONStatus(w, http.StatusBadRequest, oauthError{Error: "unsupported_grant_type"})
+		return
+	}
+	if body["refresh_token"] == "" {
+		writeJSONStatus(w, http.StatusBadRequest, oauthError{Error: "invalid_request", ErrorDescription: "missing refresh_token"})
+		return
+	}
+
+	resp, err := rotateRefreshToken(body["refresh_token"], "")
+	if errors.Is(err, ErrInvalidRefreshToken) {
+		writeJSONStatus(w, http.StatusUnauthorized, oauthError{Error: "invalid_grant", ErrorDescription: "Invalid refresh token"})
+		return
+	}
+	if err != nil {
+		writeJSONStatus(w, http.StatusInternalServerError, oauthError{Error: "server_error"})
+		return
+	}
+	writeJSON(w, resp)
+}
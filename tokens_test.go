@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// signTestClaims signs arbitrary claims the way issueAccessToken does.
+func signTestClaims(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	token, err := signingKeys.sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// validTestClaims returns claims that parseAccessToken accepts.
+func validTestClaims() jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"sub": "user-id",
+		"iss": tokenSettings.issuer,
+		"aud": tokenSettings.audience,
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": now.Add(time.Minute).Unix(),
+	}
+}
+
+// TestParseAccessToken tests validation of exp, nbf, iss and aud.
+func TestParseAccessToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(jwt.MapClaims)
+		wantErr bool
+	}{
+		{name: "valid", modify: func(jwt.MapClaims) {}},
+		{name: "expired", modify: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }, wantErr: true},
+		{name: "no expiry", modify: func(c jwt.MapClaims) { delete(c, "exp") }, wantErr: true},
+		{name: "not yet valid", modify: func(c jwt.MapClaims) { c["nbf"] = time.Now().Add(time.Hour).Unix() }, wantErr: true},
+		{name: "no nbf", modify: func(c jwt.MapClaims) { delete(c, "nbf") }, wantErr: true},
+		{name: "wrong issuer", modify: func(c jwt.MapClaims) { c["iss"] = "someone-else" }, wantErr: true},
+		{name: "wrong audience", modify: func(c jwt.MapClaims) { c["aud"] = "another-api" }, wantErr: true},
+		{name: "no audience", modify: func(c jwt.MapClaims) { delete(c, "aud") }, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			claims := validTestClaims()
+			tc.modify(claims)
+			_, err := parseAccessToken(signTestClaims(t, claims))
+			if (err != nil) != tc.wantErr {
+				t.Errorf("expected error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+
+	issued, err := issueAccessToken(&User{ID: "u1", Username: "reader"}, "", tokenGrant{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := parseAccessToken(issued)
+	if err != nil {
+		t.Fatalf("expected an issued token to be valid, got %v", err)
+	}
+	if claims["sub"] != "u1" {
+		t.Errorf("unexpected sub %v", claims["sub"])
+	}
+}
+
+// useRefreshTokenStore swaps refreshTokens for the duration of a test.
+func useRefreshTokenStore(t *testing.T, store RefreshTokenStore) {
+	original := refreshTokens
+	refreshTokens = store
+	t.Cleanup(func() { refreshTokens = original })
+}
+
+// postRefresh calls refreshHandler with a JSON body.
+func postRefresh(refreshToken string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/auth/refresh", strings.NewReader(`{"refresh_token": "`+refreshToken+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	refreshHandler(rr, req)
+	return rr
+}
+
+// TestRefreshTokenRotation tests that each refresh rotates the refresh token, and that reusing
+// a rotated token revokes the whole family and its access tokens.
+func TestRefreshTokenRotation(t *testing.T) {
+	user := newTestUser(t, "reader", "readerpassword")
+	useRefreshTokenStore(t, newMemoryRefreshTokenStore())
+	useRevocationStore(t, newMemoryRevocationStore())
+
+	first, err := issueTokens(user, "", tokenGrant{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ExpiresIn != int64(tokenSettings.accessTTL.Seconds()) || first.RefreshToken == "" {
+		t.Fatalf("unexpected token response %+v", first)
+	}
+
+	rr := postRefresh(first.RefreshToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected refresh to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var second tokenResponse
+	if err := json.NewDecoder(rr.Body).Decode(&second); err != nil {
+		t.Fatal(err)
+	}
+	if second.RefreshToken == first.RefreshToken || second.AccessToken == "" {
+		t.Fatalf("expected a rotated refresh token, got %+v", second)
+	}
+	if _, err := parseAccessToken(second.AccessToken); err != nil {
+		t.Errorf("expected a valid access token, got %v", err)
+	}
+
+	// Replaying the first token is reuse: it fails and revokes the second token too.
+	if rr := postRefresh(first.RefreshToken); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected reuse to be rejected, got %d", rr.Code)
+	}
+	if rr := postRefresh(second.RefreshToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected the family to be revoked after reuse, got %d", rr.Code)
+	}
+	for _, accessToken := range []string{first.AccessToken, second.AccessToken} {
+		if rr := authorizedRequest("GET", "/api/cache/stats", accessToken); rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected the family's access tokens to be revoked after reuse, got %d", rr.Code)
+		}
+	}
+
+	// Other families are unaffected.
+	other, err := issueTokens(user, "", tokenGrant{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr := postRefresh(other.RefreshToken); rr.Code != http.StatusOK {
+		t.Errorf("expected an unrelated family to keep working, got %d", rr.Code)
+	}
+}
+
+// TestRefreshTokenExpiry tests that expired and unknown refresh tokens are rejected.
+func TestRefreshTokenExpiry(t *testing.T) {
+	store := newMemoryRefreshTokenStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	store.Save(RefreshToken{Hash: hashToken("t"), FamilyID: "f", UserID: "u", ExpiresAt: now.Add(time.Hour)})
+
+	now = now.Add(2 * time.Hour)
+	if _, err := store.Consume(hashToken("t")); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("expected an expired token to be invalid, got %v", err)
+	}
+	if _, err := store.Consume(hashToken("unknown")); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("expected an unknown token to be invalid, got %v", err)
+	}
+	if rr := postRefresh(""); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected a missing refresh_token to be a bad request, got %d", rr.Code)
+	}
+}
+
+// TestNewTokenConfigFromEnv tests that invalid token lifetimes are rejected at startup.
+func TestNewTokenConfigFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{"defaults", nil, false},
+		{"custom lifetimes", map[string]string{"ACCESS_TOKEN_TTL": "5m", "REFRESH_TOKEN_TTL": "24h"}, false},
+		{"zero access TTL", map[string]string{"ACCESS_TOKEN_TTL": "0"}, true},
+		{"negative access TTL", map[string]string{"ACCESS_TOKEN_TTL": "-1m"}, true},
+		{"zero refresh TTL", map[string]string{"REFRESH_TOKEN_TTL": "0"}, true},
+		{"negative refresh TTL", map[string]string{"REFRESH_TOKEN_TTL": "-1h"}, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, key := range []string{"ACCESS_TOKEN_TTL", "REFRESH_TOKEN_TTL"} {
+				t.Setenv(key, tc.env[key])
+			}
+			if _, err := newTokenConfigFromEnv(); (err != nil) != tc.wantErr {
+				t.Errorf("expected error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+// TestTokenGrantScopes tests that the user's own logins get all their scopes, and clients only
+// those they asked for, even when they asked for none.
+func TestTokenGrantScopes(t *testing.T) {
+	user := &User{Roles: []string{roleLibrarian}}
+	tests := []struct {
+		name  string
+		grant tokenGrant
+		want  []string
+	}{
+		{"own login", tokenGrant{}, []string{"books:read", "cache:read"}},
+		{"client", tokenGrant{ClientID: "c1", Scopes: []string{"openid", "books:read", "users:admin"}}, []string{"books:read", "openid"}},
+		{"client without scopes", tokenGrant{ClientID: "c1"}, []string{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.grant.scopes(user); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected scopes %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+// totpCodeAt returns the code an authenticator app would show for secret at t.
+func totpCodeAt(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hotp(key, uint64(totpStep(at)), totpDigits)
+}
+
+// TestHOTP tests the SHA-1 test vectors of RFC 6238 appendix B.
+func TestHOTP(t *testing.T) {
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tc := range tests {
+		if got := hotp(key, uint64(totpStep(time.Unix(tc.unix, 0))), 8); got != tc.want {
+			t.Errorf("at %d: expected %s, got %s", tc.unix, tc.want, got)
+		}
+	}
+}
+
+// TestVerifyTOTP tests that codes are accepted within the allowed clock drift, and only once.
+func TestVerifyTOTP(t *testing.T) {
+	secret := newTOTPSecret()
+	now := time.Date(2024, 1, 1, 12, 0, 10, 0, time.UTC)
+	step := totpStep(now)
+
+	tests := []struct {
+		name     string
+		code     string
+		lastStep int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current", totpCodeAt(t, secret, now), 0, step, true},
+		{"previous step", totpCodeAt(t, secret, now.Add(-totpPeriod)), 0, step - 1, true},
+		{"next step", totpCodeAt(t, secret, now.Add(totpPeriod)), 0, step + 1, true},
+		{"too old", totpCodeAt(t, secret, now.Add(-2*totpPeriod)), 0, 0, false},
+		{"too new", totpCodeAt(t, secret, now.Add(2*totpPeriod)), 0, 0, false},
+		{"already used", totpCodeAt(t, secret, now), step, 0, false},
+		{"later than last used", totpCodeAt(t, secret, now.Add(totpPeriod)), step, step + 1, true},
+		{"wrong length", "12345", 0, 0, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := verifyTOTP(secret, tc.code, now, tc.lastStep)
+			if ok != tc.wantOK || got != tc.wantStep {
+				t.Errorf("expected step %d, %v, got %d, %v", tc.wantStep, tc.wantOK, got, ok)
+			}
+		})
+	}
+
+	if _, ok := verifyTOTP("not base32!", "123456", now, 0); ok {
+		t.Error("expected an invalid secret to accept no codes")
+	}
+}
+
+// TestTOTPURI tests the enrolment URI authenticator apps scan.
+func TestTOTPURI(t *testing.T) {
+	u, err := url.Parse(totpURI("go-books", "alice", "JBSWY3DPEHPK3PXP"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/go-books:alice" {
+		t.Errorf("unexpected URI %s", u)
+	}
+	if q.Get("secret") != "JBSWY3DPEHPK3PXP" || q.Get("issuer") != "go-books" || q.Get("digits") != "6" || q.Get("period") != "30" {
+		t.Errorf("unexpected parameters %v", q)
+	}
+}
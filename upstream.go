@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrUpstreamUnavailable is returned when the upstream is considered unhealthy and requests
+// to it fail fast without being sent.
+var ErrUpstreamUnavailable = errors.New("upstream unavailable")
+
+// unavailableError is an ErrUpstreamUnavailable that says when to try again.
+type unavailableError struct {
+	retryAfter time.Duration
+}
+
+func (e *unavailableError) Error() string {
+	return fmt.Sprintf("%v: circuit breaker open, retry in %s", ErrUpstreamUnavailable, e.retryAfter.Round(time.Second))
+}
+
+func (e *unavailableError) Unwrap() error { return ErrUpstreamUnavailable }
+
+// statusError is an unexpected HTTP status from the upstream.
+type statusError struct {
+	code       int
+	retryAfter time.Duration // From the Retry-After header, if any.
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("upstream returned status %d", e.code)
+}
+
+// retryPolicy controls how failed upstream requests are retried.
+type retryPolicy struct {
+	retries   int           // Retries after the first attempt.
+	baseDelay time.Duration // Backoff before the first retry; doubles with each retry.
+	maxDelay  time.Duration // Upper bound of the backoff.
+}
+
+// backoff returns a random delay for the given retry (0-based) using "full jitter":
+// uniformly between zero and the capped exponential backoff.
+func (p retryPolicy) backoff(retry int) time.Duration {
+	d := p.baseDelay << retry
+	if d <= 0 || d > p.maxDelay {
+		d = p.maxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return rand.N(d)
+}
+
+// upstreamClient performs GET requests against a catalogue API, serving repeated requests
+// from an optional response cache and coalescing identical concurrent requests. Requests
+// are bounded by deadlines, retried on transient failures and guarded by a circuit breaker.
+type upstreamClient struct {
+	client  *http.Client
+	cache   *responseCache // nil disables caching.
+	flight  flightGroup
+	breaker *circuitBreaker
+	retry   retryPolicy
+
+	attemptTimeout time.Duration // Deadline for each attempt.
+	requestTimeout time.Duration // Deadline for a whole get, including retries.
+
+	// maxStale is the oldest cached response that is served when the upstream fails.
+	// Zero disables serving stale responses.
+	maxStale time.Duration
+}
+
+// newUpstreamClient returns a client with the default timeouts, retry policy and circuit breaker.
+func newUpstreamClient(client *http.Client, cache *responseCache) *upstreamClient {
+	return &upstreamClient{
+		client:         client,
+		cache:          cache,
+		breaker:        newCircuitBreaker(5, 30*time.Second),
+		retry:          retryPolicy{retries: 2, baseDelay: 200 * time.Millisecond, maxDelay: 5 * time.Second},
+		attemptTimeout: 5 * time.Second,
+		requestTimeout: 15 * time.Second,
+		maxStale:       time.Hour,
+	}
+}
+
+// newUpstreamClientFromEnv builds an upstream client configured by UPSTREAM_TIMEOUT,
+// UPSTREAM_REQUEST_TIMEOUT, UPSTREAM_RETRIES, UPSTREAM_BREAKER_THRESHOLD, UPSTREAM_BREAKER_COOLDOWN
+// and CACHE_MAX_STALE.
+func newUpstreamClientFromEnv(cache *responseCache) (*upstreamClient, error) {
+	u := newUpstreamClient(newUpstreamHTTPClient(), cache)
+
+	var err error
+	if u.attemptTimeout, err = envDuration("UPSTREAM_TIMEOUT", u.attemptTimeout); err != nil {
+		return nil, err
+	}
+	if u.attemptTimeout < 0 {
+		return nil, fmt.Errorf("UPSTREAM_TIMEOUT must not be negative, got %s", u.attemptTimeout)
+	}
+	if u.requestTimeout, err = envDuration("UPSTREAM_REQUEST_TIMEOUT", u.requestTimeout); err != nil {
+		return nil, err
+	}
+	if u.requestTimeout < 0 {
+		return nil, fmt.Errorf("UPSTREAM_REQUEST_TIMEOUT must not be negative, got %s", u.requestTimeout)
+	}
+	if u.retry.retries, err = envInt("UPSTREAM_RETRIES", u.retry.retries); err != nil {
+		return nil, err
+	}
+	if u.retry.retries < 0 {
+		return nil, fmt.Errorf("UPSTREAM_RETRIES must not be negative, got %d", u.retry.retries)
+	}
+	if u.breaker.threshold, err = envInt("UPSTREAM_BREAKER_THRESHOLD", u.breaker.threshold); err != nil {
+		return nil, err
+	}
+	if u.breaker.threshold < 1 {
+		return nil, fmt.Errorf("UPSTREAM_BREAKER_THRESHOLD must be at least 1, got %d", u.breaker.threshold)
+	}
+	if u.breaker.cooldown, err = envDuration("UPSTREAM_BREAKER_COOLDOWN", u.breaker.cooldown); err != nil {
+		return nil, err
+	}
+	if u.breaker.cooldown < 0 {
+		return nil, fmt.Errorf("UPSTREAM_BREAKER_COOLDOWN must not be negative, got %s", u.breaker.cooldown)
+	}
+	if u.maxStale, err = envDuration("CACHE_MAX_STALE", u.maxStale); err != nil {
+		return nil, err
+	}
+	if u.maxStale < 0 {
+		return nil, fmt.Errorf("CACHE_MAX_STALE must not be negative, got %s", u.maxStale)
+	}
+	return u, nil
+}
+
+// newUpstreamHTTPClient returns an HTTP client with connection-level timeouts, so a stalled
+// upstream cannot hold a connection open indefinitely.
+func newUpstreamHTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+			TLSHandshakeTimeout:   5 * time.Second,
+			ResponseHeaderTimeout: 10 * time.Second,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConnsPerHost:   16,
+		},
+	}
+}
+
+// get fetches url and returns the response body. Cached bodies are revalidated with the
+// upstream once they expire. If the upstream fails, a cached body up to maxStale old is
+// served instead.
+func (u *upstreamClient) get(ctx context.Context, url string) ([]byte, error) {
+	if u.cache != nil {
+		if cached, fresh, ok := u.cache.get(url); ok && fresh {
+			u.cache.record(cacheHit)
+			recordFetch(ctx, cacheHit, false)
+			return cached.Body, nil
+		}
+	}
+
+	if u.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, u.requestTimeout)
+		defer cancel()
+	}
+	result, shared, err := u.flight.do(ctx, url, func(ctx context.Context) (upstreamResult, error) {
+		return u.load(ctx, url)
+	})
+	if err != nil {
+		if body, ok := u.staleIfError(ctx, url, err); ok {
+			return body, nil
+		}
+		return nil, err
+	}
+	if u.cache != nil {
+		u.cache.record(result.cacheStatus)
+	}
+	recordFetch(ctx, result.cacheStatus, !shared)
+	return result.body, nil
+}
+
+// staleIfError returns the cached body for url if the upstream failed with err and the cached
+// copy is no older than maxStale. Missing resources and abandoned requests are not covered.
+func (u *upstreamClient) staleIfError(ctx context.Context, url string, err error) ([]byte, bool) {
+	if u.cache == nil || u.maxStale <= 0 || errors.Is(err, ErrNotFound) || errors.Is(err, context.Canceled) {
+		return nil, false
+	}
+	cached, _, ok := u.cache.get(url)
+	if !ok {
+		return nil, false
+	}
+	age := u.cache.now().Sub(cached.StoredAt)
+	if age > u.maxStale {
+		return nil, false
+	}
+
+	logrus.Warnf("Serving %s old cached response for %s after upstream error: %v", age.Round(time.Second), url, err)
+	u.cache.record(cacheStale)
+	u.cache.recordStaleIfError()
+	recordFetch(ctx, cacheStale, false)
+	recordStale(ctx, age)
+	return cached.Body, true
+}
+
+// load fetches url from the upstream, revalidating the cached copy if there is one.
+func (u *upstreamClient) load(ctx context.Context, url string) (upstreamResult, error) {
+	var cached cacheEntry
+	if u.cache != nil {
+		cached, _, _ = u.cache.get(url)
+	}
+
+	body, notModified, err := u.fetchWithRetry(ctx, url, cached)
+	if err != nil {
+		return upstreamResult{}, err
+	}
+	if notModified {
+		u.cache.refresh(url)
+		u.cache.recordRevalidation()
+		return upstreamResult{body: cached.Body, cacheStatus: cacheStale}, nil
+	}
+	return upstreamResult{body: body, cacheStatus: cacheMiss}, nil
+}
+
+// fetchWithRetry sends the request through the circuit breaker, retrying network errors,
+// 5xx and 429 responses with jittered exponential backoff. A Retry-After header from the
+// upstream takes precedence over the backoff.
+func (u *upstreamClient) fetchWithRetry(ctx context.Context, url string, cached cacheEntry) (body []byte, notModified bool, err error) {
+	if u.breaker != nil {
+		if retryAfter, ok := u.breaker.allow(); !ok {
+			return nil, false, &unavailableError{retryAfter: retryAfter}
+		}
+	}
+
+	for retry := 0; ; retry++ {
+		body, notModified, err = u.fetch(ctx, url, cached)
+		if err == nil || !retryable(err) || retry >= u.retry.retries || ctx.Err() != nil {
+			break
+		}
+
+		delay := u.retry.backoff(retry)
+		var status *statusError
+		if errors.As(err, &status) && status.retryAfter > 0 {
+			delay = status.retryAfter
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			break // Waiting would outlast the request; fail now instead.
+		}
+		if !sleepContext(ctx, delay) {
+			err = ctx.Err()
+			break
+		}
+	}
+
+	if u.breaker != nil {
+		switch {
+		case err == nil || errors.Is(err, ErrNotFound):
+			u.breaker.success()
+		case errors.Is(err, context.Canceled):
+			u.breaker.release()
+		default:
+			u.breaker.failure()
+		}
+	}
+	return body, notModified, err
+}
+
+// sleepContext waits for d, returning false if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// retryable reports whether a failed attempt may succeed if repeated.
+func retryable(err error) bool {
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.code == http.StatusTooManyRequests || status.code >= 500
+	}
+	return !errors.Is(err, ErrNotFound) && !errors.Is(err, context.Canceled)
+}
+
+// fetch sends a single attempt, conditional on the validators in cached if it has any. It
+// returns notModified if the upstream answered 304. Successful responses are stored in the cache.
+func (u *upstreamClient) fetch(ctx context.Context, url string, cached cacheEntry) (body []byte, notModified bool, err error) {
+	if u.attemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, u.attemptTimeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if cached.ETag != "" {
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+	if cached.LastModified != "" {
+		req.Header.Set("If-Modified-Since", cached.LastModified)
+	}
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached.Body != nil:
+		return nil, true, nil
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, false, ErrNotFound
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return nil, false, &statusError{code: resp.StatusCode, retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	if u.cache != nil {
+		u.cache.put(url, body, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"))
+	}
+	return body, false, nil
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as an HTTP date.
+// It returns 0 if the header is absent or invalid.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// fetchInfo records how the upstream data for one incoming request was obtained.
+type fetchInfo struct {
+	mu            sync.Mutex
+	cacheStatus   string
+	upstreamCalls int
+	stale         bool          // A cached response was served because the upstream failed.
+	staleAge      time.Duration // Age of the oldest such response.
+}
+
+type fetchInfoKey struct{}
+
+// withFetchInfo returns a context that records upstream fetches made on its behalf. If ctx
+// already records them, for example to charge the request's cost, the record is shared.
+func withFetchInfo(ctx context.Context) (context.Context, *fetchInfo) {
+	if info, ok := ctx.Value(fetchInfoKey{}).(*fetchInfo); ok {
+		return ctx, info
+	}
+	info := &fetchInfo{}
+	return context.WithValue(ctx, fetchInfoKey{}, info), info
+}
+
+// recordFetch notes a fetch in the fetchInfo carried by ctx, if any.
+func recordFetch(ctx context.Context, cacheStatus string, upstreamCall bool) {
+	info, ok := ctx.Value(fetchInfoKey{}).(*fetchInfo)
+	if !ok {
+		return
+	}
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.cacheStatus = cacheStatus
+	if upstreamCall {
+		info.upstreamCalls++
+	}
+}
+
+// recordStale notes in the fetchInfo carried by ctx, if any, that a cached response of the
+// given age was served in place of a failed upstream request.
+func recordStale(ctx context.Context, age time.Duration) {
+	info, ok := ctx.Value(fetchInfoKey{}).(*fetchInfo)
+	if !ok {
+		return
+	}
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.stale = true
+	if age > info.staleAge {
+		info.staleAge = age
+	}
+}
+
+// Stale reports whether stale data was served because the upstream failed, and how old it was.
+func (f *fetchInfo) Stale() (age time.Duration, stale bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.staleAge, f.stale
+}
+
+// CacheStatus returns the cache status of the most recent fetch, or "" if nothing was fetched.
+func (f *fetchInfo) CacheStatus() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.cacheStatus
+}
+
+// UpstreamCalls returns the number of requests that were sent to the upstream.
+func (f *fetchInfo) UpstreamCalls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.upstreamCalls
+}
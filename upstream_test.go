@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestUpstreamClientCaching tests cache hits, misses and ETag revalidation of expired entries.
+func TestUpstreamClientCaching(t *testing.T) {
+	calls := 0
+	var lastIfNoneMatch string
+	rt := RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		lastIfNoneMatch = req.Header.Get("If-None-Match")
+		if lastIfNoneMatch == `"v1"` {
+			return newResponse(http.StatusNotModified, ""), nil
+		}
+		resp := newResponse(http.StatusOK, `{"docs": []}`)
+		resp.Header.Set("ETag", `"v1"`)
+		return resp, nil
+	})
+	cache, now := newTestCache(10, time.Minute)
+	upstream := newTestUpstreamClient(rt, cache)
+
+	get := func(wantStatus string, wantCalls int) {
+		t.Helper()
+		ctx, info := withFetchInfo(context.Background())
+		body, err := upstream.get(ctx, "https://upstream.test/search.json?q=x")
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if string(body) != `{"docs": []}` {
+			t.Errorf("unexpected body %q", body)
+		}
+		if info.CacheStatus() != wantStatus {
+			t.Errorf("expected cache status %s, got %s", wantStatus, info.CacheStatus())
+		}
+		if calls != wantCalls {
+			t.Errorf("expected %d upstream calls, got %d", wantCalls, calls)
+		}
+	}
+
+	get(cacheMiss, 1)
+	get(cacheHit, 1)
+
+	*now = now.Add(2 * time.Minute)
+	get(cacheStale, 2)
+	if lastIfNoneMatch != `"v1"` {
+		t.Errorf("expected revalidation with If-None-Match, got %q", lastIfNoneMatch)
+	}
+	get(cacheHit, 2)
+
+	stats := cache.Stats()
+	if stats.Hits != 2 || stats.Misses != 1 || stats.Stale != 1 || stats.Revalidated != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+// TestUpstreamClientRetries tests that transient failures are retried and permanent ones are not.
+func TestUpstreamClientRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []int // Status codes returned in turn; 0 simulates a network error.
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "retry 5xx then succeed", responses: []int{503, 502, 200}, wantCalls: 3},
+		{name: "retry 429", responses: []int{429, 200}, wantCalls: 2},
+		{name: "retry network error", responses: []int{0, 200}, wantCalls: 2},
+		{name: "give up after retries", responses: []int{500, 500, 500, 200}, wantCalls: 3, wantErr: true},
+		{name: "no retry on 404", responses: []int{404, 200}, wantCalls: 1, wantErr: true},
+		{name: "no retry on 400", responses: []int{400, 200}, wantCalls: 1, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			upstream := newTestUpstreamClient(func(req *http.Request) (*http.Response, error) {
+				status := tc.responses[calls]
+				calls++
+				if status == 0 {
+					return nil, errors.New("connection reset")
+				}
+				return newResponse(status, `{}`), nil
+			}, nil)
+
+			_, err := upstream.get(context.Background(), "https://upstream.test/x")
+			if (err != nil) != tc.wantErr {
+				t.Errorf("expected error %v, got %v", tc.wantErr, err)
+			}
+			if calls != tc.wantCalls {
+				t.Errorf("expected %d calls, got %d", tc.wantCalls, calls)
+			}
+		})
+	}
+}
+
+// TestUpstreamClientRetryAfter tests that Retry-After is honoured, and that a retry that would
+// outlast the request deadline is not attempted.
+func TestUpstreamClientRetryAfter(t *testing.T) {
+	var times []time.Time
+	upstream := newTestUpstreamClient(func(req *http.Request) (*http.Response, error) {
+		times = append(times, time.Now())
+		if len(times) == 1 {
+			resp := newResponse(http.StatusTooManyRequests, "")
+			resp.Header.Set("Retry-After", "1")
+			return resp, nil
+		}
+		return newResponse(http.StatusOK, `{}`), nil
+	}, nil)
+
+	if _, err := upstream.get(context.Background(), "https://upstream.test/x"); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if len(times) != 2 || times[1].Sub(times[0]) < time.Second {
+		t.Errorf("expected a retry after at least 1s, got %d calls", len(times))
+	}
+
+	times = nil
+	upstream.requestTimeout = 100 * time.Millisecond
+	start := time.Now()
+	if _, err := upstream.get(context.Background(), "https://upstream.test/y"); err == nil {
+		t.Fatal("expected an error when Retry-After exceeds the deadline")
+	}
+	if len(times) != 1 || time.Since(start) > 50*time.Millisecond {
+		t.Errorf("expected to fail fast without retrying, got %d calls in %s", len(times), time.Since(start))
+	}
+}
+
+// TestUpstreamClientDeadline tests that a hanging upstream is abandoned at the incoming request's deadline.
+func TestUpstreamClientDeadline(t *testing.T) {
+	upstream := newTestUpstreamClient(func(req *http.Request) (*http.Response, error) {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := upstream.get(ctx, "https://upstream.test/slow")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected to give up at the deadline, took %s", elapsed)
+	}
+}
+
+// TestNewUpstreamClientFromEnv tests that invalid upstream settings are rejected at startup.
+func TestNewUpstreamClientFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{"defaults", nil, false},
+		{"no timeouts", map[string]string{"UPSTREAM_TIMEOUT": "0", "UPSTREAM_REQUEST_TIMEOUT": "0"}, false},
+		{"no retries", map[string]string{"UPSTREAM_RETRIES": "0"}, false},
+		{"negative timeout", map[string]string{"UPSTREAM_TIMEOUT": "-1s"}, true},
+		{"negative request timeout", map[string]string{"UPSTREAM_REQUEST_TIMEOUT": "-1s"}, true},
+		{"negative retries", map[string]string{"UPSTREAM_RETRIES": "-1"}, true},
+		{"zero breaker threshold", map[string]string{"UPSTREAM_BREAKER_THRESHOLD": "0"}, true},
+		{"negative breaker cooldown", map[string]string{"UPSTREAM_BREAKER_COOLDOWN": "-1s"}, true},
+		{"no stale responses", map[string]string{"CACHE_MAX_STALE": "0"}, false},
+		{"negative max stale", map[string]string{"CACHE_MAX_STALE": "-1m"}, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, key := range []string{"UPSTREAM_TIMEOUT", "UPSTREAM_REQUEST_TIMEOUT", "UPSTREAM_RETRIES", "UPSTREAM_BREAKER_THRESHOLD", "UPSTREAM_BREAKER_COOLDOWN", "CACHE_MAX_STALE"} {
+				t.Setenv(key, tc.env[key])
+			}
+			if _, err := newUpstreamClientFromEnv(nil); (err != nil) != tc.wantErr {
+				t.Errorf("expected error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+// TestSearchCircuitBreaker tests that /api/search fails fast with 503 once the upstream is unhealthy.
+func TestSearchCircuitBreaker(t *testing.T) {
+	calls := 0
+	provider := newTestOpenLibrary(func(req *http.Request) (*http.Response, error) {
+		calls++
+		return newResponse(http.StatusInternalServerError, ""), nil
+	})
+	provider.upstream.retry.retries = 0
+	provider.upstream.breaker = newCircuitBreaker(2, time.Minute)
+	useProvider(t, provider)
+
+	search := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		searchHandler(rr, httptest.NewRequest("GET", "/api/search?author=x", nil))
+		return rr
+	}
+	for i := 0; i < 2; i++ {
+		if rr := search(); rr.Code != http.StatusInternalServerError {
+			t.Fatalf("expected 500 before the breaker opens, got %d", rr.Code)
+		}
+	}
+
+	rr := search()
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 once the breaker is open, got %d", rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "circuit breaker open") {
+		t.Errorf("expected a clear error body, got %q", rr.Body.String())
+	}
+	if rr.Header().Get("Retry-After") != "60" {
+		t.Errorf("expected Retry-After: 60, got %q", rr.Header().Get("Retry-After"))
+	}
+	if calls != 2 {
+		t.Errorf("expected the open breaker to stop upstream calls, got %d", calls)
+	}
+}
+
+// TestSearchStaleIfError tests that cached results are served, flagged as stale, while the
+// upstream is down, but only up to the configured maximum staleness.
+func TestSearchStaleIfError(t *testing.T) {
+	down := false
+	cache, now := newTestCache(10, time.Minute)
+	provider := newOpenLibrary("https://openlibrary.test", newTestUpstreamClient(func(req *http.Request) (*http.Response, error) {
+		if down {
+			return nil, errors.New("connection refused")
+		}
+		return newResponse(http.StatusOK, `{"numFound": 1, "docs": [{"title": "Cached Book"}]}`), nil
+	}, cache))
+	provider.upstream.maxStale = time.Hour
+	useProvider(t, provider)
+
+	search := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		searchHandler(rr, httptest.NewRequest("GET", "/api/search?author=x", nil))
+		return rr
+	}
+
+	if rr := search(); rr.Code != http.StatusOK || rr.Header().Get("X-Cache") != cacheMiss {
+		t.Fatalf("expected a 200 cache miss, got %d %q", rr.Code, rr.Header().Get("X-Cache"))
+	}
+
+	down = true
+	*now = now.Add(10 * time.Minute)
+	rr := search()
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "Cached Book") {
+		t.Fatalf("expected the stale result, got %d %q", rr.Code, rr.Body.String())
+	}
+	for header, want := range map[string]string{"X-Cache": cacheStale, "X-Data-Stale": "true", "Age": "600"} {
+		if got := rr.Header().Get(header); got != want {
+			t.Errorf("expected %s: %s, got %q", header, want, got)
+		}
+	}
+	if rr.Header().Get("Warning") == "" {
+		t.Error("expected a Warning header")
+	}
+
+	*now = now.Add(time.Hour)
+	if rr := search(); rr.Code != http.StatusInternalServerError || rr.Header().Get("X-Data-Stale") != "" {
+		t.Errorf("expected an error beyond the maximum staleness, got %d", rr.Code)
+	}
+
+	if stats := cache.Stats(); stats.StaleIfError != 1 {
+		t.Errorf("expected 1 stale-if-error response in stats, got %+v", stats)
+	}
+}
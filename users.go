@@ -0,0 +1,346 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrUserNotFound is returned by a UserStore when no user matches.
+	ErrUserNotFound = errors.New("user not found")
+	// ErrUserExists is returned by a UserStore when the username is already taken.
+	ErrUserExists = errors.New("username already taken")
+	// ErrInvalidCredentials is returned by authenticate for an unknown user or a wrong password.
+	ErrInvalidCredentials = errors.New("invalid username or password")
+)
+
+// bcryptCost is the work factor for password hashes. Tests lower it to keep them fast.
+var bcryptCost = 12
+
+// Password length limits. bcrypt ignores everything after 72 bytes, so longer passwords are refused.
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 72
+)
+
+var validUsername = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{2,63}$`)
+
+// User is a registered account.
+type User struct {
+	ID           string    `json:"id"`
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"password_hash"`
+	Roles        []string  `json:"roles,omitempty"`
+	Scopes       []string  `json:"scopes,omitempty"` // Granted in addition to those of the roles.
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+
+	// Two-factor authentication; see mfa.go.
+	TOTPSecret    string   `json:"totp_secret,omitempty"`    // Base32; set once enrolment is confirmed.
+	TOTPPending   string   `json:"totp_pending,omitempty"`   // Secret awaiting its first code during enrolment.
+	TOTPLastStep  int64    `json:"totp_last_step,omitempty"` // Time step of the last code used.
+	RecoveryCodes []string `json:"recovery_codes,omitempty"` // SHA-256 of the unused recovery codes.
+}
+
+// clone returns a copy of u that shares no slices with it.
+func (u User) clone() *User {
+	u.Roles = append([]string(nil), u.Roles...)
+	u.Scopes = append([]string(nil), u.Scopes...)
+	u.RecoveryCodes = append([]string(nil), u.RecoveryCodes...)
+	return &u
+}
+
+// MFAEnabled reports whether the user must present a second factor to log in.
+func (u *User) MFAEnabled() bool {
+	return u.TOTPSecret != ""
+}
+
+// SetPassword replaces the user's password hash after checking the password length.
+func (u *User) SetPassword(password string) error {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return fmt.Errorf("password must be between %d and %d characters", minPasswordLength, maxPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = string(hash)
+	return nil
+}
+
+// CheckPassword reports whether password matches the user's password hash.
+func (u *User) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+}
+
+// UserStore persists user accounts. Implementations must be safe for concurrent use and
+// return copies, so callers can modify a returned User and pass it to Update.
+type UserStore interface {
+	// Create stores a new user, assigning its ID and timestamps.
+	Create(u *User) error
+	// GetByID returns the user with the given ID.
+	GetByID(id string) (*User, error)
+	// GetByUsername returns the user with the given (normalized) username.
+	GetByUsername(username string) (*User, error)
+	// Update replaces a stored user.
+	Update(u *User) error
+	// Delete removes a user.
+	Delete(id string) error
+}
+
+// normalizeUsername lower-cases and trims a username so lookups are case-insensitive.
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// registerUser creates an account with a hashed password.
+func registerUser(store UserStore, username, password string) (*User, error) {
+	username = normalizeUsername(username)
+	if !validUsername.MatchString(username) {
+		return nil, errors.New("username must be 3-64 characters of letters, digits, '.', '_' or '-'")
+	}
+	u := &User{Username: username, Roles: []string{roleReader}}
+	if err := u.SetPassword(password); err != nil {
+		return nil, err
+	}
+	if err := store.Create(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// dummyHash is a password hash at bcryptCost that authenticate checks passwords for unknown
+// users against, so that they take as long to reject as wrong passwords for known ones.
+var dummyHash struct {
+	sync.Mutex
+	cost int
+	hash []byte
+}
+
+// dummyPasswordHash returns the dummy hash, generating it for the current bcryptCost.
+func dummyPasswordHash() []byte {
+	dummyHash.Lock()
+	defer dummyHash.Unlock()
+	if dummyHash.hash == nil || dummyHash.cost != bcryptCost {
+		hash, err := bcrypt.GenerateFromPassword([]byte(newID()), bcryptCost)
+		if err != nil {
+			panic(err) // Only fails for invalid costs or passwords over 72 bytes.
+		}
+		dummyHash.cost, dummyHash.hash = bcryptCost, hash
+	}
+	return dummyHash.hash
+}
+
+// authenticate returns the user identified by username and password, or ErrInvalidCredentials.
+func authenticate(store UserStore, username, password string) (*User, error) {
+	u, err := store.GetByUsername(normalizeUsername(username))
+	if errors.Is(err, ErrUserNotFound) {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !u.CheckPassword(password) {
+		return nil, ErrInvalidCredentials
+	}
+	return u, nil
+}
+
+// newID returns a random 128-bit identifier in hex.
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms.
+	}
+	return hex.EncodeToString(b)
+}
+
+// memoryUserStore is a UserStore that keeps users in memory.
+type memoryUserStore struct {
+	mu    sync.RWMutex
+	users map[string]User // By ID.
+	now   func() time.Time
+}
+
+// newMemoryUserStore returns an empty in-memory user store.
+func newMemoryUserStore() *memoryUserStore {
+	return &memoryUserStore{users: make(map[string]User), now: time.Now}
+}
+
+func (s *memoryUserStore) Create(u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.byUsername(u.Username); err == nil {
+		return ErrUserExists
+	}
+	u.ID = newID()
+	u.CreatedAt = s.now()
+	u.UpdatedAt = u.CreatedAt
+	s.users[u.ID] = *u.clone()
+	return nil
+}
+
+func (s *memoryUserStore) GetByID(id string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return u.clone(), nil
+}
+
+func (s *memoryUserStore) GetByUsername(username string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.byUsername(username)
+}
+
+// byUsername finds a user by username. s.mu must be held.
+func (s *memoryUserStore) byUsername(username string) (*User, error) {
+	for _, u := range s.users {
+		if u.Username == username {
+			return u.clone(), nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+func (s *memoryUserStore) Update(u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[u.ID]; !ok {
+		return ErrUserNotFound
+	}
+	if other, err := s.byUsername(u.Username); err == nil && other.ID != u.ID {
+		return ErrUserExists
+	}
+	u.UpdatedAt = s.now()
+	s.users[u.ID] = *u.clone()
+	return nil
+}
+
+func (s *memoryUserStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[id]; !ok {
+		return ErrUserNotFound
+	}
+	delete(s.users, id)
+	return nil
+}
+
+// fileUserStore is a UserStore that keeps users in memory and writes them all to a JSON
+// file after every change.
+type fileUserStore struct {
+	*memoryUserStore
+	path string
+	save sync.Mutex // Serializes writes to path.
+}
+
+// newFileUserStore returns a user store backed by path, loading any users already in it.
+func newFileUserStore(path string) (*fileUserStore, error) {
+	s := &fileUserStore{memoryUserStore: newMemoryUserStore(), path: path}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var users []User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	for _, u := range users {
+		s.users[u.ID] = u
+	}
+	return s, nil
+}
+
+func (s *fileUserStore) Create(u *User) error {
+	return s.persist(s.memoryUserStore.Create(u))
+}
+
+func (s *fileUserStore) Update(u *User) error {
+	return s.persist(s.memoryUserStore.Update(u))
+}
+
+func (s *fileUserStore) Delete(id string) error {
+	return s.persist(s.memoryUserStore.Delete(id))
+}
+
+// persist writes the users to the file unless err reports that the change failed.
+func (s *fileUserStore) persist(err error) error {
+	if err != nil {
+		return err
+	}
+	s.save.Lock()
+	defer s.save.Unlock()
+
+	s.mu.RLock()
+	users := make([]User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	s.mu.RUnlock()
+
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// userStore holds the registered accounts. It is replaced at startup by newUserStoreFromEnv.
+var userStore UserStore = newMemoryUserStore()
+
+// newUserStoreFromEnv returns a file-backed user store if USER_STORE_FILE is set, or an
+// in-memory one otherwise.
+func newUserStoreFromEnv() (UserStore, error) {
+	if path := os.Getenv("USER_STORE_FILE"); path != "" {
+		return newFileUserStore(path)
+	}
+	return newMemoryUserStore(), nil
+}
+
+// registerHandler creates an account from the username and password in a JSON or form body.
+func registerHandler(w http.ResponseWriter, r *http.Request) {
+	creds, err := readCredentials(w, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid registration: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	u, err := registerUser(userStore, creds.Username, creds.Password)
+	switch {
+	case errors.Is(err, ErrUserExists):
+		http.Error(w, "Username already taken", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("Invalid registration: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	writeJSONStatus(w, http.StatusCreated, map[string]string{"id": u.ID, "username": u.Username})
+}
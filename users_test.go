@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func init() {
+	// Keep password hashing fast in tests.
+	bcryptCost = bcrypt.MinCost
+}
+
+// useUserStore swaps userStore for the duration of a test.
+func useUserStore(t *testing.T, store UserStore) {
+	original := userStore
+	userStore = store
+	t.Cleanup(func() { userStore = original })
+}
+
+// testUserStores returns one of each UserStore implementation.
+func testUserStores(t *testing.T) map[string]func() UserStore {
+	return map[string]func() UserStore{
+		"memory": func() UserStore { return newMemoryUserStore() },
+		"file": func() UserStore {
+			store, err := newFileUserStore(filepath.Join(t.TempDir(), "users.json"))
+			if err != nil {
+				t.Fatalf("newFileUserStore: %v", err)
+			}
+			return store
+		},
+	}
+}
+
+// TestUserStores tests the register, lookup, update and delete operations of every UserStore.
+func TestUserStores(t *testing.T) {
+	for name, newStore := range testUserStores(t) {
+		t.Run(name, func(t *testing.T) {
+			store := newStore()
+
+			u, err := registerUser(store, " Alice ", "correct horse")
+			if err != nil {
+				t.Fatalf("registerUser: %v", err)
+			}
+			if u.ID == "" || u.Username != "alice" || u.PasswordHash == "correct horse" {
+				t.Errorf("unexpected user %+v", u)
+			}
+			if _, err := registerUser(store, "ALICE", "another password"); !errors.Is(err, ErrUserExists) {
+				t.Errorf("expected ErrUserExists for a duplicate username, got %v", err)
+			}
+
+			got, err := store.GetByUsername("alice")
+			if err != nil || got.ID != u.ID {
+				t.Fatalf("GetByUsername: got %+v, %v", got, err)
+			}
+			if err := got.SetPassword("new password"); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Update(got); err != nil {
+				t.Fatalf("Update: %v", err)
+			}
+			if _, err := authenticate(store, "alice", "correct horse"); !errors.Is(err, ErrInvalidCredentials) {
+				t.Errorf("expected the old password to be rejected, got %v", err)
+			}
+			if _, err := authenticate(store, "Alice", "new password"); err != nil {
+				t.Errorf("expected the new password to be accepted, got %v", err)
+			}
+
+			if err := store.Delete(u.ID); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			if _, err := store.GetByID(u.ID); !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("expected ErrUserNotFound after delete, got %v", err)
+			}
+			if err := store.Update(u); !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("expected ErrUserNotFound updating a deleted user, got %v", err)
+			}
+		})
+	}
+}
+
+// TestFileUserStorePersistence tests that users survive reopening the file store.
+func TestFileUserStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	store, err := newFileUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := registerUser(store, "bob", "hunter2hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := newFileUserStore(path)
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	got, err := authenticate(reopened, "bob", "hunter2hunter2")
+	if err != nil || got.ID != u.ID {
+		t.Errorf("expected bob to authenticate after reopening, got %+v, %v", got, err)
+	}
+}
+
+// TestAuthenticate tests the wrong-password and unknown-user paths.
+func TestAuthenticate(t *testing.T) {
+	store := newMemoryUserStore()
+	if _, err := registerUser(store, "carol", "s3cret-pass"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		wantErr  error
+	}{
+		{"valid", "carol", "s3cret-pass", nil},
+		{"wrong password", "carol", "wrong-pass", ErrInvalidCredentials},
+		{"unknown user", "mallory", "s3cret-pass", ErrInvalidCredentials},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := authenticate(store, tc.username, tc.password); !errors.Is(err, tc.wantErr) {
+				t.Errorf("expected %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+// TestRegisterHandler tests account creation over HTTP.
+func TestRegisterHandler(t *testing.T) {
+	useUserStore(t, newMemoryUserStore())
+
+	register := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/register", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		registerHandler(rr, req)
+		return rr
+	}
+
+	tests := []struct {
+		name                  string
+		form                  url.Values
+		expectedStatus        int
+		expectedBodySubstring string
+	}{
+		{"created", url.Values{"username": {"dave"}, "password": {"long enough"}}, http.StatusCreated, `"username":"dave"`},
+		{"duplicate", url.Values{"username": {"Dave"}, "password": {"long enough"}}, http.StatusConflict, "already taken"},
+		{"short password", url.Values{"username": {"erin"}, "password": {"short"}}, http.StatusBadRequest, "password must be"},
+		{"bad username", url.Values{"username": {"a b"}, "password": {"long enough"}}, http.StatusBadRequest, "username must be"},
+		{"missing password", url.Values{"username": {"erin"}}, http.StatusBadRequest, "missing credentials"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := register(tc.form)
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d", tc.expectedStatus, rr.Code)
+			}
+			if !strings.Contains(rr.Body.String(), tc.expectedBodySubstring) {
+				t.Errorf("expected response body to contain %q, got %q", tc.expectedBodySubstring, rr.Body.String())
+			}
+		})
+	}
+}